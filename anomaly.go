@@ -0,0 +1,304 @@
+package mozzle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+
+	cfevent "github.com/cloudfoundry/sonde-go/events"
+)
+
+// Default anomaly detection configuration.
+const (
+	DefaultAnomalyAlpha      = 0.05
+	DefaultAnomalyWarn       = 3.0
+	DefaultAnomalyCritical   = 5.0
+	DefaultAnomalyMinSamples = 30
+)
+
+// AnomalyDetection configures the detection of anomalies in the HTTP
+// response times and 5xx ratios of applications. On every refresh, the
+// values since the previous one are compared to their rolling baselines and
+// their z-scores are emitted.
+type AnomalyDetection struct {
+	// Alpha is the smoothing factor of the baselines, between 0 and 1.
+	// Higher values adapt to changes faster. Defaults to
+	// DefaultAnomalyAlpha.
+	Alpha float64
+	// Warn and Critical are the z-scores at or above which a value is in
+	// warn or critical state. They default to DefaultAnomalyWarn and
+	// DefaultAnomalyCritical.
+	Warn     float64
+	Critical float64
+	// MinSamples is the number of samples a baseline needs before values
+	// are reported in warn or critical state. Defaults to
+	// DefaultAnomalyMinSamples.
+	MinSamples int
+	// Store persists the baselines, so that they survive restarts.
+	// Defaults to a MemoryBaselineStore.
+	Store BaselineStore
+}
+
+func (a *AnomalyDetection) init() {
+	if a.Alpha == 0 {
+		a.Alpha = DefaultAnomalyAlpha
+	}
+	if a.Warn == 0 {
+		a.Warn = DefaultAnomalyWarn
+	}
+	if a.Critical == 0 {
+		a.Critical = DefaultAnomalyCritical
+	}
+	if a.MinSamples == 0 {
+		a.MinSamples = DefaultAnomalyMinSamples
+	}
+	if a.Store == nil {
+		a.Store = new(MemoryBaselineStore)
+	}
+}
+
+// Baseline is the rolling baseline of a metric - its exponentially weighted
+// moving mean and variance.
+type Baseline struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	// Samples is the number of samples the baseline is based on.
+	Samples int `json:"samples"`
+}
+
+// ZScore returns the number of standard deviations x is away from the
+// mean, or 0, if there is no deviation yet.
+func (b Baseline) ZScore(x float64) float64 {
+	if b.Variance <= 0 {
+		return 0
+	}
+	return (x - b.Mean) / math.Sqrt(b.Variance)
+}
+
+// Update returns the baseline updated with the sample x.
+func (b Baseline) Update(x, alpha float64) Baseline {
+	if b.Samples == 0 {
+		return Baseline{Mean: x, Samples: 1}
+	}
+	diff := x - b.Mean
+	incr := alpha * diff
+	return Baseline{
+		Mean:     b.Mean + incr,
+		Variance: (1 - alpha) * (b.Variance + diff*incr),
+		Samples:  b.Samples + 1,
+	}
+}
+
+// BaselineStore stores baselines by key. Implementations should be safe for
+// concurrent use.
+type BaselineStore interface {
+	// Load returns all stored baselines.
+	Load() (map[string]Baseline, error)
+	// Save replaces the stored baselines with b.
+	Save(b map[string]Baseline) error
+}
+
+// MemoryBaselineStore implements BaselineStore that keeps baselines in
+// memory. Its zero value is ready to use.
+type MemoryBaselineStore struct {
+	mu        sync.Mutex
+	baselines map[string]Baseline
+}
+
+// Load implements BaselineStore.
+func (s *MemoryBaselineStore) Load() (map[string]Baseline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyBaselines(s.baselines), nil
+}
+
+// Save implements BaselineStore.
+func (s *MemoryBaselineStore) Save(b map[string]Baseline) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.baselines = copyBaselines(b)
+	return nil
+}
+
+// FileBaselineStore implements BaselineStore that persists baselines in a
+// JSON encoded file, so that they survive restarts.
+// The file is rewritten atomically on every Save.
+type FileBaselineStore struct {
+	// Path is the path of the file. It is created if it does not exist.
+	Path string
+
+	mu sync.Mutex
+}
+
+// Load implements BaselineStore.
+func (s *FileBaselineStore) Load() (map[string]Baseline, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	baselines := make(map[string]Baseline)
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &baselines); err != nil {
+			return nil, err
+		}
+	}
+	return baselines, nil
+}
+
+// Save implements BaselineStore.
+func (s *FileBaselineStore) Save(b map[string]Baseline) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.Path, b)
+}
+
+func copyBaselines(b map[string]Baseline) map[string]Baseline {
+	res := make(map[string]Baseline, len(b))
+	for k, v := range b {
+		res[k] = v
+	}
+	return res
+}
+
+// anomaly describes the deviation of a value from its baseline.
+type anomaly struct {
+	Service  string
+	Value    float64
+	Baseline Baseline
+	Config   *AnomalyDetection
+	App      application
+}
+
+func (a anomaly) EmitTo(e Emitter) {
+	z := a.Baseline.ZScore(a.Value)
+	state := "ok"
+	// Only increases of the response time and the 5xx ratio are anomalies
+	// worth reporting.
+	if a.Baseline.Samples >= a.Config.MinSamples {
+		switch {
+		case z >= a.Config.Critical:
+			state = "critical"
+		case z >= a.Config.Warn:
+			state = "warn"
+		}
+	}
+	attributes := attributes(a.App)
+	attributes["value"] = strconv.FormatFloat(a.Value, 'f', 4, 64)
+	attributes["baseline_mean"] = strconv.FormatFloat(a.Baseline.Mean, 'f', 4, 64)
+	attributes["baseline_stddev"] = strconv.FormatFloat(math.Sqrt(a.Baseline.Variance), 'f', 4, 64)
+	e.Emit(forApp(a.App, Metric{
+		Service:    a.Service,
+		Metric:     z,
+		State:      state,
+		Attributes: attributes,
+	}))
+}
+
+// observeAnomalyLocked adds the HTTP event to the application's values
+// compared to their baselines on the next refresh. It expects m.mu to be
+// held.
+func (m *AppMonitor) observeAnomalyLocked(status *appStatus, r *cfevent.HttpStartStop) {
+	if m.Anomaly == nil {
+		return
+	}
+	if status.anomaly == nil {
+		status.anomaly = &httpAggregate{App: status.application}
+	}
+	status.anomaly.add(r)
+}
+
+// emitAnomalies emits the z-scores of the application's mean response time
+// and 5xx ratio since the last refresh, and updates their baselines.
+// Refreshes without requests are skipped, so that idle periods do not skew
+// the baselines.
+func (m *AppMonitor) emitAnomalies(guid string) {
+	if m.Anomaly == nil {
+		return
+	}
+	m.mu.Lock()
+	status, ok := m.monitored[guid]
+	if !ok || status.anomaly == nil || status.anomaly.Requests == 0 {
+		m.mu.Unlock()
+		return
+	}
+	window := status.anomaly
+	status.anomaly = nil
+	values := []struct {
+		service, key string
+		value        float64
+	}{
+		{"http response time_ms zscore", guid + ":time_ms", ratio(uint64(window.TotalMillis), uint64(window.Requests))},
+		{"http response server_error_ratio zscore", guid + ":server_error_ratio", ratio(uint64(window.ServerErrors), uint64(window.Requests))},
+	}
+	var anomalies []anomaly
+	for _, v := range values {
+		b := m.baselines[v.key]
+		anomalies = append(anomalies, anomaly{v.service, v.value, b, m.Anomaly, window.App})
+		m.baselines[v.key] = b.Update(v.value, m.Anomaly.Alpha)
+	}
+	m.mu.Unlock()
+
+	for _, a := range anomalies {
+		a.EmitTo(m.emitter)
+	}
+}
+
+// loadBaselines loads the baselines from the store.
+func (m *AppMonitor) loadBaselines() {
+	if m.Anomaly == nil {
+		return
+	}
+	baselines, err := m.Anomaly.Store.Load()
+	if err != nil {
+		m.Logger.Error("error loading anomaly baselines", "error", err)
+		return
+	}
+	m.mu.Lock()
+	for k, b := range baselines {
+		m.baselines[k] = b
+	}
+	m.mu.Unlock()
+}
+
+// saveBaselines saves the baselines of the monitored applications to the
+// store, keeping the stored baselines of the other existing applications, so
+// that instances sharing the store do not overwrite each other's baselines,
+// and take them over when applications move between them.
+func (m *AppMonitor) saveBaselines() {
+	if m.Anomaly == nil {
+		return
+	}
+	stored, err := m.Anomaly.Store.Load()
+	if err != nil {
+		m.Logger.Error("error loading anomaly baselines", "error", err)
+		return
+	}
+	m.mu.Lock()
+	baselines := make(map[string]Baseline, len(stored))
+	for key, b := range stored {
+		guid, ok := keyGUID(key)
+		if _, exists := m.appMeta[guid]; !ok || !exists {
+			continue
+		}
+		if _, monitored := m.monitored[guid]; !monitored {
+			baselines[key] = b
+		}
+	}
+	for key, b := range m.baselines {
+		guid, _ := keyGUID(key)
+		if _, monitored := m.monitored[guid]; monitored {
+			baselines[key] = b
+		}
+	}
+	m.baselines = copyBaselines(baselines)
+	m.mu.Unlock()
+
+	if err := m.Anomaly.Store.Save(baselines); err != nil {
+		m.Logger.Error("error saving anomaly baselines", "error", err)
+	}
+}
@@ -0,0 +1,168 @@
+package mozzle
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBaselineUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		alpha   float64
+		want    Baseline
+	}{
+		{"first sample", []float64{10}, 0.5, Baseline{Mean: 10, Samples: 1}},
+		{"two samples", []float64{10, 20}, 0.5, Baseline{Mean: 15, Variance: 25, Samples: 2}},
+		{"three samples", []float64{10, 20, 20}, 0.5, Baseline{Mean: 17.5, Variance: 18.75, Samples: 3}},
+		{"constant", []float64{5, 5, 5, 5}, 0.1, Baseline{Mean: 5, Samples: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Baseline
+			for _, x := range tt.samples {
+				b = b.Update(x, tt.alpha)
+			}
+			if b != tt.want {
+				t.Errorf("baseline = %+v, want %+v", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaselineZScore(t *testing.T) {
+	tests := []struct {
+		baseline Baseline
+		x        float64
+		want     float64
+	}{
+		{Baseline{}, 100, 0},
+		{Baseline{Mean: 10, Samples: 1}, 100, 0},
+		{Baseline{Mean: 10, Variance: 4, Samples: 2}, 16, 3},
+		{Baseline{Mean: 10, Variance: 4, Samples: 2}, 6, -2},
+	}
+	for _, tt := range tests {
+		if got := tt.baseline.ZScore(tt.x); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v.ZScore(%v) = %v, want %v", tt.baseline, tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestFileBaselineStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-baselines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &FileBaselineStore{Path: filepath.Join(dir, "baselines.json")}
+
+	if b, err := s.Load(); err != nil || len(b) != 0 {
+		t.Fatalf("Load() from a missing file = %v, %v, want no baselines", b, err)
+	}
+	want := map[string]Baseline{"a:time_ms": {Mean: 12.5, Variance: 3, Samples: 40}}
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Load(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestEmitAnomalies(t *testing.T) {
+	m, c := newTestMonitor(Target{Anomaly: &AnomalyDetection{Alpha: 0.2, MinSamples: 5}}, new(fakeCC))
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app}
+
+	// Refreshes without requests do not count towards the baselines.
+	m.emitAnomalies(app.GUID)
+	if len(c.metrics) != 0 {
+		t.Fatalf("emitted %d metrics without requests, want none", len(c.metrics))
+	}
+	for i := 0; i < 10; i++ {
+		m.observeHTTP(app.GUID, httpEvent("/", 200, time.Duration(100+i%2*10)*time.Millisecond))
+		m.emitAnomalies(app.GUID)
+	}
+	m.observeHTTP(app.GUID, httpEvent("/", 500, time.Second))
+	m.emitAnomalies(app.GUID)
+
+	tests := []struct {
+		service   string
+		wantState []string
+	}{
+		{"http response time_ms zscore", []string{"ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "critical"}},
+		// The ratio has no variance before the error, so its z-score is
+		// zero.
+		{"http response server_error_ratio zscore", []string{"ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok", "ok"}},
+	}
+	for _, tt := range tests {
+		var states []string
+		for _, m := range c.service(tt.service) {
+			states = append(states, m.State)
+		}
+		if !reflect.DeepEqual(states, tt.wantState) {
+			t.Errorf("%s states = %v, want %v", tt.service, states, tt.wantState)
+		}
+	}
+
+	m.saveBaselines()
+	saved, err := m.Anomaly.Store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := saved["a:time_ms"]; b.Samples != 11 {
+		t.Errorf("saved baseline = %+v, want 11 samples", b)
+	}
+}
+
+func TestSaveBaselinesShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-baselines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileBaselineStore{Path: filepath.Join(dir, "baselines.json")}
+
+	// Two instances share the store, each monitoring one of the apps.
+	monitors := make(map[string]*AppMonitor)
+	for _, guid := range []string{"a", "b"} {
+		m, _ := newTestMonitor(Target{Anomaly: &AnomalyDetection{Store: store}}, new(fakeCC))
+		m.loadBaselines()
+		m.metadata("a")
+		m.metadata("b")
+		app := testApp(guid, "app-"+guid)
+		m.monitored[guid] = &appStatus{application: app}
+		monitors[guid] = m
+	}
+	for i := 0; i < 3; i++ {
+		for guid, m := range monitors {
+			m.observeHTTP(guid, httpEvent("/", 200, 100*time.Millisecond))
+			m.emitAnomalies(guid)
+			m.saveBaselines()
+		}
+	}
+
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a:time_ms", "b:time_ms"} {
+		if b := saved[key]; b.Samples != 3 {
+			t.Errorf("saved baseline %s = %+v, want 3 samples", key, b)
+		}
+	}
+
+	// An app moving to the other instance continues with its baseline.
+	a, b := monitors["a"], monitors["b"]
+	delete(b.monitored, "b")
+	b.saveBaselines()
+	a.saveBaselines()
+	a.monitored["b"] = &appStatus{application: testApp("b", "app-b")}
+	if got := a.baselines["b:time_ms"]; got.Samples != 3 {
+		t.Errorf("baseline taken over = %+v, want 3 samples", got)
+	}
+}
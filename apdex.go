@@ -0,0 +1,124 @@
+package mozzle
+
+import (
+	"strconv"
+	"time"
+
+	cfevent "github.com/cloudfoundry/sonde-go/events"
+)
+
+// apdexRatings are the standard Apdex ratings, with the scores at or above
+// which they apply and the states they are reported in.
+var apdexRatings = []struct {
+	name  string
+	score float64
+	state string
+}{
+	{"excellent", 0.94, "ok"},
+	{"good", 0.85, "ok"},
+	{"fair", 0.7, "ok"},
+	{"poor", 0.5, "warn"},
+	{"unacceptable", 0, "critical"},
+}
+
+// apdexScore counts the HTTP events of an application with the same peer
+// type, and route, if computed per route, since the last refresh.
+type apdexScore struct {
+	Requests   int
+	Satisfied  int
+	Tolerating int
+	T          time.Duration
+	Peer       string
+	Host       string
+	// Route is the route the requests matched, or the host, if they did
+	// not match any of the application's routes.
+	Route string
+	App   application
+}
+
+// add counts the request as satisfied, if it completed within T, as
+// tolerating, if it completed within 4T, or otherwise as frustrated. Server
+// errors are always frustrated.
+func (a *apdexScore) add(r *cfevent.HttpStartStop) {
+	a.Requests++
+	if r.GetStatusCode() >= 500 {
+		return
+	}
+	switch duration := time.Duration(r.GetStopTimestamp() - r.GetStartTimestamp()); {
+	case duration <= a.T:
+		a.Satisfied++
+	case duration <= 4*a.T:
+		a.Tolerating++
+	}
+}
+
+func (a apdexScore) EmitTo(e Emitter) {
+	score := (float64(a.Satisfied) + float64(a.Tolerating)/2) / float64(a.Requests)
+	rating := apdexRatings[len(apdexRatings)-1]
+	for _, r := range apdexRatings {
+		if score >= r.score {
+			rating = r
+			break
+		}
+	}
+	attributes := attributes(a.App)
+	attributes["peer"] = a.Peer
+	if a.Host != "" {
+		attributes["host"] = a.Host
+	}
+	if a.Route != "" {
+		attributes["route"] = a.Route
+	}
+	attributes["apdex_t_ms"] = strconv.FormatInt(a.T.Milliseconds(), 10)
+	attributes["rating"] = rating.name
+	attributes["requests_count"] = strconv.Itoa(a.Requests)
+	attributes["satisfied_count"] = strconv.Itoa(a.Satisfied)
+	attributes["tolerating_count"] = strconv.Itoa(a.Tolerating)
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http apdex",
+		Metric:     score,
+		State:      rating.state,
+		Attributes: attributes,
+	}))
+}
+
+// observeApdexLocked counts the HTTP event towards the Apdex score of the
+// application, if its settings enable it. Per route, the request is matched
+// against the application's routes. It expects the monitor's mutex to be
+// held.
+func observeApdexLocked(status *appStatus, settings AppSettings, routes []string, r *cfevent.HttpStartStop) {
+	if settings.ApdexT <= 0 {
+		return
+	}
+	peer := peerType(r.GetPeerType())
+	key, host, route := peer, "", ""
+	if settings.ApdexPerRoute {
+		host = requestHost(r.GetUri())
+		route = matchRoute(routes, r.GetUri())
+		key += " " + route
+	}
+	if status.apdex == nil {
+		status.apdex = make(map[string]*apdexScore)
+	}
+	a, ok := status.apdex[key]
+	if !ok {
+		a = &apdexScore{T: settings.ApdexT, Peer: peer, Host: host, Route: route, App: status.application}
+		status.apdex[key] = a
+	}
+	a.add(r)
+}
+
+// emitApdex emits and resets the Apdex scores of the application. Scores are
+// not emitted for refreshes without requests, as they are undefined.
+func (m *AppMonitor) emitApdex(guid string) {
+	m.mu.Lock()
+	var scores map[string]*apdexScore
+	if status, ok := m.monitored[guid]; ok {
+		scores = status.apdex
+		status.apdex = nil
+	}
+	m.mu.Unlock()
+	for _, a := range scores {
+		a.EmitTo(m.emitter)
+	}
+}
@@ -0,0 +1,139 @@
+package mozzle
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestApdexScore(t *testing.T) {
+	tests := []struct {
+		name       string
+		durations  []time.Duration
+		statuses   []int32 // 200 if missing
+		wantScore  float64
+		wantRating string
+		wantState  string
+	}{
+		{
+			name:       "all satisfied",
+			durations:  []time.Duration{10 * time.Millisecond, 100 * time.Millisecond},
+			wantScore:  1,
+			wantRating: "excellent",
+			wantState:  "ok",
+		},
+		{
+			name:       "tolerating",
+			durations:  []time.Duration{10 * time.Millisecond, 101 * time.Millisecond, 400 * time.Millisecond, 10 * time.Millisecond},
+			wantScore:  0.75,
+			wantRating: "fair",
+			wantState:  "ok",
+		},
+		{
+			name:       "frustrated",
+			durations:  []time.Duration{10 * time.Millisecond, 401 * time.Millisecond},
+			wantScore:  0.5,
+			wantRating: "poor",
+			wantState:  "warn",
+		},
+		{
+			name:       "server errors are frustrated",
+			durations:  []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+			statuses:   []int32{500, 503, 200},
+			wantScore:  1.0 / 3,
+			wantRating: "unacceptable",
+			wantState:  "critical",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := apdexScore{T: 100 * time.Millisecond, Peer: "server", App: testApp("a", "app-a")}
+			for i, d := range tt.durations {
+				status := int32(200)
+				if i < len(tt.statuses) {
+					status = tt.statuses[i]
+				}
+				a.add(httpEvent("/", status, d))
+			}
+			var c collector
+			a.EmitTo(&c)
+			ms := c.service("http apdex")
+			if len(ms) != 1 {
+				t.Fatalf("emitted %d scores, want 1", len(ms))
+			}
+			if score := ms[0].Metric.(float64); math.Abs(score-tt.wantScore) > 1e-9 {
+				t.Errorf("score = %v, want %v", score, tt.wantScore)
+			}
+			if rating := ms[0].Attributes["rating"]; rating != tt.wantRating || ms[0].State != tt.wantState {
+				t.Errorf("rating = %s, state = %s, want %s, %s", rating, ms[0].State, tt.wantRating, tt.wantState)
+			}
+			if ms[0].Attributes["apdex_t_ms"] != "100" {
+				t.Errorf("apdex_t_ms = %q, want 100", ms[0].Attributes["apdex_t_ms"])
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := []string{"www.example.com", "www.example.com/shop", "www.example.com/shop/cart", "api.example.com/v1"}
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"https://www.example.com/", "www.example.com"},
+		{"https://www.example.com/shop", "www.example.com/shop"},
+		{"https://www.example.com/shop/items/1", "www.example.com/shop"},
+		{"https://www.example.com/shopping", "www.example.com"},
+		{"https://www.example.com/shop/cart/checkout", "www.example.com/shop/cart"},
+		{"https://WWW.example.com/shop", "WWW.example.com/shop"},
+		{"api.example.com/v1/users", "api.example.com/v1"},
+		{"https://api.example.com/v2/users", "api.example.com"},
+		{"https://other.example.com/shop", "other.example.com"},
+		{"http://[::1", ""},
+	}
+	for _, tt := range tests {
+		if got := matchRoute(routes, tt.uri); got != tt.want {
+			t.Errorf("matchRoute(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestObserveApdexPerRoute(t *testing.T) {
+	m, c := newTestMonitor(Target{AppDefaults: AppSettings{ApdexT: 100 * time.Millisecond, ApdexPerRoute: true}}, new(fakeCC))
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app}
+	m.routes[app.GUID] = []string{"www.example.com", "www.example.com/shop"}
+
+	for _, uri := range []string{
+		"https://www.example.com/",
+		"https://www.example.com/shop/1",
+		"https://www.example.com/shop/2",
+		"https://other.example.com/",
+	} {
+		m.observeHTTP(app.GUID, httpEvent(uri, 200, time.Millisecond))
+	}
+	m.emitApdex(app.GUID)
+
+	var got []string
+	for _, ms := range c.service("http apdex") {
+		got = append(got, ms.Attributes["host"]+" "+ms.Attributes["route"]+" "+ms.Attributes["requests_count"])
+	}
+	sort.Strings(got)
+	want := []string{
+		"other.example.com other.example.com 1",
+		"www.example.com www.example.com 1",
+		"www.example.com www.example.com/shop 2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scores = %v, want %v", got, want)
+	}
+
+	// Scores are reset on every refresh, and not emitted without requests.
+	c.metrics = nil
+	m.emitApdex(app.GUID)
+	if len(c.metrics) != 0 {
+		t.Errorf("emitted %d scores without requests, want none", len(c.metrics))
+	}
+}
@@ -23,3 +23,34 @@ func (e applicationEvent) EmitTo(emitter Emitter) {
 		Attributes: attributes,
 	}))
 }
+
+// spaceEvent is an audit event in a space, which does not concern an
+// application - e.g. a service instance or route change.
+type spaceEvent struct {
+	ccv2.Event
+	Org   string
+	Space string
+}
+
+func (e spaceEvent) EmitTo(emitter Emitter) {
+	attributes := map[string]string{
+		"org":        e.Org,
+		"space":      e.Space,
+		"event":      e.Entity.Type,
+		"actee":      e.Entity.ActeeName,
+		"actee_id":   e.Entity.Actee,
+		"actee_type": e.Entity.ActeeType,
+		"actor":      e.Entity.ActorName,
+		"actor_type": e.Entity.ActorType,
+	}
+
+	emitter.Emit(Metric{
+		Organization: e.Org,
+		Space:        e.Space,
+		Time:         e.Entity.Timestamp.Unix(),
+		Service:      "space event",
+		Metric:       1,
+		State:        "ok",
+		Attributes:   attributes,
+	})
+}
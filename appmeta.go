@@ -0,0 +1,109 @@
+package mozzle
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// appMetadata holds additional attributes of an application, which are
+// attached to all of its metrics. It is shared between all copies of the
+// application value, so that attributes fetched by one poller show up in
+// the metrics of all others.
+//
+// A nil *appMetadata holds no attributes.
+type appMetadata struct {
+	mu    sync.RWMutex
+	attrs map[string]string
+}
+
+// set sets the attribute key to value. An empty value removes it.
+func (md *appMetadata) set(key, value string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if value == "" {
+		delete(md.attrs, key)
+		return
+	}
+	if md.attrs == nil {
+		md.attrs = make(map[string]string)
+	}
+	md.attrs[key] = value
+}
+
+// addTo adds the attributes to attrs, without overwriting existing ones.
+func (md *appMetadata) addTo(attrs map[string]string) {
+	if md == nil {
+		return
+	}
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	for k, v := range md.attrs {
+		if _, ok := attrs[k]; !ok {
+			attrs[k] = v
+		}
+	}
+}
+
+// metadata returns the metadata of the application with the given GUID.
+func (m *AppMonitor) metadata(guid string) *appMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md, ok := m.appMeta[guid]
+	if !ok {
+		md = new(appMetadata)
+		m.appMeta[guid] = md
+	}
+	return md
+}
+
+// pruneMetadata forgets the metadata and other state of applications that
+// no longer exist.
+func (m *AppMonitor) pruneMetadata(apps []application) {
+	exists := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		exists[app.GUID] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for guid := range m.appMeta {
+		if !exists[guid] {
+			delete(m.appMeta, guid)
+		}
+	}
+	for guid := range m.routes {
+		if !exists[guid] {
+			delete(m.routes, guid)
+		}
+	}
+	for guid := range m.settingsSynced {
+		if !exists[guid] {
+			delete(m.appSettings, guid)
+			delete(m.settingsSynced, guid)
+			delete(m.invalidSettings, guid)
+		}
+	}
+	for key := range m.baselines {
+		// Keys without a GUID can only come from an edited store, and are
+		// dropped as well.
+		if guid, ok := keyGUID(key); !ok || !exists[guid] {
+			delete(m.baselines, key)
+		}
+	}
+}
+
+// keyGUID returns the application GUID of a key of the form <guid>:<name>.
+func keyGUID(key string) (string, bool) {
+	i := strings.IndexByte(key, ':')
+	if i < 0 {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// joinSorted returns the sorted values, separated by commas.
+func joinSorted(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
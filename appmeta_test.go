@@ -0,0 +1,57 @@
+package mozzle
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneMetadata(t *testing.T) {
+	m, _ := newTestMonitor(Target{}, new(fakeCC))
+	for _, guid := range []string{"a", "b"} {
+		m.metadata(guid).set("buildpack", "go")
+		m.routes[guid] = []string{guid + ".example.com"}
+		m.appSettings[guid] = AppSettings{}
+		m.settingsSynced[guid] = time.Time{}
+		m.baselines[guid+":time_ms"] = Baseline{Samples: 1}
+	}
+	// Keys without a GUID can only come from an edited store.
+	m.baselines["time_ms"] = Baseline{Samples: 1}
+
+	m.pruneMetadata([]application{testApp("a", "app-a")})
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"metadata", len(m.appMeta), 1},
+		{"routes", m.routes, map[string][]string{"a": {"a.example.com"}}},
+		{"settings", len(m.appSettings), 1},
+		{"synced settings", len(m.settingsSynced), 1},
+		{"baselines", m.baselines, map[string]Baseline{"a:time_ms": {Samples: 1}}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestKeyGUID(t *testing.T) {
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"a:time_ms", "a", true},
+		{"a:checkout:objective=99%", "a", true},
+		{"time_ms", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := keyGUID(tt.key); got != tt.want || ok != tt.wantOK {
+			t.Errorf("keyGUID(%q) = %q, %v, want %q, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package mozzle
 
-import "github.com/Bo0mer/ccv2"
-
 type applicationMetrics struct {
-	ccv2.ApplicationSummary
+	appSummary
 	App application
 }
 
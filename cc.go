@@ -0,0 +1,206 @@
+package mozzle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// The Cloud Controller client covers only the endpoints needed for the
+// application metrics. The helpers below call the remaining endpoints
+// directly, using the client's API address and authenticated HTTP client,
+// so that they share its rate limiting, instrumentation and recording.
+
+// ccGet fetches the Cloud Controller resource at path and decodes it into v.
+func (m *AppMonitor) ccGet(ctx context.Context, path string, query url.Values, v interface{}) error {
+	return m.call(ctx, func(ctx context.Context) error {
+		return ccGet(ctx, m.CloudController, path, query, v)
+	})
+}
+
+// ccList fetches all pages of the Cloud Controller v2 list endpoint at path
+// and decodes their resources into v, which must be a pointer to a slice.
+func (m *AppMonitor) ccList(ctx context.Context, path string, query url.Values, v interface{}) error {
+	var resources []json.RawMessage
+	for path != "" {
+		var page struct {
+			NextURL   string            `json:"next_url"`
+			Resources []json.RawMessage `json:"resources"`
+		}
+		if err := m.ccGet(ctx, path, query, &page); err != nil {
+			return err
+		}
+		resources = append(resources, page.Resources...)
+		// The next URL already contains the query.
+		path, query = page.NextURL, nil
+	}
+	return decodeResources(resources, v)
+}
+
+// ccListV3 is like ccList, but for the Cloud Controller v3 list endpoints.
+func (m *AppMonitor) ccListV3(ctx context.Context, path string, query url.Values, v interface{}) error {
+	var resources []json.RawMessage
+	for path != "" {
+		var page struct {
+			Pagination struct {
+				Next *struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			Resources []json.RawMessage `json:"resources"`
+		}
+		if err := m.ccGet(ctx, path, query, &page); err != nil {
+			return err
+		}
+		resources = append(resources, page.Resources...)
+		path, query = "", nil
+		if next := page.Pagination.Next; next != nil {
+			// The next URL already contains the query.
+			path = next.Href
+		}
+	}
+	return decodeResources(resources, v)
+}
+
+// decodeResources decodes the resources into v, which must be a pointer to
+// a slice.
+func decodeResources(resources []json.RawMessage, v interface{}) error {
+	data, err := json.Marshal(resources)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ccCount returns the total number of resources of the Cloud Controller v2
+// list endpoint at path, fetching a single resource.
+func (m *AppMonitor) ccCount(ctx context.Context, path string, query url.Values) (int, error) {
+	q := url.Values{"results-per-page": {"1"}}
+	for k, v := range query {
+		q[k] = v
+	}
+	var page struct {
+		TotalResults int `json:"total_results"`
+	}
+	err := m.ccGet(ctx, path, q, &page)
+	return page.TotalResults, err
+}
+
+func ccGet(ctx context.Context, cc *ccv2.Client, path string, query url.Values, v interface{}) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	u := cc.API.ResolveReference(ref)
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cc.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &ccv2.UnexpectedResponseError{
+			StatusCode:  resp.StatusCode,
+			Status:      resp.Status,
+			Description: strings.TrimSpace(string(body)),
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	return nil
+}
+
+// appSummary is the response of /v2/apps/:guid/summary.
+type appSummary struct {
+	GUID              string `json:"guid"`
+	Name              string `json:"name"`
+	State             string `json:"state"`
+	RunningInstances  int    `json:"running_instances"`
+	Instances         int    `json:"instances"`
+	Memory            int    `json:"memory"`
+	DiskQuota         int    `json:"disk_quota"`
+	HealthCheckType   string `json:"health_check_type"`
+	Buildpack         string `json:"buildpack"`
+	DetectedBuildpack string `json:"detected_buildpack"`
+	StackGUID         string `json:"stack_guid"`
+	PackageUpdatedAt  string `json:"package_updated_at"`
+}
+
+func (m *AppMonitor) appSummary(ctx context.Context, appGUID string) (appSummary, error) {
+	var summary appSummary
+	err := m.ccGet(ctx, "/v2/apps/"+appGUID+"/summary", nil, &summary)
+	return summary, err
+}
+
+// spaceSummary is the response of /v2/spaces/:guid/summary.
+type spaceSummary struct {
+	Apps []struct {
+		GUID         string   `json:"guid"`
+		Name         string   `json:"name"`
+		ServiceNames []string `json:"service_names"`
+		State        string   `json:"state"`
+		Memory       int      `json:"memory"`
+		Instances    int      `json:"instances"`
+		Routes       []struct {
+			GUID   string `json:"guid"`
+			Host   string `json:"host"`
+			Path   string `json:"path"`
+			Domain struct {
+				GUID string `json:"guid"`
+				Name string `json:"name"`
+			} `json:"domain"`
+		} `json:"routes"`
+	} `json:"apps"`
+	Services []serviceInstanceSummary `json:"services"`
+}
+
+// serviceInstanceSummary describes a service instance in a spaceSummary.
+type serviceInstanceSummary struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	BoundAppCount int    `json:"bound_app_count"`
+	LastOperation *struct {
+		Type  string `json:"type"`
+		State string `json:"state"`
+	} `json:"last_operation"`
+	ServicePlan *struct {
+		GUID    string `json:"guid"`
+		Name    string `json:"name"`
+		Service struct {
+			GUID  string `json:"guid"`
+			Label string `json:"label"`
+		} `json:"service"`
+	} `json:"service_plan"`
+}
+
+func (m *AppMonitor) spaceSummary(ctx context.Context, spaceGUID string) (spaceSummary, error) {
+	var summary spaceSummary
+	err := m.ccGet(ctx, "/v2/spaces/"+spaceGUID+"/summary", nil, &summary)
+	return summary, err
+}
+
+// route is a Cloud Controller v2 route resource.
+type route struct {
+	Metadata struct {
+		GUID string `json:"guid"`
+	} `json:"metadata"`
+	Entity struct {
+		Host       string `json:"host"`
+		Path       string `json:"path"`
+		DomainGUID string `json:"domain_guid"`
+	} `json:"entity"`
+}
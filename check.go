@@ -0,0 +1,199 @@
+package mozzle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// CheckThresholds configures the states reported by AppMonitor.Check, in
+// addition to the instance states reported by the "instance running_count"
+// metric. Zero values disable the respective threshold.
+type CheckThresholds struct {
+	// MemoryWarn and MemoryCritical are the used memory ratios of any
+	// instance above which an application is in warn or critical state.
+	MemoryWarn     float64
+	MemoryCritical float64
+	// ErrorRateWarn and ErrorRateCritical are the ratios of 5xx responses
+	// above which an application is in warn or critical state.
+	ErrorRateWarn     float64
+	ErrorRateCritical float64
+}
+
+// AppCheck is the result of checking a single application.
+type AppCheck struct {
+	GUID string
+	Name string
+	// State is one of "ok", "warn", "critical" or "unknown", if the
+	// application could not be checked.
+	State string
+	// Reasons describe why the application is not ok.
+	Reasons []string
+
+	RunningInstances int
+	Instances        int
+	// MemoryRatio is the highest used memory ratio of the application's
+	// instances, while sampling the firehose.
+	MemoryRatio float64
+	// Requests and ServerErrors are the numbers of all and 5xx responses,
+	// as reported by the router, while sampling the firehose.
+	Requests     int
+	ServerErrors int
+}
+
+// ErrorRate returns the ratio of 5xx responses.
+func (c AppCheck) ErrorRate() float64 {
+	return ratio(uint64(c.ServerErrors), uint64(c.Requests))
+}
+
+// Check checks the health of the applications under the specified
+// organization and space once, instead of monitoring them continuously.
+// If apps is not empty, only the applications with these names or GUIDs
+// are checked. If sample is positive, the firehose is sampled for that long
+// for memory and HTTP metrics.
+//
+// The results are sorted by application name. An error is returned only if
+// the applications cannot be listed.
+func (m *AppMonitor) Check(ctx context.Context, org, space string, apps []string, sample time.Duration, th CheckThresholds) ([]AppCheck, error) {
+	m.init()
+
+	var spaceEntity ccv2.Space
+	err := m.call(ctx, func(ctx context.Context) (err error) {
+		spaceEntity, err = getSpace(ctx, m.CloudController, org, space)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	all, err := m.applications(ctx, spaceEntity, org, space)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checkCollector{checks: make(map[string]*AppCheck)}
+	var checked []application
+	for _, app := range all {
+		if len(apps) > 0 && !contains(apps, app.Entity.Name) && !contains(apps, app.GUID) {
+			continue
+		}
+		checked = append(checked, app)
+		c.checks[app.GUID] = &AppCheck{GUID: app.GUID, Name: app.Entity.Name, State: "ok"}
+	}
+
+	var wg sync.WaitGroup
+	sampleCtx, cancel := context.WithTimeout(ctx, sample)
+	defer cancel()
+	for _, app := range checked {
+		if sample > 0 {
+			wg.Add(1)
+			go func(app application) {
+				defer wg.Done()
+				m.monitorFirehose(sampleCtx, app, c)
+			}(app)
+		}
+
+		summary, err := m.appSummary(ctx, app.GUID)
+		if err != nil {
+			c.fail(app.GUID, fmt.Sprintf("error fetching summary: %v", err))
+			continue
+		}
+		applicationMetrics{summary, app}.EmitTo(c)
+	}
+	wg.Wait()
+
+	res := make([]AppCheck, 0, len(c.checks))
+	for _, check := range c.checks {
+		check.evaluate(th)
+		res = append(res, *check)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// evaluate applies the thresholds to the sampled metrics.
+func (c *AppCheck) evaluate(th CheckThresholds) {
+	switch {
+	case th.MemoryCritical > 0 && c.MemoryRatio > th.MemoryCritical:
+		c.degrade("critical", fmt.Sprintf("memory usage %.0f%%", c.MemoryRatio*100))
+	case th.MemoryWarn > 0 && c.MemoryRatio > th.MemoryWarn:
+		c.degrade("warn", fmt.Sprintf("memory usage %.0f%%", c.MemoryRatio*100))
+	}
+	rate := c.ErrorRate()
+	switch {
+	case th.ErrorRateCritical > 0 && rate > th.ErrorRateCritical:
+		c.degrade("critical", fmt.Sprintf("5xx rate %.1f%%", rate*100))
+	case th.ErrorRateWarn > 0 && rate > th.ErrorRateWarn:
+		c.degrade("warn", fmt.Sprintf("5xx rate %.1f%%", rate*100))
+	}
+}
+
+// degrade sets the state to state, if it is worse than the current one,
+// and records the reason.
+func (c *AppCheck) degrade(state, reason string) {
+	c.State = WorstState(c.State, state)
+	c.Reasons = append(c.Reasons, reason)
+}
+
+// stateSeverity orders the states from the best to the worst.
+var stateSeverity = map[string]int{"ok": 0, "warn": 1, "unknown": 2, "critical": 3}
+
+// WorstState returns the worse of the states a and b - one of "ok",
+// "warn", "unknown" and "critical", from the best to the worst.
+func WorstState(a, b string) string {
+	if stateSeverity[b] > stateSeverity[a] {
+		return b
+	}
+	return a
+}
+
+// checkCollector implements Emitter that collects the metrics relevant to
+// checks.
+type checkCollector struct {
+	mu     sync.Mutex // guards
+	checks map[string]*AppCheck
+}
+
+func (c *checkCollector) Emit(m Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	check, ok := c.checks[m.ApplicationID]
+	if !ok {
+		return
+	}
+	switch m.Service {
+	case "instance running_count":
+		check.RunningInstances, _ = m.Metric.(int)
+	case "instance configured_count":
+		// It is emitted after the running count, with the same state.
+		check.Instances, _ = m.Metric.(int)
+		if m.State != "ok" {
+			check.degrade(m.State, fmt.Sprintf("%d/%d instances running", check.RunningInstances, check.Instances))
+		}
+	case "memory used_ratio":
+		if r, _ := m.Metric.(float64); r > check.MemoryRatio {
+			check.MemoryRatio = r
+		}
+	case "http response time_ms":
+		// Requests are reported by both the router, as the client, and
+		// the application, as the server. Only the router's view is
+		// counted, so that each request is counted once.
+		if m.Attributes["peer"] != "client" {
+			return
+		}
+		check.Requests++
+		if strings.HasPrefix(m.Attributes["status_code"], "5") {
+			check.ServerErrors++
+		}
+	}
+}
+
+func (c *checkCollector) fail(guid, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[guid].degrade("unknown", reason)
+}
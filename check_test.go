@@ -0,0 +1,118 @@
+package mozzle
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckCollector(t *testing.T) {
+	http := func(peer, status string) Metric {
+		return Metric{
+			ApplicationID: "a",
+			Service:       "http response time_ms",
+			Attributes:    map[string]string{"peer": peer, "status_code": status},
+		}
+	}
+	tests := []struct {
+		name    string
+		metrics []Metric
+		want    AppCheck
+	}{
+		{
+			name: "instances",
+			metrics: []Metric{
+				{ApplicationID: "a", Service: "instance running_count", Metric: 1, State: "critical"},
+				{ApplicationID: "a", Service: "instance configured_count", Metric: 2, State: "critical"},
+			},
+			want: AppCheck{State: "critical", Reasons: []string{"1/2 instances running"}, RunningInstances: 1, Instances: 2},
+		},
+		{
+			name: "memory",
+			metrics: []Metric{
+				{ApplicationID: "a", Service: "memory used_ratio", Metric: 0.5},
+				{ApplicationID: "a", Service: "memory used_ratio", Metric: 0.7},
+				{ApplicationID: "a", Service: "memory used_ratio", Metric: 0.6},
+			},
+			want: AppCheck{State: "ok", MemoryRatio: 0.7},
+		},
+		{
+			name: "requests counted once",
+			metrics: []Metric{
+				http("client", "200"), http("server", "200"),
+				http("client", "502"), http("server", "500"),
+				http("client", "503"),
+			},
+			want: AppCheck{State: "ok", Requests: 3, ServerErrors: 2},
+		},
+		{
+			name: "other application",
+			metrics: []Metric{
+				{ApplicationID: "b", Service: "memory used_ratio", Metric: 0.9},
+			},
+			want: AppCheck{State: "ok"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &checkCollector{checks: map[string]*AppCheck{"a": {State: "ok"}}}
+			for _, m := range tt.metrics {
+				c.Emit(m)
+			}
+			if got := *c.checks["a"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("check = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppCheckEvaluate(t *testing.T) {
+	th := CheckThresholds{MemoryWarn: 0.8, MemoryCritical: 0.95, ErrorRateWarn: 0.01, ErrorRateCritical: 0.05}
+	tests := []struct {
+		name        string
+		check       AppCheck
+		th          CheckThresholds
+		wantState   string
+		wantReasons []string
+	}{
+		{"ok", AppCheck{MemoryRatio: 0.5, Requests: 100}, th, "ok", nil},
+		{"memory warn", AppCheck{MemoryRatio: 0.9}, th, "warn", []string{"memory usage 90%"}},
+		{"memory critical", AppCheck{MemoryRatio: 0.99}, th, "critical", []string{"memory usage 99%"}},
+		{"5xx warn", AppCheck{Requests: 100, ServerErrors: 2}, th, "warn", []string{"5xx rate 2.0%"}},
+		{"5xx critical", AppCheck{Requests: 10, ServerErrors: 1}, th, "critical", []string{"5xx rate 10.0%"}},
+		{
+			"both",
+			AppCheck{MemoryRatio: 0.9, Requests: 10, ServerErrors: 1},
+			th,
+			"critical",
+			[]string{"memory usage 90%", "5xx rate 10.0%"},
+		},
+		{"disabled", AppCheck{MemoryRatio: 0.99, Requests: 10, ServerErrors: 5}, CheckThresholds{}, "ok", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.check
+			c.State = "ok"
+			c.evaluate(tt.th)
+			if c.State != tt.wantState || !reflect.DeepEqual(c.Reasons, tt.wantReasons) {
+				t.Errorf("evaluate() = %s %q, want %s %q", c.State, c.Reasons, tt.wantState, tt.wantReasons)
+			}
+		})
+	}
+}
+
+func TestWorstState(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"ok", "ok", "ok"},
+		{"ok", "warn", "warn"},
+		{"critical", "warn", "critical"},
+		{"warn", "unknown", "unknown"},
+		{"unknown", "critical", "critical"},
+	}
+	for _, tt := range tests {
+		if got := WorstState(tt.a, tt.b); got != tt.want {
+			t.Errorf("WorstState(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
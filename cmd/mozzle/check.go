@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Bo0mer/mozzle"
+)
+
+// Flags of the check command.
+var (
+	checkApps          string
+	checkSample        time.Duration
+	checkTimeout       time.Duration
+	checkMemoryWarn    float64
+	checkMemoryCrit    float64
+	checkErrorRateWarn float64
+	checkErrorRateCrit float64
+)
+
+// Nagios plugin exit codes.
+const (
+	exitOK       = 0
+	exitWarning  = 1
+	exitCritical = 2
+	exitUnknown  = 3
+)
+
+// checkCommand checks the health of the applications once and reports it
+// in the format of Nagios plugins. It returns the Nagios exit code.
+func checkCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	targetFlags(fs)
+	fs.StringVar(&checkApps, "app", "", "Comma-separated names or GUIDs of the checked applications; all if empty")
+	fs.DurationVar(&checkSample, "sample", 0, "Time to sample the firehose for memory usage and 5xx rates; disabled if 0")
+	fs.DurationVar(&checkTimeout, "timeout", 30*time.Second, "Maximum time for checking the applications, in addition to -sample")
+	fs.Float64Var(&checkMemoryWarn, "memory-warn", 0.8, "Used memory ratio of any instance above which an application is in warning state")
+	fs.Float64Var(&checkMemoryCrit, "memory-crit", 0.95, "Used memory ratio of any instance above which an application is in critical state")
+	fs.Float64Var(&checkErrorRateWarn, "5xx-warn", 0.01, "Ratio of 5xx responses above which an application is in warning state")
+	fs.Float64Var(&checkErrorRateCrit, "5xx-crit", 0.05, "Ratio of 5xx responses above which an application is in critical state")
+	fs.Parse(args)
+
+	_, t, err := setup()
+	if err != nil {
+		return exitUnknown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkSample+checkTimeout)
+	defer cancel()
+
+	mon, closeMonitor, err := newMonitor(ctx, cancel, &t, nil)
+	if err != nil {
+		fmt.Printf("MOZZLE UNKNOWN - error creating monitor: %v\n", err)
+		return exitUnknown
+	}
+	th := mozzle.CheckThresholds{
+		MemoryWarn:        checkMemoryWarn,
+		MemoryCritical:    checkMemoryCrit,
+		ErrorRateWarn:     checkErrorRateWarn,
+		ErrorRateCritical: checkErrorRateCrit,
+	}
+	checks, err := mon.Check(ctx, t.Org, t.Space, splitList(checkApps), checkSample, th)
+	closeMonitor()
+	if err != nil {
+		fmt.Printf("MOZZLE UNKNOWN - error checking applications: %v\n", err)
+		return exitUnknown
+	}
+	if len(checks) == 0 {
+		fmt.Println("MOZZLE UNKNOWN - no applications found")
+		return exitUnknown
+	}
+
+	output, code := checkOutput(checks, th)
+	fmt.Println(output)
+	return code
+}
+
+// checkOutput formats the checks as Nagios plugin output, with performance
+// data, and returns the corresponding exit code.
+func checkOutput(checks []mozzle.AppCheck, th mozzle.CheckThresholds) (string, int) {
+	state := "ok"
+	var problems, perfdata []string
+	for _, c := range checks {
+		state = mozzle.WorstState(state, c.State)
+		if c.State != "ok" {
+			problems = append(problems, fmt.Sprintf("%s %s: %s", c.Name, c.State, strings.Join(c.Reasons, ", ")))
+		}
+		perfdata = append(perfdata,
+			fmt.Sprintf("'%s_running'=%d;;;0;%d", c.Name, c.RunningInstances, c.Instances),
+		)
+		if checkSample > 0 {
+			perfdata = append(perfdata,
+				fmt.Sprintf("'%s_memory'=%.3f;%g;%g;0;1", c.Name, c.MemoryRatio, th.MemoryWarn, th.MemoryCritical),
+				fmt.Sprintf("'%s_5xx_rate'=%.3f;%g;%g;0;1", c.Name, c.ErrorRate(), th.ErrorRateWarn, th.ErrorRateCritical),
+				fmt.Sprintf("'%s_requests'=%dc", c.Name, c.Requests),
+			)
+		}
+	}
+
+	summary := fmt.Sprintf("%d applications ok", len(checks))
+	if len(problems) > 0 {
+		summary = strings.Join(problems, "; ")
+	}
+	var label string
+	var code int
+	switch state {
+	case "ok":
+		label, code = "OK", exitOK
+	case "warn":
+		label, code = "WARNING", exitWarning
+	case "critical":
+		label, code = "CRITICAL", exitCritical
+	default:
+		label, code = "UNKNOWN", exitUnknown
+	}
+	return fmt.Sprintf("MOZZLE %s - %s | %s", label, summary, strings.Join(perfdata, " ")), code
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/mozzle"
+)
+
+func TestCheckOutput(t *testing.T) {
+	th := mozzle.CheckThresholds{MemoryWarn: 0.8, MemoryCritical: 0.95, ErrorRateWarn: 0.01, ErrorRateCritical: 0.05}
+	healthy := mozzle.AppCheck{Name: "a", State: "ok", RunningInstances: 2, Instances: 2}
+	tests := []struct {
+		name     string
+		checks   []mozzle.AppCheck
+		sample   bool
+		want     string
+		wantCode int
+	}{
+		{
+			name:     "ok",
+			checks:   []mozzle.AppCheck{healthy},
+			want:     "MOZZLE OK - 1 applications ok | 'a_running'=2;;;0;2",
+			wantCode: exitOK,
+		},
+		{
+			name:     "warning",
+			checks:   []mozzle.AppCheck{healthy, {Name: "b", State: "warn", Reasons: []string{"memory usage 90%"}, RunningInstances: 1, Instances: 1}},
+			want:     "MOZZLE WARNING - b warn: memory usage 90% | 'a_running'=2;;;0;2 'b_running'=1;;;0;1",
+			wantCode: exitWarning,
+		},
+		{
+			name: "critical",
+			checks: []mozzle.AppCheck{
+				{Name: "a", State: "critical", Reasons: []string{"0/2 instances running", "5xx rate 10.0%"}, Instances: 2},
+				{Name: "b", State: "warn", Reasons: []string{"memory usage 90%"}, RunningInstances: 1, Instances: 1},
+			},
+			want:     "MOZZLE CRITICAL - a critical: 0/2 instances running, 5xx rate 10.0%; b warn: memory usage 90% | 'a_running'=0;;;0;2 'b_running'=1;;;0;1",
+			wantCode: exitCritical,
+		},
+		{
+			name:     "unknown",
+			checks:   []mozzle.AppCheck{healthy, {Name: "b", State: "unknown", Reasons: []string{"error fetching summary: timeout"}}},
+			want:     "MOZZLE UNKNOWN - b unknown: error fetching summary: timeout | 'a_running'=2;;;0;2 'b_running'=0;;;0;0",
+			wantCode: exitUnknown,
+		},
+		{
+			name:     "sampled",
+			checks:   []mozzle.AppCheck{{Name: "a", State: "ok", RunningInstances: 1, Instances: 1, MemoryRatio: 0.5, Requests: 200, ServerErrors: 1}},
+			sample:   true,
+			want:     "MOZZLE OK - 1 applications ok | 'a_running'=1;;;0;1 'a_memory'=0.500;0.8;0.95;0;1 'a_5xx_rate'=0.005;0.01;0.05;0;1 'a_requests'=200c",
+			wantCode: exitOK,
+		},
+	}
+	defer func(sample time.Duration) { checkSample = sample }(checkSample)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkSample = 0
+			if tt.sample {
+				checkSample = time.Second
+			}
+			got, code := checkOutput(tt.checks, th)
+			if got != tt.want || code != tt.wantCode {
+				t.Errorf("checkOutput() = %q, %d, want %q, %d", got, code, tt.want, tt.wantCode)
+			}
+		})
+	}
+}
@@ -4,15 +4,16 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"net/url"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -21,6 +22,7 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Flags shared by all commands that monitor a target.
 var (
 	apiAddr        string
 	insecure       bool
@@ -28,18 +30,33 @@ var (
 	password       string
 	accessToken    string
 	refreshToken   string
+	tokenFile      string
+	clientID       string
+	clientSecret   string
 	org            string
 	space          string
 	useCfCliTarget bool
 
-	riemannAddr string
-
-	eventsTTL       float64
-	queueSize       int
 	rpcTimeout      time.Duration
 	refreshInterval time.Duration
+	ccRate          float64
+	ccBurst         int
+	ccMaxConcurrent int
+
+	retryAttempts       int
+	retryInitialBackoff time.Duration
+	retryMaxBackoff     time.Duration
+	retryBudget         int
+
+	cursorFile  string
+	spaceEvents bool
+
+	recordFile  string
+	replayFile  string
+	replaySpeed float64
 
-	reportVersion bool
+	logFormat string
+	logLevel  string
 )
 
 // populated using -ldflags.
@@ -49,39 +66,93 @@ var (
 	buildstamp string
 )
 
-func init() {
-	flag.StringVar(&apiAddr, "api", "https://api.bosh-lite.com", "Address of the Cloud Foundry API")
-	flag.BoolVar(&insecure, "insecure", false, "Please, please, don't!")
-	flag.StringVar(&username, "username", "", "Cloud Foundry user; usage is discouraged - see token option instead")
-	flag.StringVar(&password, "password", "", "Cloud Foundry password; usage is discouraged - see token option instead")
-	flag.StringVar(&accessToken, "access-token", "", "Cloud Foundry OAuth2 token; either token or username and password must be provided")
-	flag.StringVar(&refreshToken, "refresh-token", "", "Cloud Foundry OAuth2 refresh token; to be used with the token flag")
-	flag.StringVar(&org, "org", "NASA", "Cloud Foundry organization")
-	flag.StringVar(&space, "space", "rocket", "Cloud Foundry space")
-	flag.BoolVar(&useCfCliTarget, "use-cf-cli-target", false, "Use CF CLI's current configured target")
-
-	flag.StringVar(&riemannAddr, "riemann", "tcp://127.0.0.1:5555", "Address of the Riemann endpoint")
-
-	flag.Float64Var(&eventsTTL, "events-ttl", 30.0, "TTL for emitted events (in seconds)")
-	flag.IntVar(&queueSize, "events-queue-size", 256, "Queue size for outgoing events")
-	flag.DurationVar(&rpcTimeout, "rpc-timeout", 15*time.Second, "Timeout for RPCs")
-	flag.DurationVar(&refreshInterval, "refresh-interval", 15*time.Second, "Time between polling the CF API")
-	flag.BoolVar(&reportVersion, "v", false, "Report mozzle version")
-	flag.BoolVar(&reportVersion, "version", false, "Report mozzle version")
-}
+const usage = `Usage: mozzle [command] [flags]
+
+Commands:
+  run      monitor applications and emit their metrics to Riemann (default)
+  tail     print the metrics of the monitored applications to the terminal
+  check    check the health of the applications once, as a Nagios plugin
+  version  report mozzle version
+
+Run 'mozzle <command> -h' for the flags of a command.
+`
 
+// main runs the command and exits with its exit code. The commands return
+// the code instead of exiting themselves, so that their deferred calls, e.g.
+// draining the emitter, are run.
 func main() {
-	flag.Parse()
-	if reportVersion {
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var code int
+	switch cmd {
+	case "run":
+		code = runCommand(args)
+	case "tail":
+		code = tailCommand(args)
+	case "check":
+		code = checkCommand(args)
+	case "version":
 		printVersion()
-		os.Exit(0)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "mozzle: unknown command %q\n\n%s", cmd, usage)
+		code = 2
+	}
+	os.Exit(code)
+}
+
+// targetFlags registers the flags shared by all commands that monitor a
+// target.
+func targetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&apiAddr, "api", "https://api.bosh-lite.com", "Address of the Cloud Foundry API")
+	fs.BoolVar(&insecure, "insecure", false, "Please, please, don't!")
+	fs.StringVar(&username, "username", "", "Cloud Foundry user; usage is discouraged - see token option instead")
+	fs.StringVar(&password, "password", "", "Cloud Foundry password; usage is discouraged - see token option instead")
+	fs.StringVar(&accessToken, "access-token", "", "Cloud Foundry OAuth2 token; either token or username and password must be provided")
+	fs.StringVar(&refreshToken, "refresh-token", "", "Cloud Foundry OAuth2 refresh token; to be used with the token flag")
+	fs.StringVar(&tokenFile, "token-file", "", "File containing a Cloud Foundry OAuth2 token, re-read whenever it changes")
+	fs.StringVar(&clientID, "client-id", "cf", "UAA client ID")
+	fs.StringVar(&clientSecret, "client-secret", "", "UAA client secret; used for the client credentials grant when no other credentials are provided")
+	fs.StringVar(&org, "org", "NASA", "Cloud Foundry organization")
+	fs.StringVar(&space, "space", "rocket", "Cloud Foundry space")
+	fs.BoolVar(&useCfCliTarget, "use-cf-cli-target", false, "Use CF CLI's current configured target")
+
+	fs.DurationVar(&rpcTimeout, "rpc-timeout", 15*time.Second, "Timeout for RPCs")
+	fs.DurationVar(&refreshInterval, "refresh-interval", 15*time.Second, "Time between polling the CF API")
+	fs.StringVar(&cursorFile, "cursor-file", "", "File for persisting audit event cursors across restarts; kept in memory if empty")
+	fs.BoolVar(&spaceEvents, "space-events", false, "Fetch audit events once per space instead of once per application")
+	fs.Float64Var(&ccRate, "cc-rate", 0, "Maximum number of Cloud Controller requests per second; unlimited if 0")
+	fs.IntVar(&ccBurst, "cc-burst", 1, "Number of Cloud Controller requests allowed at once above -cc-rate")
+	fs.IntVar(&ccMaxConcurrent, "cc-max-concurrent", 0, "Maximum number of concurrent Cloud Controller requests; unlimited if 0")
+	fs.IntVar(&retryAttempts, "retry-attempts", 5, "Maximum number of attempts for failed Cloud Controller and UAA calls")
+	fs.DurationVar(&retryInitialBackoff, "retry-initial-backoff", 500*time.Millisecond, "Time to wait before the first retry of a failed call, doubled on each next retry")
+	fs.DurationVar(&retryMaxBackoff, "retry-max-backoff", 30*time.Second, "Maximum time to wait between retries of a failed call")
+	fs.IntVar(&retryBudget, "retry-budget", 0, "Maximum number of retries per minute across all calls; unlimited if 0")
+	fs.StringVar(&recordFile, "record", "", "File for recording the firehose envelopes and Cloud Controller responses, for replaying them later")
+	fs.StringVar(&replayFile, "replay", "", "File with a recording to replay instead of monitoring a live target")
+	fs.Float64Var(&replaySpeed, "replay-speed", 1, "Speed factor for -replay, e.g. 10 for replaying ten times faster")
+	fs.StringVar(&logFormat, "log-format", "text", "Log output format, either text or json")
+	fs.StringVar(&logLevel, "log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+}
+
+// setup creates the logger and the target configured by the target flags.
+// It reports invalid flags and returns an error for them.
+func setup() (*slog.Logger, mozzle.Target, error) {
+	logger, err := newLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mozzle: %v\n", err)
+		return nil, mozzle.Target{}, err
 	}
+	slog.SetDefault(logger)
 
 	if useCfCliTarget {
 		cliConfig, err := cfcliConfig()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "mozzle: error reading CF CLI config: %v\n", err)
-			os.Exit(1)
+			logger.Error("error reading CF CLI config", "error", err)
+			return nil, mozzle.Target{}, err
 		}
 		apiAddr = cliConfig.Target
 		accessToken = cliConfig.AccessToken
@@ -93,11 +164,10 @@ func main() {
 
 	var token *oauth2.Token
 	if accessToken != "" {
-		var err error
-		token, err = parseToken(accessToken, refreshToken)
+		token, err = mozzle.ParseToken(accessToken, refreshToken)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "mozzle: error parsing token: %v\n", err)
-			os.Exit(1)
+			logger.Error("error parsing token", "error", err)
+			return nil, mozzle.Target{}, err
 		}
 	}
 	t := mozzle.Target{
@@ -105,40 +175,128 @@ func main() {
 		Username:        username,
 		Password:        password,
 		Token:           token,
+		TokenFile:       tokenFile,
+		ClientID:        clientID,
+		ClientSecret:    clientSecret,
 		Insecure:        insecure,
 		Org:             org,
 		Space:           space,
 		RPCTimeout:      rpcTimeout,
 		RefreshInterval: refreshInterval,
+		Logger:          logger,
+		RateLimit: mozzle.RateLimit{
+			Rate:          ccRate,
+			Burst:         ccBurst,
+			MaxConcurrent: ccMaxConcurrent,
+		},
+		Retry: mozzle.RetryPolicy{
+			MaxAttempts:    retryAttempts,
+			InitialBackoff: retryInitialBackoff,
+			MaxBackoff:     retryMaxBackoff,
+			Budget:         retryBudget,
+		},
+	}
+	if cursorFile != "" {
+		t.Cursors = &mozzle.FileCursorStore{Path: cursorFile}
 	}
+	if spaceEvents {
+		t.EventPolling = mozzle.PollSpaceEvents
+	}
+	return logger, t, nil
+}
 
+// signalContext returns a context that is canceled on SIGINT or SIGTERM.
+// A second signal exits immediately.
+func signalContext(logger *slog.Logger, args ...interface{}) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt)
-		<-sig
-		fmt.Println("exiting...")
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		s := <-sig
+		logger.Info("exiting", append([]interface{}{"signal", s}, args...)...)
 		cancel()
+		<-sig
+		os.Exit(1)
 	}()
+	return ctx, cancel
+}
+
+// newMonitor creates a monitor for t, or one replaying -replay, recording
+// to -record if set. The returned function releases the monitor's resources.
+// When replaying, the organization and space of t are set to the recorded
+// ones and ctx is canceled at the end of the recording.
+func newMonitor(ctx context.Context, cancel context.CancelFunc, t *mozzle.Target, e mozzle.Emitter) (*mozzle.AppMonitor, func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	if recordFile != "" {
+		recorder, err := mozzle.CreateRecording(recordFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, func() {
+			if err := recorder.Close(); err != nil {
+				t.Logger.Error("error recording", "error", err)
+			}
+		})
+		t.Recorder = recorder
+	}
 
-	network, addr, err := splitSchemeHost(riemannAddr)
+	var mon *mozzle.AppMonitor
+	var err error
+	if replayFile != "" {
+		mon, err = replayMonitor(ctx, cancel, t, e)
+	} else {
+		mon, err = mozzle.NewMonitor(ctx, *t, e)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "mozzle: error parsing riemann address: %v\n", err)
-		os.Exit(1)
+		closeAll()
+		return nil, nil, err
 	}
-	if network == "" {
-		network = "tcp"
+	closers = append(closers, func() {
+		if err := mon.Close(); err != nil {
+			t.Logger.Error("error closing monitor", "error", err)
+		}
+	})
+	return mon, closeAll, nil
+}
+
+// replayMonitor returns a monitor replaying -replay.
+func replayMonitor(ctx context.Context, cancel context.CancelFunc, t *mozzle.Target, e mozzle.Emitter) (*mozzle.AppMonitor, error) {
+	replay, err := mozzle.OpenReplay(replayFile, replaySpeed)
+	if err != nil {
+		return nil, err
 	}
-	riemann := new(mozzle.RiemannEmitter)
-	riemann.Initialize(network, addr, float32(eventsTTL), queueSize)
-	defer func() {
-		if err := riemann.Close(); err != nil {
-			fmt.Printf("mozzle: error closing riemann emitter: %v\n", err)
+	t.Org, t.Space = replay.Org, replay.Space
+	go func() {
+		select {
+		case <-replay.Done():
+			cancel()
+		case <-ctx.Done():
+			replay.Close()
 		}
 	}()
+	return replay.Monitor(*t, e)
+}
 
-	if err := mozzle.Monitor(ctx, t, riemann); err != nil {
-		fmt.Printf("mozzle: error occured during Monitor: %v\n", err)
+// newLogger returns a logger writing to w in the given format, discarding
+// messages below the given level.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
 	}
 }
 
@@ -177,49 +335,3 @@ func cfcliConfig() (*cliConfig, error) {
 	}
 	return config, nil
 }
-
-func parseToken(accessToken, refreshToken string) (*oauth2.Token, error) {
-	if strings.HasPrefix(accessToken, "bearer ") {
-		accessToken = accessToken[len("bearer "):]
-	}
-	token, err := parseBearerToken(accessToken)
-	if err != nil {
-		return nil, err
-	}
-	token.RefreshToken = refreshToken
-	return token, nil
-}
-
-// parseBearerToken converts the string s to an OAuth2 bearer token.
-// It must be of the form <header>.<payload>.<signature>, where header,
-// payload and signature are base64 encoded JSON objects.
-func parseBearerToken(s string) (*oauth2.Token, error) {
-	parts := strings.Split(s, ".")
-	if len(parts) != 3 {
-		return nil, errors.New("invalid token syntax")
-	}
-	claims, err := base64.RawStdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return nil, errors.Wrap(err, "error decoding token claims segment")
-	}
-	var t struct {
-		Exp int64 `json:"exp"`
-	}
-	err = json.Unmarshal([]byte(claims), &t)
-	if err != nil {
-		return nil, errors.Wrap(err, "error decoding token claims")
-	}
-	return &oauth2.Token{
-		AccessToken: s,
-		TokenType:   "bearer",
-		Expiry:      time.Unix(t.Exp, 0),
-	}, nil
-}
-
-func splitSchemeHost(addr string) (scheme, host string, err error) {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return "", "", err
-	}
-	return u.Scheme, u.Host, nil
-}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		format, level string
+		wantErr       bool
+		want          []string // substrings of the logged lines, in order
+	}{
+		{format: "text", level: "info", want: []string{"level=INFO msg=info", "level=WARN msg=warn"}},
+		{format: "json", level: "info", want: []string{`"level":"INFO","msg":"info"`, `"level":"WARN","msg":"warn"`}},
+		{format: "text", level: "debug", want: []string{"level=DEBUG msg=debug", "level=INFO msg=info", "level=WARN msg=warn"}},
+		{format: "text", level: "WARN", want: []string{"level=WARN msg=warn"}},
+		{format: "text", level: "error"},
+		{format: "xml", level: "info", wantErr: true},
+		{format: "text", level: "verbose", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, tt.format, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLogger() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if buf.Len() == 0 {
+				lines = nil
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("logged %d messages, want %d:\n%s", len(lines), len(tt.want), buf.String())
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("message %q does not contain %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
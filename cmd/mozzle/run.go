@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bo0mer/mozzle"
+)
+
+// Flags of the run command.
+var (
+	riemannAddr string
+
+	eventsTTL          float64
+	queueSize          int
+	eventsOverflow     string
+	eventsBlockTimeout time.Duration
+	eventsSample       string
+
+	shardIndex int
+	shardCount int
+	shardDir   string
+	shardTTL   time.Duration
+
+	leaseFile string
+	leaseURL  string
+	leaseTTL  time.Duration
+
+	instanceID          string
+	adminAddr           string
+	shutdownGracePeriod time.Duration
+
+	quotaWarn     float64
+	quotaCritical float64
+	enrich        string
+
+	optIn          bool
+	httpAggregate  bool
+	memoryWarn     float64
+	memoryCritical float64
+	diskWarn       float64
+	diskCritical   float64
+
+	trend         bool
+	trendWindow   time.Duration
+	trendWarn     time.Duration
+	trendCritical time.Duration
+
+	anomaly         bool
+	anomalyFile     string
+	anomalyAlpha    float64
+	anomalyWarn     float64
+	anomalyCritical float64
+
+	slo             string
+	sloFile         string
+	sloSaveInterval time.Duration
+
+	apdexT        time.Duration
+	apdexPerRoute bool
+
+	reportVersion bool
+)
+
+// runCommand monitors applications and emits their metrics to Riemann. It
+// returns the exit code.
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	targetFlags(fs)
+	fs.StringVar(&riemannAddr, "riemann", "tcp://127.0.0.1:5555", "Address of the Riemann endpoint")
+	fs.Float64Var(&eventsTTL, "events-ttl", 30.0, "TTL for emitted events (in seconds)")
+	fs.IntVar(&queueSize, "events-queue-size", 256, "Queue size for outgoing events")
+	fs.StringVar(&eventsOverflow, "events-overflow", "drop-newest", "Policy when the event queue is full: drop-newest, drop-oldest, block or priority")
+	fs.DurationVar(&eventsBlockTimeout, "events-block-timeout", time.Second, "Maximum time to wait for room in the event queue with the block overflow policy")
+	fs.StringVar(&eventsSample, "events-sample", "", "Comma-separated service=rate pairs, e.g. 'http response time_ms=0.1', for emitting only a fraction of the events of high-rate services")
+	fs.IntVar(&shardIndex, "shard-index", 0, "Index of this instance when sharding applications between -shard-count instances")
+	fs.IntVar(&shardCount, "shard-count", 0, "Number of instances to shard applications between; disabled if 0")
+	fs.StringVar(&shardDir, "shard-dir", "", "Directory shared between instances for sharding applications dynamically; takes precedence over -shard-count")
+	fs.DurationVar(&shardTTL, "shard-ttl", 45*time.Second, "Time after which an instance that stopped heartbeating in -shard-dir is considered dead")
+	fs.StringVar(&leaseFile, "leader-lease-file", "", "Lease file shared between replicas, so that only the leader emits metrics")
+	fs.StringVar(&leaseURL, "leader-lease-url", "", "URL of an HTTP lease shared between replicas, so that only the leader emits metrics")
+	fs.DurationVar(&leaseTTL, "leader-lease-ttl", 0, "Duration of the leader lease (default 3/4 of -refresh-interval)")
+	fs.StringVar(&instanceID, "instance-id", defaultInstanceID(), "ID of this mozzle instance, attached to its own metrics")
+	fs.StringVar(&adminAddr, "admin-addr", "", "Address for serving /healthz, /readyz and mozzle's own metrics at /stats; disabled if empty")
+	fs.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 10*time.Second, "Time to wait for queued events to be sent on shutdown")
+	fs.Float64Var(&quotaWarn, "quota-warn", mozzle.DefaultQuotaWarn, "Ratio of used to allowed org or space quota resources at which they are in warn state")
+	fs.Float64Var(&quotaCritical, "quota-critical", mozzle.DefaultQuotaCritical, "Ratio of used to allowed org or space quota resources at which they are in critical state")
+	fs.StringVar(&enrich, "enrich", "", "Comma-separated application attributes from the Cloud Controller attached to all of its metrics, out of "+strings.Join(mozzle.EnrichmentAttributes, ",")+"; none if empty")
+	fs.BoolVar(&optIn, "opt-in", false, "Monitor only the applications that opt in using mozzle.io/enabled=true")
+	fs.BoolVar(&httpAggregate, "http-aggregate", false, "Emit HTTP metrics aggregated on every refresh instead of for each request, unless applications override it")
+	fs.Float64Var(&memoryWarn, "memory-warn", 0, "Used memory ratio of an instance above which its memory metrics are in warn state, unless applications override it; disabled if 0")
+	fs.Float64Var(&memoryCritical, "memory-critical", 0, "Used memory ratio of an instance above which its memory metrics are in critical state, unless applications override it; disabled if 0")
+	fs.Float64Var(&diskWarn, "disk-warn", 0, "Used disk ratio of an instance above which its disk metrics are in warn state, unless applications override it; disabled if 0")
+	fs.Float64Var(&diskCritical, "disk-critical", 0, "Used disk ratio of an instance above which its disk metrics are in critical state, unless applications override it; disabled if 0")
+	fs.BoolVar(&trend, "trend", false, "Emit the projected time until each instance exhausts its memory or disk quota, polling the uptime of the instances of running applications on every refresh")
+	fs.DurationVar(&trendWindow, "trend-window", mozzle.DefaultTrendWindow, "Time over which the -trend memory and disk growth of each instance is estimated")
+	fs.DurationVar(&trendWarn, "trend-warn", mozzle.DefaultTrendWarn, "Projected time until an instance exhausts its memory or disk quota below which it is in warn state")
+	fs.DurationVar(&trendCritical, "trend-critical", mozzle.DefaultTrendCritical, "Projected time until an instance exhausts its memory or disk quota below which it is in critical state")
+	fs.BoolVar(&anomaly, "anomaly", false, "Emit z-scores of the HTTP response times and 5xx ratios of applications compared to their rolling baselines")
+	fs.StringVar(&anomalyFile, "anomaly-file", "", "File for persisting the -anomaly baselines across restarts; kept in memory if empty")
+	fs.Float64Var(&anomalyAlpha, "anomaly-alpha", mozzle.DefaultAnomalyAlpha, "Smoothing factor of the -anomaly baselines; higher values adapt to changes faster")
+	fs.Float64Var(&anomalyWarn, "anomaly-warn", mozzle.DefaultAnomalyWarn, "Z-score at or above which -anomaly metrics are in warn state")
+	fs.Float64Var(&anomalyCritical, "anomaly-critical", mozzle.DefaultAnomalyCritical, "Z-score at or above which -anomaly metrics are in critical state")
+	fs.StringVar(&slo, "slo", "", "SLOs of all applications, unless they override them, e.g. 'objective=99.9%,latency=500ms,period=30d,peer=server'; multiple ones are separated by semicolons")
+	fs.StringVar(&sloFile, "slo-file", "", "File for persisting the SLO request counts across restarts; kept in memory if empty")
+	fs.DurationVar(&sloSaveInterval, "slo-save-interval", mozzle.DefaultSLOSaveInterval, "Interval for saving the SLO request counts, which are also saved on shutdown and when applications move between instances")
+	fs.DurationVar(&apdexT, "apdex-t", 0, "Apdex threshold of the HTTP response times of all applications, unless they override it; disabled if 0")
+	fs.BoolVar(&apdexPerRoute, "apdex-per-route", false, "Emit Apdex scores per route instead of per application, unless applications override it")
+	fs.BoolVar(&reportVersion, "v", false, "Report mozzle version")
+	fs.BoolVar(&reportVersion, "version", false, "Report mozzle version")
+	fs.Parse(args)
+	if reportVersion {
+		printVersion()
+		return 0
+	}
+
+	logger, t, err := setup()
+	if err != nil {
+		return 1
+	}
+	stats := &mozzle.Stats{InstanceID: instanceID}
+	t.Stats = stats
+	t.Quota = mozzle.QuotaThresholds{Warn: quotaWarn, Critical: quotaCritical}
+	t.AppDefaults = mozzle.AppSettings{
+		Disabled:       optIn,
+		HTTPAggregate:  httpAggregate,
+		MemoryWarn:     memoryWarn,
+		MemoryCritical: memoryCritical,
+		DiskWarn:       diskWarn,
+		DiskCritical:   diskCritical,
+		ApdexT:         apdexT,
+		ApdexPerRoute:  apdexPerRoute,
+	}
+	slos, err := mozzle.ParseSLOs(slo)
+	if err != nil {
+		logger.Error("error parsing SLOs", "error", err)
+		return 1
+	}
+	t.AppDefaults.SLOs = slos
+	if sloFile != "" {
+		t.SLOStore = &mozzle.FileSLOStore{Path: sloFile}
+	}
+	t.SLOSaveInterval = sloSaveInterval
+	if trend {
+		t.Trend = &mozzle.TrendConfig{Window: trendWindow, Warn: trendWarn, Critical: trendCritical}
+	}
+	t.Enrich = splitList(enrich)
+	if anomaly {
+		t.Anomaly = &mozzle.AnomalyDetection{
+			Alpha:    anomalyAlpha,
+			Warn:     anomalyWarn,
+			Critical: anomalyCritical,
+		}
+		if anomalyFile != "" {
+			t.Anomaly.Store = &mozzle.FileBaselineStore{Path: anomalyFile}
+		}
+	}
+	if err := checkEnrichment(t.Enrich); err != nil {
+		logger.Error("error parsing enrichment attributes", "error", err)
+		return 1
+	}
+
+	switch {
+	case shardDir != "":
+		sharder := &mozzle.GroupSharder{
+			ID:         instanceID,
+			Membership: &mozzle.DirMembership{Dir: shardDir, TTL: shardTTL},
+		}
+		defer func() {
+			if err := sharder.Leave(context.Background()); err != nil {
+				logger.Error("error leaving shard group", "error", err)
+			}
+		}()
+		t.Sharder = sharder
+	case shardCount > 0:
+		if shardIndex < 0 || shardIndex >= shardCount {
+			logger.Error("invalid shard index", "shard_index", shardIndex, "shard_count", shardCount)
+			return 1
+		}
+		t.Sharder = &mozzle.StaticSharder{Index: shardIndex, Count: shardCount}
+	}
+
+	var lease mozzle.Lease
+	switch {
+	case leaseFile != "":
+		lease = &mozzle.FileLease{Path: leaseFile}
+	case leaseURL != "":
+		lease = &mozzle.HTTPLease{URL: leaseURL}
+	}
+	var leadership *mozzle.Leadership
+	if lease != nil {
+		if leaseTTL == 0 {
+			// Renewing three times per TTL makes sure that a standby takes
+			// over within one refresh interval.
+			leaseTTL = refreshInterval * 3 / 4
+		}
+		leadership = &mozzle.Leadership{
+			ID:     instanceID,
+			Lease:  lease,
+			TTL:    leaseTTL,
+			Logger: logger,
+		}
+		t.Leader = leadership
+	}
+
+	ctx, cancel := signalContext(logger, "grace_period", shutdownGracePeriod)
+
+	network, addr, err := splitSchemeHost(riemannAddr)
+	if err != nil {
+		logger.Error("error parsing riemann address", "error", err)
+		return 1
+	}
+	if network == "" {
+		network = "tcp"
+	}
+	overflow, ok := mozzle.ParseOverflowPolicy(eventsOverflow)
+	if !ok {
+		logger.Error("invalid events overflow policy", "policy", eventsOverflow)
+		return 1
+	}
+	sampleRates, err := parseSampleRates(eventsSample)
+	if err != nil {
+		logger.Error("error parsing events sample rates", "error", err)
+		return 1
+	}
+	riemann := &mozzle.RiemannEmitter{
+		Stats:        stats,
+		Logger:       logger,
+		Overflow:     overflow,
+		BlockTimeout: eventsBlockTimeout,
+		SampleRates:  sampleRates,
+	}
+	riemann.Initialize(network, addr, float32(eventsTTL), queueSize)
+	defer func() {
+		// Monitor has returned by now, so wait for the queued events to be
+		// sent, but no longer than the grace period.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if err := mozzle.ShutdownEmitter(shutdownCtx, riemann); err != nil {
+			logger.Error("error shutting down riemann emitter", "error", err)
+		}
+	}()
+
+	mon, closeMonitor, err := newMonitor(ctx, cancel, &t, riemann)
+	if err != nil {
+		logger.Error("error creating monitor", "error", err)
+		return 1
+	}
+	defer closeMonitor()
+
+	if leadership != nil {
+		go func() {
+			if err := leadership.Run(ctx); err != nil && err != context.Canceled {
+				logger.Error("error running leader election", "error", err)
+			}
+		}()
+	}
+
+	if adminAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, mozzle.AdminHandler(mon, stats)); err != nil {
+				logger.Error("error serving admin endpoints", "error", err)
+			}
+		}()
+	}
+
+	if err := mon.Monitor(ctx, t.Org, t.Space); err != nil && err != context.Canceled {
+		logger.Error("error occurred during Monitor", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// defaultInstanceID returns an ID based on the hostname and the process ID,
+// which is unique enough for telling mozzle instances apart.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// parseSampleRates parses comma-separated service=rate pairs.
+func parseSampleRates(s string) (map[string]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("missing rate for service %q", pair)
+		}
+		rate, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate %q for service %q; must be between 0 and 1", pair[i+1:], pair[:i])
+		}
+		rates[strings.TrimSpace(pair[:i])] = rate
+	}
+	return rates, nil
+}
+
+func splitSchemeHost(addr string) (scheme, host string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// checkEnrichment returns an error if any of attrs is not one of
+// mozzle.EnrichmentAttributes.
+func checkEnrichment(attrs []string) error {
+	valid := make(map[string]bool)
+	for _, attr := range mozzle.EnrichmentAttributes {
+		valid[attr] = true
+	}
+	for _, attr := range attrs {
+		if !valid[attr] {
+			return fmt.Errorf("unknown attribute %q, expected one of %s", attr, strings.Join(mozzle.EnrichmentAttributes, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Bo0mer/mozzle"
+)
+
+// Flags of the tail command.
+var (
+	tailFormat   string
+	tailApps     string
+	tailServices string
+	tailTop      bool
+	topInterval  time.Duration
+)
+
+// tailCommand prints the metrics of the monitored applications to stdout. It
+// returns the exit code.
+func tailCommand(args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	targetFlags(fs)
+	fs.StringVar(&tailFormat, "format", "text", "Output format, either text or json")
+	fs.StringVar(&tailApps, "app", "", "Comma-separated names or GUIDs of the applications whose metrics are printed; all if empty")
+	fs.StringVar(&tailServices, "service", "", "Comma-separated prefixes of the services whose metrics are printed, e.g. 'memory,http'; all if empty")
+	fs.BoolVar(&tailTop, "top", false, "Print a live table of per-instance CPU, memory, disk and HTTP rates instead of single metrics")
+	fs.DurationVar(&topInterval, "top-interval", 2*time.Second, "Time between refreshing the -top table")
+	fs.Parse(args)
+
+	logger, t, err := setup()
+	if err != nil {
+		return 1
+	}
+	if tailFormat != "text" && tailFormat != "json" {
+		logger.Error("invalid output format", "format", tailFormat)
+		return 1
+	}
+	filter := mozzle.MetricFilter{
+		Apps:     splitList(tailApps),
+		Services: splitList(tailServices),
+	}
+
+	ctx, cancel := signalContext(logger)
+	var e mozzle.Emitter = &mozzle.ConsoleEmitter{
+		W:      os.Stdout,
+		JSON:   tailFormat == "json",
+		Filter: filter,
+	}
+	if tailTop {
+		top := newTopTable(filter)
+		go top.Run(ctx.Done(), os.Stdout, topInterval)
+		e = top
+	}
+
+	mon, closeMonitor, err := newMonitor(ctx, cancel, &t, e)
+	if err != nil {
+		logger.Error("error creating monitor", "error", err)
+		return 1
+	}
+	defer closeMonitor()
+
+	if err := mon.Monitor(ctx, t.Org, t.Space); err != nil && err != context.Canceled {
+		logger.Error("error occurred during Monitor", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// topTable implements mozzle.Emitter that aggregates the metrics of each
+// application instance and periodically prints them as a table.
+type topTable struct {
+	filter mozzle.MetricFilter
+
+	mu   sync.Mutex // guards
+	rows map[topKey]*topRow
+}
+
+type topKey struct {
+	app      string
+	instance int
+}
+
+// topRow holds the latest container metrics of an instance and the number
+// of HTTP requests since the table was last printed.
+type topRow struct {
+	cpu         float64
+	memory      int
+	memoryQuota int
+	disk        int
+	diskQuota   int
+	requests    int
+	errors      int // 5xx responses
+	updated     time.Time
+}
+
+// topRowTTL is the time after which instances without new metrics are
+// removed from the table, e.g. after being stopped.
+const topRowTTL = time.Minute
+
+func newTopTable(filter mozzle.MetricFilter) *topTable {
+	return &topTable{filter: filter, rows: make(map[topKey]*topRow)}
+}
+
+// Emit implements mozzle.Emitter.
+func (t *topTable) Emit(m mozzle.Metric) {
+	if !t.filter.Match(m) {
+		return
+	}
+	instance, err := strconv.Atoi(m.Attributes["instance"])
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := topKey{app: m.Organization + "/" + m.Space + "/" + m.Application, instance: instance}
+	row, ok := t.rows[key]
+	if !ok {
+		row = new(topRow)
+		t.rows[key] = row
+	}
+	row.updated = time.Now()
+	switch m.Service {
+	case "cpu_percent":
+		row.cpu, _ = m.Metric.(float64)
+	case "memory used_bytes":
+		row.memory, _ = m.Metric.(int)
+	case "memory total_bytes":
+		row.memoryQuota, _ = m.Metric.(int)
+	case "disk used_bytes":
+		row.disk, _ = m.Metric.(int)
+	case "disk total_bytes":
+		row.diskQuota, _ = m.Metric.(int)
+	case "http response time_ms":
+		row.requests++
+		if strings.HasPrefix(m.Attributes["status_code"], "5") {
+			row.errors++
+		}
+	}
+}
+
+// Run prints the table to w every interval, until done is closed.
+func (t *topTable) Run(done <-chan struct{}, w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.print(w, interval)
+		case <-done:
+			return
+		}
+	}
+}
+
+// print clears the terminal and prints the table, with HTTP rates computed
+// over the past interval.
+func (t *topTable) print(w io.Writer, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]topKey, 0, len(t.rows))
+	for k, row := range t.rows {
+		if time.Since(row.updated) > topRowTTL {
+			delete(t.rows, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].app != keys[j].app {
+			return keys[i].app < keys[j].app
+		}
+		return keys[i].instance < keys[j].instance
+	})
+
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "mozzle tail - %s\n\n", time.Now().Format("15:04:05"))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "APP\tINSTANCE\tCPU\tMEMORY\tDISK\tREQ/S\t5XX/S")
+	for _, k := range keys {
+		row := t.rows[k]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%s / %s\t%s / %s\t%.1f\t%.1f\n",
+			k.app, k.instance, row.cpu,
+			byteSize(row.memory), byteSize(row.memoryQuota),
+			byteSize(row.disk), byteSize(row.diskQuota),
+			float64(row.requests)/interval.Seconds(), float64(row.errors)/interval.Seconds())
+		row.requests, row.errors = 0, 0
+	}
+	tw.Flush()
+}
+
+// byteSize formats n bytes using binary units, e.g. 1.5G.
+func byteSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.Itoa(n) + "B"
+	}
+	div, exp := unit, 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
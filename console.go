@@ -0,0 +1,140 @@
+package mozzle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsoleEmitter implements Emitter that writes metrics to a terminal or a
+// file, either in a human-readable form, one metric per line, or as JSON
+// lines. It is meant for debugging, without setting up a metrics pipeline.
+type ConsoleEmitter struct {
+	// W is where metrics are written to.
+	W io.Writer
+	// JSON selects JSON lines output.
+	JSON bool
+	// Filter selects the written metrics.
+	Filter MetricFilter
+
+	mu sync.Mutex // guards W
+}
+
+// MetricFilter selects metrics by application and service.
+type MetricFilter struct {
+	// Apps, if not empty, selects the metrics of the applications with
+	// these names or GUIDs.
+	Apps []string
+	// Services, if not empty, selects the metrics whose service starts with
+	// any of these prefixes, e.g. "memory" or "http response".
+	Services []string
+}
+
+// Match reports whether m is selected by the filter.
+func (f MetricFilter) Match(m Metric) bool {
+	if len(f.Apps) > 0 && !contains(f.Apps, m.Application) && !contains(f.Apps, m.ApplicationID) {
+		return false
+	}
+	if len(f.Services) == 0 {
+		return true
+	}
+	for _, prefix := range f.Services {
+		if strings.HasPrefix(m.Service, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// consoleMetric is the JSON representation of a Metric.
+type consoleMetric struct {
+	Time          time.Time         `json:"time"`
+	Application   string            `json:"application"`
+	ApplicationID string            `json:"application_id"`
+	Organization  string            `json:"org"`
+	Space         string            `json:"space"`
+	Service       string            `json:"service"`
+	Metric        interface{}       `json:"metric"`
+	State         string            `json:"state"`
+	Description   string            `json:"description,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+}
+
+// Emit writes m, if it matches the filter. It is safe for concurrent use.
+func (c *ConsoleEmitter) Emit(m Metric) {
+	if !c.Filter.Match(m) {
+		return
+	}
+	t := time.Now()
+	if m.Time != 0 {
+		t = time.Unix(m.Time, 0)
+	}
+
+	var line []byte
+	if c.JSON {
+		var err error
+		line, err = json.Marshal(consoleMetric{
+			Time:          t.UTC(),
+			Application:   m.Application,
+			ApplicationID: m.ApplicationID,
+			Organization:  m.Organization,
+			Space:         m.Space,
+			Service:       m.Service,
+			Metric:        m.Metric,
+			State:         m.State,
+			Description:   m.Description,
+			Tags:          m.Tags,
+			Attributes:    m.Attributes,
+		})
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		line = []byte(formatMetric(t, m))
+	}
+
+	c.mu.Lock()
+	c.W.Write(line)
+	c.mu.Unlock()
+}
+
+// formatMetric formats m as a single human-readable line. The attributes
+// that identify the application are left out, as they are already part of
+// the line.
+func formatMetric(t time.Time, m Metric) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s/%s/%s %q = %v [%s]",
+		t.Format("15:04:05"), m.Organization, m.Space, m.Application, m.Service, m.Metric, m.State)
+	keys := make([]string, 0, len(m.Attributes))
+	for k := range m.Attributes {
+		switch k {
+		case "org", "space", "application", "application_id":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, m.Attributes[k])
+	}
+	if m.Description != "" {
+		fmt.Fprintf(&b, " %q", m.Description)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
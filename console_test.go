@@ -0,0 +1,92 @@
+package mozzle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMetricFilterMatch(t *testing.T) {
+	m := Metric{Application: "app-a", ApplicationID: "a", Service: "http response time_ms"}
+	tests := []struct {
+		name   string
+		filter MetricFilter
+		want   bool
+	}{
+		{"empty", MetricFilter{}, true},
+		{"app name", MetricFilter{Apps: []string{"app-b", "app-a"}}, true},
+		{"app guid", MetricFilter{Apps: []string{"a"}}, true},
+		{"other app", MetricFilter{Apps: []string{"b"}}, false},
+		{"service prefix", MetricFilter{Services: []string{"memory", "http"}}, true},
+		{"other service", MetricFilter{Services: []string{"memory"}}, false},
+		{"app and service", MetricFilter{Apps: []string{"a"}, Services: []string{"http response"}}, true},
+		{"app but not service", MetricFilter{Apps: []string{"a"}, Services: []string{"cpu"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(m); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsoleEmitter(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := ts.Local().Format("15:04:05")
+	m := Metric{
+		Time:          ts.Unix(),
+		Application:   "app-a",
+		ApplicationID: "a",
+		Organization:  "org",
+		Space:         "space",
+		Service:       "memory used_bytes",
+		Metric:        42,
+		State:         "ok",
+		Attributes:    map[string]string{"instance": "0", "application_id": "a", "org": "org", "buildpack": "go"},
+	}
+	described := m
+	described.Description = "used memory"
+	tests := []struct {
+		name   string
+		json   bool
+		filter MetricFilter
+		metric Metric
+		want   string
+	}{
+		{
+			name:   "text",
+			metric: m,
+			want:   clock + ` org/space/app-a "memory used_bytes" = 42 [ok] buildpack=go instance=0` + "\n",
+		},
+		{
+			name:   "text with description",
+			metric: described,
+			want:   clock + ` org/space/app-a "memory used_bytes" = 42 [ok] buildpack=go instance=0 "used memory"` + "\n",
+		},
+		{
+			name:   "json",
+			json:   true,
+			metric: m,
+			want: `{"time":"2020-01-02T03:04:05Z","application":"app-a","application_id":"a","org":"org","space":"space",` +
+				`"service":"memory used_bytes","metric":42,"state":"ok",` +
+				`"attributes":{"application_id":"a","buildpack":"go","instance":"0","org":"org"}}` + "\n",
+		},
+		{
+			name:   "filtered out",
+			filter: MetricFilter{Services: []string{"cpu"}},
+			metric: m,
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := &ConsoleEmitter{W: &buf, JSON: tt.json, Filter: tt.filter}
+			c.Emit(tt.metric)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
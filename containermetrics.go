@@ -8,48 +8,53 @@ import (
 
 type containerMetrics struct {
 	*cfevent.ContainerMetric
-	App application
+	App      application
+	Settings AppSettings
 }
 
 func (m containerMetrics) EmitTo(e Emitter) {
 	attributes := attributes(m.App)
 	attributes["instance"] = strconv.Itoa(int(m.GetInstanceIndex()))
+	memoryRatio := ratio(m.GetMemoryBytes(), m.GetMemoryBytesQuota())
+	memoryState := ratioState(memoryRatio, m.Settings.MemoryWarn, m.Settings.MemoryCritical)
+	diskRatio := ratio(m.GetDiskBytes(), m.GetDiskBytesQuota())
+	diskState := ratioState(diskRatio, m.Settings.DiskWarn, m.Settings.DiskCritical)
 
 	e.Emit(forApp(m.App, Metric{
 		Service:    "memory used_bytes",
 		Metric:     int(m.GetMemoryBytes()),
-		State:      "ok",
+		State:      memoryState,
 		Attributes: attributes,
 	}))
 	e.Emit(forApp(m.App, Metric{
 		Service:    "memory total_bytes",
 		Metric:     int(m.GetMemoryBytesQuota()),
-		State:      "ok",
+		State:      memoryState,
 		Attributes: attributes,
 	}))
 	e.Emit(forApp(m.App, Metric{
 		Service:    "memory used_ratio",
-		Metric:     ratio(m.GetMemoryBytes(), m.GetMemoryBytesQuota()),
-		State:      "ok",
+		Metric:     memoryRatio,
+		State:      memoryState,
 		Attributes: attributes,
 	}))
 
 	e.Emit(forApp(m.App, Metric{
 		Service:    "disk used_bytes",
 		Metric:     int(m.GetDiskBytes()),
-		State:      "ok",
+		State:      diskState,
 		Attributes: attributes,
 	}))
 	e.Emit(forApp(m.App, Metric{
 		Service:    "disk total_bytes",
 		Metric:     int(m.GetDiskBytesQuota()),
-		State:      "ok",
+		State:      diskState,
 		Attributes: attributes,
 	}))
 	e.Emit(forApp(m.App, Metric{
 		Service:    "disk used_ratio",
-		Metric:     ratio(m.GetDiskBytes(), m.GetDiskBytesQuota()),
-		State:      "ok",
+		Metric:     diskRatio,
+		State:      diskState,
 		Attributes: attributes,
 	}))
 
@@ -0,0 +1,181 @@
+package mozzle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// EventCursor marks the position in the audit event stream up to which
+// events have already been emitted.
+type EventCursor struct {
+	// Timestamp is the timestamp of the last emitted event.
+	Timestamp time.Time `json:"timestamp"`
+	// GUIDs holds the GUIDs of the emitted events with timestamp equal to
+	// Timestamp. Since event timestamps have a precision of one second,
+	// they are needed for telling apart new events from already emitted ones.
+	GUIDs []string `json:"guids"`
+}
+
+// Seen reports whether the event e is at or before the cursor.
+func (c EventCursor) Seen(e ccv2.Event) bool {
+	ts := e.Entity.Timestamp
+	if ts.Before(c.Timestamp) {
+		return true
+	}
+	if ts.After(c.Timestamp) {
+		return false
+	}
+	for _, guid := range c.GUIDs {
+		if guid == e.GUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Advance returns a cursor positioned at the event e, which should not be
+// before c.
+func (c EventCursor) Advance(e ccv2.Event) EventCursor {
+	ts := e.Entity.Timestamp
+	if ts.After(c.Timestamp) {
+		return EventCursor{Timestamp: ts, GUIDs: []string{e.GUID}}
+	}
+	guids := make([]string, len(c.GUIDs), len(c.GUIDs)+1)
+	copy(guids, c.GUIDs)
+	return EventCursor{Timestamp: c.Timestamp, GUIDs: append(guids, e.GUID)}
+}
+
+// CursorStore stores event cursors by key. Implementations should be safe
+// for concurrent use.
+type CursorStore interface {
+	// Load returns the cursor stored under key. The boolean result reports
+	// whether such cursor exists.
+	Load(key string) (EventCursor, bool, error)
+	// Save stores the cursor c under key.
+	Save(key string, c EventCursor) error
+}
+
+// MemoryCursorStore implements CursorStore that keeps cursors in memory.
+// Its zero value is ready to use.
+type MemoryCursorStore struct {
+	mu      sync.Mutex
+	cursors map[string]EventCursor
+}
+
+// Load implements CursorStore.
+func (s *MemoryCursorStore) Load(key string) (EventCursor, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cursors[key]
+	return c, ok, nil
+}
+
+// Save implements CursorStore.
+func (s *MemoryCursorStore) Save(key string, c EventCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursors == nil {
+		s.cursors = make(map[string]EventCursor)
+	}
+	s.cursors[key] = c
+	return nil
+}
+
+// FileCursorStore implements CursorStore that persists cursors in a JSON
+// encoded file, so that they survive restarts.
+// The file is rewritten atomically on every Save.
+type FileCursorStore struct {
+	// Path is the path of the file. It is created if it does not exist.
+	Path string
+
+	mu      sync.Mutex
+	cursors map[string]EventCursor
+}
+
+// Load implements CursorStore.
+func (s *FileCursorStore) Load(key string) (EventCursor, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return EventCursor{}, false, err
+	}
+	c, ok := s.cursors[key]
+	return c, ok, nil
+}
+
+// Save implements CursorStore.
+func (s *FileCursorStore) Save(key string, c EventCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.cursors[key] = c
+	return writeFileAtomic(s.Path, s.cursors)
+}
+
+// load reads the file, unless it has already been read.
+func (s *FileCursorStore) load() error {
+	if s.cursors != nil {
+		return nil
+	}
+	cursors := make(map[string]EventCursor)
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &cursors); err != nil {
+			return err
+		}
+	}
+	s.cursors = cursors
+	return nil
+}
+
+// writeFileAtomic writes the JSON encoding of v to path, by first writing
+// to a temporary file in the same directory and then renaming it.
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newEvents returns the events from evs that are after cursor c, sorted by
+// their timestamp, together with the cursor advanced past them.
+func newEvents(c EventCursor, evs []ccv2.Event) ([]ccv2.Event, EventCursor) {
+	sort.SliceStable(evs, func(i, j int) bool {
+		return evs[i].Entity.Timestamp.Before(evs[j].Entity.Timestamp)
+	})
+	var res []ccv2.Event
+	for _, e := range evs {
+		if c.Seen(e) {
+			continue
+		}
+		res = append(res, e)
+		c = c.Advance(e)
+	}
+	return res, c
+}
@@ -0,0 +1,122 @@
+package mozzle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+func event(guid string, ts time.Time) ccv2.Event {
+	var e ccv2.Event
+	e.GUID = guid
+	e.Entity.Timestamp = ts
+	return e
+}
+
+func eventGUIDs(evs []ccv2.Event) []string {
+	var guids []string
+	for _, e := range evs {
+		guids = append(guids, e.GUID)
+	}
+	return guids
+}
+
+func TestNewEvents(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Second)
+	t2 := t1.Add(time.Second)
+	tests := []struct {
+		name       string
+		cursor     EventCursor
+		events     []ccv2.Event
+		want       []string
+		wantCursor EventCursor
+	}{
+		{
+			name:       "empty cursor",
+			events:     []ccv2.Event{event("b", t1), event("a", t0)},
+			want:       []string{"a", "b"},
+			wantCursor: EventCursor{Timestamp: t1, GUIDs: []string{"b"}},
+		},
+		{
+			name:       "no events",
+			cursor:     EventCursor{Timestamp: t1, GUIDs: []string{"b"}},
+			want:       nil,
+			wantCursor: EventCursor{Timestamp: t1, GUIDs: []string{"b"}},
+		},
+		{
+			name:       "events before cursor",
+			cursor:     EventCursor{Timestamp: t1, GUIDs: []string{"b"}},
+			events:     []ccv2.Event{event("a", t0), event("b", t1), event("c", t2)},
+			want:       []string{"c"},
+			wantCursor: EventCursor{Timestamp: t2, GUIDs: []string{"c"}},
+		},
+		{
+			name:       "new event with the cursor timestamp",
+			cursor:     EventCursor{Timestamp: t1, GUIDs: []string{"b"}},
+			events:     []ccv2.Event{event("b", t1), event("c", t1)},
+			want:       []string{"c"},
+			wantCursor: EventCursor{Timestamp: t1, GUIDs: []string{"b", "c"}},
+		},
+		{
+			name:       "all seen",
+			cursor:     EventCursor{Timestamp: t1, GUIDs: []string{"b", "c"}},
+			events:     []ccv2.Event{event("c", t1), event("b", t1), event("a", t0)},
+			want:       nil,
+			wantCursor: EventCursor{Timestamp: t1, GUIDs: []string{"b", "c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, c := newEvents(tt.cursor, tt.events)
+			if guids := eventGUIDs(got); !reflect.DeepEqual(guids, tt.want) {
+				t.Errorf("events = %v, want %v", guids, tt.want)
+			}
+			if !c.Timestamp.Equal(tt.wantCursor.Timestamp) || !reflect.DeepEqual(c.GUIDs, tt.wantCursor.GUIDs) {
+				t.Errorf("cursor = %+v, want %+v", c, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestEventCursorAdvanceDoesNotAlias(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := EventCursor{Timestamp: t0, GUIDs: make([]string, 1, 4)}
+	c.GUIDs[0] = "a"
+	b := c.Advance(event("b", t0))
+	d := c.Advance(event("d", t0))
+	if !reflect.DeepEqual(b.GUIDs, []string{"a", "b"}) || !reflect.DeepEqual(d.GUIDs, []string{"a", "d"}) {
+		t.Errorf("Advance() = %v and %v, want [a b] and [a d]", b.GUIDs, d.GUIDs)
+	}
+}
+
+func TestFileCursorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	s := &FileCursorStore{Path: path}
+	if _, ok, err := s.Load("org/space"); err != nil || ok {
+		t.Fatalf("Load() from a missing file = %v, %v, want false, nil", ok, err)
+	}
+	want := EventCursor{Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), GUIDs: []string{"a"}}
+	if err := s.Save("org/space", want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := (&FileCursorStore{Path: path}).Load("org/space")
+	if err != nil || !ok {
+		t.Fatalf("Load() = %v, %v, want true, nil", ok, err)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) || !reflect.DeepEqual(got.GUIDs, want.GUIDs) {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+}
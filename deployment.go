@@ -0,0 +1,337 @@
+package mozzle
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// deploymentTimeout is the time after which a deployment that has not
+// completed is reported.
+const deploymentTimeout = 30 * time.Minute
+
+// Audit event types that mark the stages of a deployment. Pushes through
+// the v2 API record only application updates, so the start and the end of
+// staging are detected from the staging logs as well.
+var (
+	stagingEventTypes = []string{"audit.app.restage", "audit.app.build.create", "audit.app.package.upload"}
+	dropletEventTypes = []string{"audit.app.droplet.create", "audit.app.droplet.mapped"}
+	restartEventTypes = []string{"audit.app.start", "audit.app.restart", "audit.app.deployment.create"}
+)
+
+// uploadedDroplet matches the staging log line reporting the droplet size,
+// e.g. "Uploaded droplet (58.2M)".
+var uploadedDroplet = regexp.MustCompile(`Uploaded droplet \(([0-9.]+)([KMG]?)\)`)
+
+// deployment correlates the staging of an application, the creation of its
+// droplet and its restart.
+type deployment struct {
+	App application
+	// Trigger is the type of the event that started the deployment, or
+	// "staging log", if it was noticed from the staging logs.
+	Trigger string
+	// Started, Staged and Finished are the times when the deployment
+	// started, when staging completed and when the deployment finished.
+	Started  time.Time
+	Staged   time.Time
+	Finished time.Time
+	// Outcome is one of "succeeded", "failed", "staged", if the application
+	// was not restarted in time, "timed_out", if staging did not complete
+	// in time, or "superseded", if another deployment started meanwhile.
+	Outcome      string
+	Buildpack    string
+	Stack        string
+	DropletBytes uint64
+
+	// down reports whether some of the instances were seen not running
+	// since the deployment started.
+	down bool
+	// failed is the time when staging failed.
+	failed time.Time
+}
+
+// deploymentStates maps the deployment outcomes to states.
+var deploymentStates = map[string]string{
+	"succeeded":  "ok",
+	"superseded": "ok",
+	"staged":     "warn",
+	"failed":     "critical",
+	"timed_out":  "critical",
+}
+
+func (d deployment) EmitTo(e Emitter) {
+	attributes := attributes(d.App)
+	attributes["outcome"] = d.Outcome
+	attributes["trigger"] = d.Trigger
+	attributes["started_at"] = d.Started.UTC().Format(time.RFC3339)
+	attributes["finished_at"] = d.Finished.UTC().Format(time.RFC3339)
+	if d.Buildpack != "" {
+		attributes["buildpack"] = d.Buildpack
+	}
+	if d.Stack != "" {
+		attributes["stack"] = d.Stack
+	}
+	if d.DropletBytes > 0 {
+		attributes["droplet_bytes"] = strconv.FormatUint(d.DropletBytes, 10)
+	}
+	state := deploymentStates[d.Outcome]
+	duration := d.Finished.Sub(d.Started)
+
+	e.Emit(forApp(d.App, Metric{
+		Time:       d.Finished.Unix(),
+		Service:    "app deployment duration_ms",
+		Metric:     duration.Milliseconds(),
+		State:      state,
+		Attributes: attributes,
+	}))
+	// The event carries a description and tags, so that it can be shown as
+	// an annotation on graphs.
+	e.Emit(forApp(d.App, Metric{
+		Time:        d.Finished.Unix(),
+		Service:     "app deployment",
+		Metric:      1,
+		State:       state,
+		Description: d.description(duration),
+		Tags:        []string{"deployment", d.Outcome},
+		Attributes:  attributes,
+	}))
+}
+
+// description returns a human-readable summary of the deployment.
+func (d deployment) description(duration time.Duration) string {
+	var details []string
+	if d.Buildpack != "" {
+		details = append(details, d.Buildpack)
+	}
+	if d.Stack != "" {
+		details = append(details, d.Stack)
+	}
+	if d.DropletBytes > 0 {
+		details = append(details, fmt.Sprintf("droplet %.1fM", float64(d.DropletBytes)/(1<<20)))
+	}
+	desc := fmt.Sprintf("Deployment of %s %s after %s", d.App.Entity.Name, strings.ReplaceAll(d.Outcome, "_", " "), duration.Round(time.Second))
+	if len(details) > 0 {
+		desc += " (" + strings.Join(details, ", ") + ")"
+	}
+	return desc
+}
+
+// finish marks the deployment as finished at t with the given outcome.
+func (d *deployment) finish(outcome string, t time.Time) *deployment {
+	d.Outcome = outcome
+	d.Finished = t
+	return d
+}
+
+// deploymentEvent advances the deployment of the application based on one
+// of its audit events.
+func (m *AppMonitor) deploymentEvent(ctx context.Context, guid string, event ccv2.Event) {
+	t := event.Entity.Timestamp
+	var finished []*deployment
+	m.mu.Lock()
+	status, ok := m.monitored[guid]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	if t.Before(status.deployed) {
+		// The event belongs to a deployment that has already finished.
+		m.mu.Unlock()
+		return
+	}
+	d := status.deployment
+	switch typ := event.Entity.Type; {
+	case contains(stagingEventTypes, typ):
+		// Events are polled after the staging logs are received, so only
+		// a staging event after the current one has been staged starts a
+		// new deployment.
+		if d != nil && !d.Staged.IsZero() && t.After(d.Staged) {
+			finished = append(finished, d.finish("superseded", t))
+			d = nil
+		}
+		if d == nil {
+			d = &deployment{App: status.application, Started: t}
+		}
+		// A deployment noticed from the staging logs is attributed to the
+		// event that triggered it.
+		d.Trigger = typ
+		if t.Before(d.Started) {
+			d.Started = t
+		}
+	case contains(dropletEventTypes, typ):
+		if d == nil {
+			d = &deployment{App: status.application, Trigger: typ, Started: t}
+		}
+		if d.Staged.IsZero() {
+			d.Staged = t
+		}
+	case contains(restartEventTypes, typ):
+		if d != nil && !d.Staged.IsZero() && !t.Before(d.Staged.Truncate(time.Second)) {
+			finished = append(finished, d.finish("succeeded", t))
+			d = nil
+		}
+	}
+	status.deployment = d
+	if len(finished) > 0 {
+		status.deployed = t
+	}
+	m.mu.Unlock()
+
+	for _, d := range finished {
+		m.emitDeployment(ctx, d)
+	}
+}
+
+// stagingLog advances the deployment of the application based on one of
+// its log messages.
+func (m *AppMonitor) stagingLog(guid string, msg *events.LogMessage) {
+	if msg.GetSourceType() != "STG" {
+		return
+	}
+	t := time.Unix(0, msg.GetTimestamp())
+	text := string(msg.GetMessage())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.monitored[guid]
+	if !ok {
+		return
+	}
+	lower := strings.ToLower(text)
+	d := status.deployment
+	if d == nil {
+		// The staging logs are usually received before the event that
+		// triggered staging is polled. Only the first line of staging
+		// starts a deployment, so that the lines following a failure do
+		// not.
+		if !strings.Contains(lower, "creating container") {
+			return
+		}
+		d = &deployment{App: status.application, Trigger: "staging log", Started: t}
+		status.deployment = d
+	}
+	if !d.Staged.IsZero() {
+		return
+	}
+	switch {
+	case strings.Contains(lower, "staging failed"), strings.Contains(lower, "failed to compile droplet"):
+		d.failed = t
+	case uploadedDroplet.MatchString(text):
+		d.Staged = t
+		d.DropletBytes = parseDropletSize(uploadedDroplet.FindStringSubmatch(text))
+	}
+}
+
+// deploymentProgress advances the deployment of the application based on
+// its summary, finishing it once its instances are running again after
+// staging, or once it times out.
+func (m *AppMonitor) deploymentProgress(ctx context.Context, guid string, summary appSummary) {
+	now := time.Now()
+	var finished *deployment
+	m.mu.Lock()
+	status, ok := m.monitored[guid]
+	if !ok || status.deployment == nil {
+		m.mu.Unlock()
+		return
+	}
+	d := status.deployment
+	if summary.RunningInstances < summary.Instances {
+		d.down = true
+	}
+	switch {
+	case !d.failed.IsZero():
+		finished = d.finish("failed", d.failed)
+	case !d.Staged.IsZero() && d.down && summary.Instances > 0 && summary.RunningInstances == summary.Instances:
+		finished = d.finish("succeeded", now)
+	case now.Sub(d.Started) > deploymentTimeout && !d.Staged.IsZero():
+		finished = d.finish("staged", now)
+	case now.Sub(d.Started) > deploymentTimeout:
+		finished = d.finish("timed_out", now)
+	}
+	if finished != nil {
+		status.deployment = nil
+		status.deployed = finished.Finished
+	}
+	m.mu.Unlock()
+
+	if finished != nil {
+		m.emitDeployment(ctx, finished)
+	}
+}
+
+// emitDeployment emits a finished deployment, along with the buildpack and
+// the stack of the application.
+func (m *AppMonitor) emitDeployment(ctx context.Context, d *deployment) {
+	var app struct {
+		Entity struct {
+			Buildpack         string `json:"buildpack"`
+			DetectedBuildpack string `json:"detected_buildpack"`
+			StackGUID         string `json:"stack_guid"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/apps/"+d.App.GUID, nil, &app); err != nil {
+		m.Logger.Warn("error fetching app", d.App.logArgs("error", err)...)
+	} else {
+		d.Buildpack = app.Entity.Buildpack
+		if d.Buildpack == "" {
+			d.Buildpack = app.Entity.DetectedBuildpack
+		}
+		d.Stack = m.stackName(ctx, app.Entity.StackGUID)
+	}
+	m.Logger.Info("deployment finished", d.App.logArgs("outcome", d.Outcome, "duration", d.Finished.Sub(d.Started))...)
+	d.EmitTo(m.emitter)
+}
+
+// stackName returns the name of the stack with the given GUID, or an empty
+// string, if it is not known. Names are cached, as stacks rarely change.
+func (m *AppMonitor) stackName(ctx context.Context, guid string) string {
+	if guid == "" {
+		return ""
+	}
+	m.mu.Lock()
+	name, ok := m.stacks[guid]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+	var stack struct {
+		Entity struct {
+			Name string `json:"name"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/stacks/"+guid, nil, &stack); err != nil {
+		m.Logger.Warn("error fetching stack", "stack_guid", guid, "error", err)
+		return ""
+	}
+	m.mu.Lock()
+	m.stacks[guid] = stack.Entity.Name
+	m.mu.Unlock()
+	return stack.Entity.Name
+}
+
+// parseDropletSize returns the droplet size in bytes from a match of
+// uploadedDroplet.
+func parseDropletSize(match []string) uint64 {
+	if len(match) != 3 {
+		return 0
+	}
+	size, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0
+	}
+	switch match[2] {
+	case "K":
+		size *= 1 << 10
+	case "M":
+		size *= 1 << 20
+	case "G":
+		size *= 1 << 30
+	}
+	return uint64(size)
+}
@@ -0,0 +1,205 @@
+package mozzle
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestParseDropletSize(t *testing.T) {
+	tests := []struct {
+		line string
+		want uint64
+	}{
+		{"Uploaded droplet (512)", 512},
+		{"Uploaded droplet (1.5K)", 1536},
+		{"Uploaded droplet (2.5M)", 2621440},
+		{"Uploaded droplet (1G)", 1 << 30},
+		{"Uploading droplet...", 0},
+	}
+	for _, tt := range tests {
+		if got := parseDropletSize(uploadedDroplet.FindStringSubmatch(tt.line)); got != tt.want {
+			t.Errorf("parseDropletSize(%q) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDeploymentEmitTo(t *testing.T) {
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := deployment{
+		App:          testApp("a", "app-a"),
+		Trigger:      "audit.app.restage",
+		Started:      started,
+		Outcome:      "timed_out",
+		Buildpack:    "go_buildpack",
+		Stack:        "cflinuxfs3",
+		DropletBytes: 3 << 20,
+	}
+	d.finish(d.Outcome, started.Add(90*time.Second))
+	var c collector
+	d.EmitTo(&c)
+
+	duration := c.service("app deployment duration_ms")
+	if len(duration) != 1 || duration[0].Metric != int64(90000) || duration[0].State != "critical" {
+		t.Errorf("app deployment duration_ms = %+v, want 90000 critical", duration)
+	}
+	event := c.service("app deployment")
+	if len(event) != 1 {
+		t.Fatalf("emitted %d deployment events, want 1", len(event))
+	}
+	if want := "Deployment of app-a timed out after 1m30s (go_buildpack, cflinuxfs3, droplet 3.0M)"; event[0].Description != want {
+		t.Errorf("description = %q, want %q", event[0].Description, want)
+	}
+	if want := []string{"deployment", "timed_out"}; !reflect.DeepEqual(event[0].Tags, want) {
+		t.Errorf("tags = %v, want %v", event[0].Tags, want)
+	}
+	if a := event[0].Attributes; a["droplet_bytes"] != "3145728" || a["started_at"] != "2020-01-01T00:00:00Z" || a["finished_at"] != "2020-01-01T00:01:30Z" {
+		t.Errorf("attributes = %v", a)
+	}
+}
+
+// deploymentStep is a log line, an audit event or, if both are empty, an
+// application summary with the given number of running instances out of
+// two, received at the given offset.
+type deploymentStep struct {
+	at      time.Duration
+	log     string
+	event   string
+	running int
+}
+
+func TestDeploymentCorrelation(t *testing.T) {
+	tests := []struct {
+		name  string
+		start time.Duration // ago
+		steps []deploymentStep
+		want  []string // outcome, trigger and droplet size
+	}{
+		{
+			name:  "push",
+			start: 10 * time.Minute,
+			steps: []deploymentStep{
+				{at: 0, log: "Creating container"},
+				{at: time.Minute, log: "Uploaded droplet (2M)"},
+				{at: -5 * time.Second, event: "audit.app.package.upload"},
+				{at: time.Minute, event: "audit.app.droplet.create"},
+				{at: 2 * time.Minute, running: 2},
+				{at: 2 * time.Minute, running: 1},
+				{at: 3 * time.Minute, running: 2},
+			},
+			want: []string{"succeeded audit.app.package.upload 2097152"},
+		},
+		{
+			name:  "restage",
+			start: 10 * time.Minute,
+			steps: []deploymentStep{
+				{at: 0, event: "audit.app.restage"},
+				{at: time.Minute, event: "audit.app.droplet.create"},
+				{at: time.Minute + time.Second, event: "audit.app.restart"},
+				// Events of a finished deployment are ignored.
+				{at: 30 * time.Second, event: "audit.app.droplet.create"},
+				{at: 2 * time.Minute, running: 2},
+			},
+			want: []string{"succeeded audit.app.restage "},
+		},
+		{
+			name:  "staging failed",
+			start: 10 * time.Minute,
+			steps: []deploymentStep{
+				{at: 0, log: "Creating container"},
+				{at: time.Minute, log: "Failed to compile droplet: exit status 1"},
+				{at: 2 * time.Minute, running: 2},
+				// The lines following a failure do not start another
+				// deployment.
+				{at: 2 * time.Minute, log: "Exit status 223"},
+				{at: 3 * time.Minute, running: 2},
+			},
+			want: []string{"failed staging log "},
+		},
+		{
+			name:  "superseded",
+			start: 10 * time.Minute,
+			steps: []deploymentStep{
+				{at: 0, event: "audit.app.restage"},
+				{at: time.Minute, event: "audit.app.droplet.create"},
+				{at: 2 * time.Minute, event: "audit.app.restage"},
+				{at: 3 * time.Minute, event: "audit.app.droplet.create"},
+				{at: 3*time.Minute + time.Second, event: "audit.app.start"},
+			},
+			want: []string{"superseded audit.app.restage ", "succeeded audit.app.restage "},
+		},
+		{
+			name:  "not restarted",
+			start: time.Hour,
+			steps: []deploymentStep{
+				{at: 0, event: "audit.app.droplet.create"},
+				{at: time.Minute, running: 2},
+			},
+			want: []string{"staged audit.app.droplet.create "},
+		},
+		{
+			name:  "staging timed out",
+			start: time.Hour,
+			steps: []deploymentStep{
+				{at: 0, log: "Creating container"},
+				{at: time.Minute, running: 2},
+			},
+			want: []string{"timed_out staging log "},
+		},
+		{
+			name:  "restart without staging",
+			start: 10 * time.Minute,
+			steps: []deploymentStep{
+				{at: 0, event: "audit.app.restart"},
+				{at: time.Minute, running: 1},
+				{at: 2 * time.Minute, running: 2},
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := new(fakeCC)
+			cc.set("/v2/apps/a", `{"entity":{"detected_buildpack":"go_buildpack","stack_guid":"s"}}`)
+			cc.set("/v2/stacks/s", `{"entity":{"name":"cflinuxfs3"}}`)
+			m, c := newTestMonitor(Target{}, cc)
+			app := testApp("a", "app-a")
+			m.monitored[app.GUID] = &appStatus{application: app}
+			ctx := context.Background()
+
+			start := time.Now().Add(-tt.start)
+			for _, s := range tt.steps {
+				at := start.Add(s.at)
+				switch {
+				case s.log != "":
+					m.stagingLog(app.GUID, &events.LogMessage{
+						Message:     []byte(s.log),
+						MessageType: events.LogMessage_OUT.Enum(),
+						Timestamp:   int64Ptr(at.UnixNano()),
+						SourceType:  stringPtr("STG"),
+					})
+				case s.event != "":
+					e := event(s.event, at)
+					e.Entity.Type = s.event
+					m.deploymentEvent(ctx, app.GUID, e)
+				default:
+					m.deploymentProgress(ctx, app.GUID, appSummary{Instances: 2, RunningInstances: s.running})
+				}
+			}
+
+			var got []string
+			for _, d := range c.service("app deployment") {
+				got = append(got, d.Attributes["outcome"]+" "+d.Attributes["trigger"]+" "+d.Attributes["droplet_bytes"])
+				if d.Attributes["buildpack"] != "go_buildpack" || d.Attributes["stack"] != "cflinuxfs3" {
+					t.Errorf("buildpack and stack = %q, %q", d.Attributes["buildpack"], d.Attributes["stack"])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deployments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -11,22 +11,82 @@
 //			disk used_bytes
 //			disk total_bytes
 //			disk used_ratio
+// Regarding anomalies, when AnomalyDetection is enabled - the z-scores of
+// the mean HTTP response time and the 5xx ratio since the last refresh,
+// compared to their exponentially weighted baselines.
+//			http response time_ms zscore
+//			http response server_error_ratio zscore
+// Regarding the SLOs in the application's settings - the ratio of good HTTP
+// requests over the SLO's period, the ratio of its error budget that remains,
+// and the rates at which the budget is spent over 1h, 6h and 3d windows.
+//			slo compliance_ratio
+//			slo error_budget_remaining_ratio
+//			slo burn_rate
+// Regarding the projected time until each application instance exhausts its
+// memory or disk quota, when trends are enabled, estimated from the growth of its usage over a sliding
+// window, which is reset when the instance restarts. It is -1 while the usage
+// is not growing.
+//			memory exhaustion_eta_seconds
+//			disk exhaustion_eta_seconds
 // Regarding CPU consumption.
 //			cpu_percent
 // Regarding each HTTP event (request-response).
 //			http response time_ms
 //			http response content_length_bytes
+// Regarding the HTTP events since the last refresh, instead of the above,
+// when aggregation is selected by the application's settings.
+//			http requests_count
+//			http response server_errors_count
+//			http response mean_time_ms
+//			http response max_time_ms
+//			http response content_length_bytes_total
+// Regarding the Apdex score of the HTTP events since the last refresh, per
+// peer type, and route, if selected, when the application's settings set the
+// Apdex threshold.
+//			http apdex
 // Regarding application availability.
 //			instance running_count
 //			instance configured_count
 // Regarding application events.
 //			app event
+// Regarding space events that do not concern an application, when polling
+// events per space.
+//			space event
+// Regarding service instances in the space, which are critical when their
+// last operation failed and warn while it is in progress.
+//			service instance bound_apps_count
+//			service instance last_operation_failed
+// Regarding routes.
+//			app routes_count
+//			route mapping event
+//			space orphan_routes_count
+// Regarding deployments, correlating staging, droplet creation and restart.
+//			app deployment duration_ms
+//			app deployment
+// Regarding the utilisation of the space and org quotas, as ratios of the used
+// to the allowed resources, which are in warn or critical state above the
+// configured thresholds. Unlimited resources are not emitted.
+//			space quota memory_ratio
+//			space quota app_instances_ratio
+//			space quota service_instances_ratio
+//			space quota routes_ratio
+//			org quota memory_ratio
+//			org quota app_instances_ratio
+//			org quota service_instances_ratio
+//			org quota routes_ratio
 //
 // Each of the events has attributes specifying the application's
 // org, space, name, id, and the insntace index (when appropriate).
+// When AppMonitor.Enrich is set, the application metrics also have the
+// selected attributes from EnrichmentAttributes - its buildpack, stack,
+// memory and disk limits, number of instances, health check type, state and
+// the time when its package was last updated - which are refreshed on every
+// summary poll. Note that package_updated_at changes on every deployment,
+// starting new series in backends that index attributes.
 //
 // Additionally, the HTTP events have attributes specifying the method,
-// request_id, content length the returned status code and the peer type.
+// request_id, content length the returned status code, the requested host
+// and the peer type.
 // There are two peer types - client and server. Client means that measurements
 // are recorded via the Cloud Foundry router's HTTP client that requested the
 // application container and server means that the measurements are recorded
@@ -34,4 +94,67 @@
 //
 // The application event metrics have attributes that describe the event's
 // actor and actee, as well as their ids.
+//
+// The service instance metrics have attributes specifying the instance's
+// name, id, plan, service, broker and last operation. The metrics of each
+// application have a services attribute, listing the names of the service
+// instances bound to it, and, if enriched with them, a routes attribute,
+// listing its routes. Route mapping events are emitted when a route is
+// mapped to or unmapped from an application, with the event attribute set to
+// route.mapped or route.unmapped, respectively. The orphan routes metric counts the routes in
+// the space that are not mapped to any application, listed in its routes
+// attribute. The quota metrics have attributes specifying the quota's name
+// and the used and allowed resources.
+//
+// The deployment metrics have attributes specifying the deployment's outcome,
+// trigger, start and finish time, buildpack, stack and droplet size. The
+// app deployment event also has a description and tags, so that it can be
+// shown as an annotation.
+//
+// The SLO metrics have attributes specifying the SLO's name, objective,
+// period and latency, and the burn rate also the window it is computed over.
+// The request counts are persisted using the SLOStore, so that they survive
+// restarts and applications moving between instances sharing the store.
+//
+// The Apdex score has attributes specifying its threshold, rating and the
+// numbers of all, satisfied and tolerating requests, and per route also the
+// host and the matched route. Server errors are counted as frustrated.
+//
+// How each application is monitored is controlled by its AppSettings,
+// which can be overridden by the application's labels, annotations or
+// environment - e.g. mozzle.io/enabled=false stops monitoring it and
+// mozzle.io/memory-warn=0.7 puts its memory metrics in warn state above 70%
+// usage.
+//
+// When Stats are provided, metrics about mozzle itself are emitted for the
+// application "mozzle", with the mozzle_instance attribute set to the
+// instance ID.
+//			mozzle monitored_apps_count
+//			mozzle firehose envelopes_count
+//			mozzle firehose reconnects_count
+//			mozzle firehose errors_count
+//			mozzle cc requests_count
+//			mozzle cc request_failures_count
+//			mozzle cc request latency_ms
+//			mozzle cc throttled_count
+//			mozzle cc delayed_count
+//			mozzle retry retries_count
+//			mozzle retry exhausted_count
+//			mozzle retry budget_exhausted_count
+//			mozzle retry budget_remaining
+//			mozzle riemann queue_depth
+//			mozzle riemann dropped_count
+//			mozzle riemann service dropped_count
+//			mozzle riemann sampled_out_count
+//			mozzle riemann errors_count
+//			mozzle riemann reconnects_count
+//			mozzle riemann send latency_ms
+// The firehose envelope metrics have a type attribute and the Cloud
+// Controller metrics have an endpoint attribute, e.g. "GET /v2/apps/:guid".
+// The throttled count reflects requests rejected by the Cloud Controller with
+// 429 Too Many Requests, while the delayed count reflects requests held back
+// by the client-side rate limit. The dropped counts include events dropped due
+// to a full queue and events that could not be sent. The service dropped
+// count has a dropped_service attribute, naming the service of the dropped
+// events.
 package mozzle
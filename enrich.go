@@ -0,0 +1,55 @@
+package mozzle
+
+import (
+	"context"
+	"strconv"
+)
+
+// EnrichmentAttributes are the names of the attributes that can be taken
+// from the application summaries and attached to all metrics of the
+// application, using AppMonitor.Enrich. The routes are taken from the space
+// summary instead.
+var EnrichmentAttributes = []string{
+	"buildpack",
+	"stack",
+	"memory_limit_mb",
+	"disk_limit_mb",
+	"instances",
+	"health_check_type",
+	"state",
+	"package_updated_at",
+	"routes",
+}
+
+// enrich attaches the attributes selected by Enrich, taken from the
+// application's summary, to all of its metrics.
+func (m *AppMonitor) enrich(ctx context.Context, app application, s appSummary) {
+	for _, attr := range m.Enrich {
+		var value string
+		switch attr {
+		case "buildpack":
+			value = s.Buildpack
+			if value == "" {
+				value = s.DetectedBuildpack
+			}
+		case "stack":
+			value = m.stackName(ctx, s.StackGUID)
+		case "memory_limit_mb":
+			value = strconv.Itoa(s.Memory)
+		case "disk_limit_mb":
+			value = strconv.Itoa(s.DiskQuota)
+		case "instances":
+			value = strconv.Itoa(s.Instances)
+		case "health_check_type":
+			value = s.HealthCheckType
+		case "state":
+			value = s.State
+		case "package_updated_at":
+			value = s.PackageUpdatedAt
+		default:
+			// The routes are attached by emitRoutes.
+			continue
+		}
+		app.meta.set(attr, value)
+	}
+}
@@ -0,0 +1,75 @@
+package mozzle
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestEnrich(t *testing.T) {
+	summary := appSummary{
+		State:             "STARTED",
+		Instances:         2,
+		Memory:            256,
+		DiskQuota:         1024,
+		HealthCheckType:   "http",
+		DetectedBuildpack: "go",
+		StackGUID:         "s",
+		PackageUpdatedAt:  "2020-01-02T03:04:05Z",
+	}
+	tests := []struct {
+		name    string
+		enrich  []string
+		summary appSummary
+		want    map[string]string
+	}{
+		{"none", nil, summary, map[string]string{}},
+		{"all", EnrichmentAttributes, summary, map[string]string{
+			"buildpack":          "go",
+			"stack":              "cflinuxfs3",
+			"memory_limit_mb":    "256",
+			"disk_limit_mb":      "1024",
+			"instances":          "2",
+			"health_check_type":  "http",
+			"state":              "STARTED",
+			"package_updated_at": "2020-01-02T03:04:05Z",
+		}},
+		{"selected", []string{"state", "instances"}, summary, map[string]string{
+			"state":     "STARTED",
+			"instances": "2",
+		}},
+		{"buildpack set by the user", []string{"buildpack"}, appSummary{Buildpack: "custom", DetectedBuildpack: "go"},
+			map[string]string{"buildpack": "custom"}},
+		{"empty values", []string{"buildpack", "stack", "health_check_type"}, appSummary{}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := new(fakeCC)
+			cc.set("/v2/stacks/s", `{"entity":{"name":"cflinuxfs3"}}`)
+			m, _ := newTestMonitor(Target{Enrich: tt.enrich}, cc)
+			app := testApp("a", "app-a")
+			app.meta = m.metadata(app.GUID)
+			// Attributes of an earlier summary are replaced or removed.
+			for _, attr := range EnrichmentAttributes {
+				app.meta.set(attr, "old")
+			}
+			app.meta.set("routes", "")
+
+			m.enrich(context.Background(), app, tt.summary)
+			m.enrich(context.Background(), app, tt.summary)
+			got := make(map[string]string)
+			app.meta.addTo(got)
+			for _, attr := range EnrichmentAttributes {
+				if !contains(tt.enrich, attr) {
+					delete(got, attr)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("attributes = %v, want %v", got, tt.want)
+			}
+			if n := cc.count("/v2/stacks/s"); n > 1 {
+				t.Errorf("stack fetched %d times, want it cached", n)
+			}
+		})
+	}
+}
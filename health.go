@@ -0,0 +1,245 @@
+package mozzle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectedEmitter is implemented by emitters that maintain a connection to
+// a remote system.
+type ConnectedEmitter interface {
+	Emitter
+	// Connected reports whether the emitter is currently connected.
+	Connected() bool
+}
+
+// AppStatus describes the monitoring state of a single application.
+type AppStatus struct {
+	GUID         string `json:"guid"`
+	Name         string `json:"name"`
+	Organization string `json:"org"`
+	Space        string `json:"space"`
+	// RunningInstances and Instances are taken from the last summary.
+	RunningInstances int `json:"running_instances"`
+	Instances        int `json:"instances"`
+	// LastSummary is the time of the last successfully fetched summary.
+	LastSummary time.Time `json:"last_summary"`
+	// LastEnvelope is the time of the last received firehose envelope.
+	LastEnvelope time.Time `json:"last_envelope"`
+}
+
+// appStatus holds the state of a monitored application. It is guarded by
+// the AppMonitor's mutex.
+type appStatus struct {
+	// lastEnvelope is the time of the last envelope in Unix nanoseconds.
+	// It is accessed atomically, so that the firehose does not take the
+	// mutex for every envelope, and kept first for its alignment.
+	lastEnvelope int64
+
+	application
+	summary     appSummary
+	lastSummary time.Time
+	// deployment is the application's deployment in progress, if any, and
+	// deployed is the time when the last one finished.
+	deployment *deployment
+	deployed   time.Time
+	// http aggregates the HTTP metrics by peer type since the last refresh,
+	// if the application's settings select aggregation.
+	http map[string]*httpAggregate
+	// trends holds the usage windows of each instance, and startsFailed
+	// whether the last poll of their uptime failed.
+	trends       map[int32]*instanceTrends
+	startsFailed bool
+	// anomaly aggregates the HTTP metrics since the last refresh, for
+	// comparing them to their baselines.
+	anomaly *httpAggregate
+	// slos holds the counters of the application's SLOs.
+	slos map[string]*sloCounter
+	// apdex holds the Apdex scores by peer type, and route, if computed per
+	// route, since the last refresh.
+	apdex map[string]*apdexScore
+
+	// cancel stops monitoring the application.
+	cancel context.CancelFunc
+}
+
+// beat records that the monitor loop is alive.
+func (m *AppMonitor) beat() {
+	m.mu.Lock()
+	m.heartbeat = time.Now()
+	m.mu.Unlock()
+}
+
+// progress records that the monitor has made progress, if its loop has
+// been started.
+func (m *AppMonitor) progress() {
+	m.mu.Lock()
+	if !m.heartbeat.IsZero() {
+		m.heartbeat = time.Now()
+	}
+	m.mu.Unlock()
+}
+
+func (m *AppMonitor) recordSummary(guid string, summary appSummary) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.monitored[guid]; ok {
+		s.summary = summary
+		s.lastSummary = time.Now()
+	}
+}
+
+// recordEnvelope records that an envelope of the application has been
+// received. A nil status is ignored.
+func (s *appStatus) recordEnvelope() {
+	if s != nil {
+		atomic.StoreInt64(&s.lastEnvelope, time.Now().UnixNano())
+	}
+}
+
+// Health returns an error if the monitor loop is not running or the monitor
+// has not made progress for more than two refresh intervals, plus the time a
+// single retried call may take. Progress is recorded at the start of each
+// iteration of the loop and after each Cloud Controller call, as an
+// iteration may make any number of them.
+func (m *AppMonitor) Health() error {
+	m.init()
+	m.mu.Lock()
+	heartbeat := m.heartbeat
+	m.mu.Unlock()
+	if heartbeat.IsZero() {
+		return errors.New("monitor not started")
+	}
+	// Progress may be held up by a call that is retried with backoff, so
+	// allow for it.
+	if stale := time.Since(heartbeat); stale > 2*m.RefreshInterval+m.retrier.maxDuration(m.RPCTimeout) {
+		return fmt.Errorf("monitor loop stuck for %v", stale)
+	}
+	return nil
+}
+
+// Ready checks whether the Cloud Controller is reachable, the UAA provides a
+// valid token and, if the Emitter is a ConnectedEmitter, whether it is
+// connected. It returns the result of each check, keyed by the check name.
+// A nil error denotes a successful check.
+func (m *AppMonitor) Ready(ctx context.Context) map[string]error {
+	m.init()
+	checks := make(map[string]error)
+
+	infoCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
+	defer cancel()
+	_, err := m.CloudController.Info(infoCtx)
+	checks["cloud_controller"] = err
+
+	token, err := m.UAA.Token()
+	if err == nil && !token.Valid() {
+		err = errors.New("invalid token")
+	}
+	checks["token"] = err
+
+	if ce, ok := m.Emitter.(ConnectedEmitter); ok {
+		checks["emitter"] = nil
+		if !ce.Connected() {
+			checks["emitter"] = errors.New("not connected")
+		}
+	}
+	return checks
+}
+
+// Status returns the status of all currently monitored applications,
+// sorted by organization, space and name.
+func (m *AppMonitor) Status() []AppStatus {
+	m.mu.Lock()
+	res := make([]AppStatus, 0, len(m.monitored))
+	for _, s := range m.monitored {
+		var lastEnvelope time.Time
+		if n := atomic.LoadInt64(&s.lastEnvelope); n > 0 {
+			lastEnvelope = time.Unix(0, n)
+		}
+		res = append(res, AppStatus{
+			GUID:             s.GUID,
+			Name:             s.Entity.Name,
+			Organization:     s.Org,
+			Space:            s.Space,
+			RunningInstances: s.summary.RunningInstances,
+			Instances:        s.summary.Instances,
+			LastSummary:      s.lastSummary,
+			LastEnvelope:     lastEnvelope,
+		})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Organization != res[j].Organization {
+			return res[i].Organization < res[j].Organization
+		}
+		if res[i].Space != res[j].Space {
+			return res[i].Space < res[j].Space
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// AdminHandler returns a handler that serves the following endpoints.
+//
+//	/healthz  fails with 503 if the monitor loop is stuck
+//	/readyz   fails with 503 if any of the readiness checks fails and
+//	          lists the monitored applications
+//	/stats    serves the collected Stats, if s is not nil
+func AdminHandler(m *AppMonitor, s *Stats) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		var resp struct {
+			Healthy bool   `json:"healthy"`
+			Error   string `json:"error,omitempty"`
+		}
+		status := http.StatusOK
+		if err := m.Health(); err != nil {
+			resp.Error = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+		resp.Healthy = status == http.StatusOK
+		writeJSON(w, status, resp)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var resp struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]string `json:"checks"`
+			Apps   []AppStatus       `json:"apps"`
+		}
+		resp.Ready = true
+		resp.Checks = make(map[string]string)
+		for name, err := range m.Ready(r.Context()) {
+			resp.Checks[name] = "ok"
+			if err != nil {
+				resp.Checks[name] = err.Error()
+				resp.Ready = false
+			}
+		}
+		resp.Apps = m.Status()
+		status := http.StatusOK
+		if !resp.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, resp)
+	})
+	if s != nil {
+		mux.Handle("/stats", s)
+	}
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
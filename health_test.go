@@ -0,0 +1,97 @@
+package mozzle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAppMonitorHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		monitor *AppMonitor
+		age     time.Duration // since the last heartbeat; zero if none
+		wantErr bool
+	}{
+		{"not started", &AppMonitor{}, 0, true},
+		{"defaults", &AppMonitor{}, time.Second, false},
+		{"defaults stuck", &AppMonitor{}, 2*DefaultRefreshInterval + 2*DefaultRPCTimeout, true},
+		{
+			// 2*1s refresh, 3*1s attempts and 1s+2s backoff.
+			name:    "within retries",
+			monitor: &AppMonitor{RefreshInterval: time.Second, RPCTimeout: time.Second, Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second}},
+			age:     7 * time.Second,
+			wantErr: false,
+		},
+		{
+			name:    "beyond retries",
+			monitor: &AppMonitor{RefreshInterval: time.Second, RPCTimeout: time.Second, Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second}},
+			age:     9 * time.Second,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.monitor
+			if tt.age > 0 {
+				m.heartbeat = time.Now().Add(-tt.age)
+			}
+			if err := m.Health(); (err != nil) != tt.wantErr {
+				t.Errorf("Health() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppMonitorHealthProgress(t *testing.T) {
+	m := &AppMonitor{RefreshInterval: time.Second, RPCTimeout: time.Second}
+	m.init()
+	ok := func(context.Context) error { return nil }
+	m.call(context.Background(), ok)
+	if err := m.Health(); err == nil {
+		t.Error("Health() after a call without starting = nil, want error")
+	}
+
+	// A long iteration making many calls is not stuck.
+	m.heartbeat = time.Now().Add(-time.Minute)
+	if err := m.Health(); err == nil {
+		t.Error("Health() without progress = nil, want error")
+	}
+	m.call(context.Background(), ok)
+	if err := m.Health(); err != nil {
+		t.Errorf("Health() after a call = %v, want nil", err)
+	}
+}
+
+func TestAppMonitorStatus(t *testing.T) {
+	m := &AppMonitor{}
+	m.init()
+	for _, a := range []application{
+		testApp("b", "app-b"),
+		testApp("a", "app-a"),
+	} {
+		m.monitored[a.GUID] = &appStatus{application: a}
+	}
+	m.monitored["a"].recordEnvelope()
+	var none *appStatus
+	none.recordEnvelope()
+
+	status := m.Status()
+	if len(status) != 2 || status[0].GUID != "a" || status[1].GUID != "b" {
+		t.Fatalf("Status() = %+v, want a and b", status)
+	}
+	if status[0].LastEnvelope.IsZero() || !status[1].LastEnvelope.IsZero() {
+		t.Errorf("LastEnvelope = %v and %v, want only the first set", status[0].LastEnvelope, status[1].LastEnvelope)
+	}
+}
+
+// testApp returns an application with the specified GUID and name, in org
+// "org" and space "space".
+func testApp(guid, name string) application {
+	var a application
+	a.GUID = guid
+	a.Entity.Name = name
+	a.Org = "org"
+	a.Space = "space"
+	return a
+}
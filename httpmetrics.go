@@ -2,6 +2,8 @@ package mozzle
 
 import (
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	cfevent "github.com/cloudfoundry/sonde-go/events"
 )
@@ -17,16 +19,12 @@ func (r httpMetrics) EmitTo(e Emitter) {
 	attributes["method"] = r.GetMethod().String()
 	attributes["request_id"] = r.GetRequestId().String()
 	attributes["status_code"] = strconv.Itoa(int(r.GetStatusCode()))
-
-	switch r.GetPeerType() {
-	case cfevent.PeerType_Client:
-		attributes["peer"] = "client"
-	case cfevent.PeerType_Server:
-		attributes["peer"] = "server"
-	default:
-		attributes["peer"] = "unknown"
+	if host := requestHost(r.GetUri()); host != "" {
+		attributes["host"] = host
 	}
 
+	attributes["peer"] = peerType(r.GetPeerType())
+
 	durationMillis := (r.GetStopTimestamp() - r.GetStartTimestamp()) / 1000000
 	e.Emit(forApp(r.App, Metric{
 		Service:    "http response time_ms",
@@ -40,5 +38,130 @@ func (r httpMetrics) EmitTo(e Emitter) {
 		State:      "ok",
 		Attributes: attributes,
 	}))
+}
+
+// peerType returns the name of the peer type of an HTTP event.
+func peerType(t cfevent.PeerType) string {
+	switch t {
+	case cfevent.PeerType_Client:
+		return "client"
+	case cfevent.PeerType_Server:
+		return "server"
+	}
+	return "unknown"
+}
+
+// httpAggregate describes the HTTP events of an application with the same
+// peer type, received since the last refresh.
+type httpAggregate struct {
+	Requests      int
+	ServerErrors  int
+	TotalMillis   int64
+	MaxMillis     int64
+	ContentLength int64
+	Peer          string
+	App           application
+}
 
+func (a *httpAggregate) add(r *cfevent.HttpStartStop) {
+	millis := (r.GetStopTimestamp() - r.GetStartTimestamp()) / 1000000
+	a.Requests++
+	if r.GetStatusCode() >= 500 {
+		a.ServerErrors++
+	}
+	a.TotalMillis += millis
+	if millis > a.MaxMillis {
+		a.MaxMillis = millis
+	}
+	a.ContentLength += r.GetContentLength()
+}
+
+func (a httpAggregate) EmitTo(e Emitter) {
+	attributes := attributes(a.App)
+	attributes["peer"] = a.Peer
+
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http requests_count",
+		Metric:     a.Requests,
+		State:      "ok",
+		Attributes: attributes,
+	}))
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http response server_errors_count",
+		Metric:     a.ServerErrors,
+		State:      "ok",
+		Attributes: attributes,
+	}))
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http response mean_time_ms",
+		Metric:     ratio(uint64(a.TotalMillis), uint64(a.Requests)),
+		State:      "ok",
+		Attributes: attributes,
+	}))
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http response max_time_ms",
+		Metric:     int(a.MaxMillis),
+		State:      "ok",
+		Attributes: attributes,
+	}))
+	e.Emit(forApp(a.App, Metric{
+		Service:    "http response content_length_bytes_total",
+		Metric:     int(a.ContentLength),
+		State:      "ok",
+		Attributes: attributes,
+	}))
+}
+
+// observeHTTP adds the HTTP event to the aggregates, the anomaly values,
+// the SLO counters and the Apdex scores of the application, as enabled, in a
+// single locked section, and reports whether its settings select
+// aggregation. The mutex is not taken at all while none of them is enabled.
+func (m *AppMonitor) observeHTTP(guid string, r *cfevent.HttpStartStop) bool {
+	if m.Anomaly == nil && atomic.LoadInt32(&m.httpObserved) == 0 {
+		return false
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.monitored[guid]
+	if !ok {
+		return false
+	}
+	settings := m.settingsLocked(guid)
+	m.observeAnomalyLocked(status, r)
+	m.observeSLOsLocked(status, settings.SLOs, r, now)
+	observeApdexLocked(status, settings, m.routes[guid], r)
+	if settings.HTTPAggregate {
+		aggregateHTTPLocked(status, r)
+	}
+	return settings.HTTPAggregate
+}
+
+// aggregateHTTPLocked adds the HTTP event to the aggregates of the
+// application. It expects the monitor's mutex to be held.
+func aggregateHTTPLocked(status *appStatus, r *cfevent.HttpStartStop) {
+	peer := peerType(r.GetPeerType())
+	if status.http == nil {
+		status.http = make(map[string]*httpAggregate)
+	}
+	a, ok := status.http[peer]
+	if !ok {
+		a = &httpAggregate{Peer: peer, App: status.application}
+		status.http[peer] = a
+	}
+	a.add(r)
+}
+
+// emitHTTPAggregate emits and resets the HTTP aggregates of the application.
+func (m *AppMonitor) emitHTTPAggregate(guid string) {
+	m.mu.Lock()
+	var aggregates map[string]*httpAggregate
+	if status, ok := m.monitored[guid]; ok {
+		aggregates = status.http
+		status.http = nil
+	}
+	m.mu.Unlock()
+	for _, a := range aggregates {
+		a.EmitTo(m.emitter)
+	}
 }
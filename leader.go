@@ -0,0 +1,334 @@
+package mozzle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leader reports whether this instance is the one that should emit metrics.
+type Leader interface {
+	IsLeader() bool
+}
+
+// Lease is a time-limited lock held by a single holder.
+type Lease interface {
+	// Acquire acquires the lease for holder or renews it, if holder already
+	// holds it. The lease expires after ttl unless renewed.
+	// It reports whether holder holds the lease.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release releases the lease, if it is held by holder.
+	Release(ctx context.Context, holder string) error
+}
+
+// Leadership implements Leader by periodically acquiring a Lease.
+type Leadership struct {
+	// ID identifies this instance.
+	ID string
+	// Lease is the lease that the leader holds.
+	Lease Lease
+	// TTL is the lease duration. The lease is renewed three times per TTL,
+	// so a standby takes over at most 4/3 TTL after the leader disappears.
+	TTL time.Duration
+	// Logger, if not nil, is used for logging leadership changes and errors
+	// when acquiring the lease.
+	Logger Logger
+
+	leader int32 // accessed atomically
+}
+
+// IsLeader implements Leader.
+func (l *Leadership) IsLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+// Run campaigns for leadership until ctx is canceled. It then releases the
+// lease, if held.
+func (l *Leadership) Run(ctx context.Context) error {
+	if l.TTL <= 0 {
+		return errors.New("lease TTL must be positive")
+	}
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		l.campaign(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			wasLeader := l.IsLeader()
+			atomic.StoreInt32(&l.leader, 0)
+			if !wasLeader {
+				return ctx.Err()
+			}
+			releaseCtx, cancel := context.WithTimeout(context.Background(), l.TTL/3)
+			defer cancel()
+			return l.Lease.Release(releaseCtx, l.ID)
+		}
+	}
+}
+
+func (l *Leadership) campaign(ctx context.Context) {
+	acquireCtx, cancel := context.WithTimeout(ctx, l.TTL/3)
+	defer cancel()
+	ok, err := l.Lease.Acquire(acquireCtx, l.ID, l.TTL)
+	if err != nil {
+		// The lease may still be held by us, but we cannot tell, so step
+		// down to avoid emitting twice.
+		ok = false
+		if l.Logger != nil {
+			l.Logger.Error("error acquiring lease", "holder", l.ID, "error", err)
+		}
+	}
+	var v int32
+	if ok {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&l.leader, v); old != v && l.Logger != nil {
+		l.Logger.Info("leadership changed", "holder", l.ID, "leader", ok)
+	}
+}
+
+// leaderEmitter emits metrics only while this instance is the leader.
+type leaderEmitter struct {
+	Emitter
+	leader Leader
+}
+
+func (e *leaderEmitter) Emit(m Metric) {
+	if e.leader.IsLeader() {
+		e.Emitter.Emit(m)
+	}
+}
+
+// leaseRecord describes the current holder of a lease.
+type leaseRecord struct {
+	Holder string    `json:"holder"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// acquire returns the record resulting from holder trying to acquire the
+// lease described by r, and whether holder holds it.
+func (r leaseRecord) acquire(holder string, ttl time.Duration, now time.Time) (leaseRecord, bool) {
+	if r.Holder != "" && r.Holder != holder && now.Before(r.Expiry) {
+		return r, false
+	}
+	return leaseRecord{Holder: holder, Expiry: now.Add(ttl)}, true
+}
+
+// FileLease implements Lease using a file, e.g. on a local or network file
+// system shared between the instances. A separate lock file guards
+// concurrent updates of the lease file.
+type FileLease struct {
+	// Path is the path of the lease file.
+	Path string
+}
+
+// staleLockAge is the age after which a lock file is considered abandoned.
+const staleLockAge = 10 * time.Second
+
+// Acquire implements Lease.
+func (f *FileLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	var held bool
+	err := f.update(func(r leaseRecord) (leaseRecord, error) {
+		r, held = r.acquire(holder, ttl, time.Now())
+		return r, nil
+	})
+	return held, err
+}
+
+// Release implements Lease.
+func (f *FileLease) Release(ctx context.Context, holder string) error {
+	return f.update(func(r leaseRecord) (leaseRecord, error) {
+		if r.Holder != holder {
+			return r, nil
+		}
+		return leaseRecord{}, nil
+	})
+}
+
+func (f *FileLease) update(fn func(leaseRecord) (leaseRecord, error)) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var r leaseRecord
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("error decoding lease file %q: %v", f.Path, err)
+		}
+	}
+	r, err = fn(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, r)
+}
+
+// lock creates the lock file exclusively. Lock files older than
+// staleLockAge are removed, in case their owner died while holding them.
+func (f *FileLease) lock() (unlock func(), err error) {
+	path := f.Path + ".lock"
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		if fi, serr := os.Stat(path); serr == nil && time.Since(fi.ModTime()) > staleLockAge {
+			removeStaleLock(path, fi)
+			fd, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking lease file: %v", err)
+	}
+	fd.Close()
+	return func() { os.Remove(path) }, nil
+}
+
+// removeStaleLock removes the lock file at path, if it is still the stale
+// file described by stale. Another instance may have replaced the stale lock
+// with its own since it was checked, so the file is first renamed to a
+// unique name, and put back unless it is the stale one.
+func removeStaleLock(path string, stale os.FileInfo) {
+	tmp := fmt.Sprintf("%s.stale.%d.%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, tmp); err != nil {
+		return
+	}
+	// File systems may reuse the inode of a removed file, so compare the
+	// modification times as well.
+	if fi, err := os.Stat(tmp); err != nil || !os.SameFile(fi, stale) || !fi.ModTime().Equal(stale.ModTime()) {
+		// Linking, unlike renaming, fails if yet another lock has been
+		// created in the meantime.
+		os.Link(tmp, path)
+	}
+	os.Remove(tmp)
+}
+
+// HTTPLease implements Lease using an HTTP service with etcd-like lease
+// semantics, such as the one implemented by LeaseServer.
+//
+// Acquire sends a PUT request to URL with a JSON body containing the holder
+// and the TTL in seconds. The service should respond with 200 OK if the
+// holder holds the lease and 409 Conflict if someone else holds it.
+// Release sends a DELETE request to URL with the holder query parameter.
+type HTTPLease struct {
+	// URL is the address of the lease.
+	URL string
+	// Client is the HTTP client used for the requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+type leaseRequest struct {
+	Holder     string  `json:"holder"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+}
+
+// Acquire implements Lease.
+func (h *HTTPLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	body, err := json.Marshal(leaseRequest{Holder: holder, TTLSeconds: ttl.Seconds()})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPut, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected lease response: %s", resp.Status)
+	}
+}
+
+// Release implements Lease.
+func (h *HTTPLease) Release(ctx context.Context, holder string) error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("holder", holder)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected lease response: %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *HTTPLease) client() *http.Client {
+	if h.Client != nil {
+		return h.Client
+	}
+	return http.DefaultClient
+}
+
+// LeaseServer implements the HTTP lease protocol used by HTTPLease, keeping
+// the leases in memory. Each request path denotes a separate lease.
+// It is meant as a stand-in for a real coordination service, e.g. in tests.
+type LeaseServer struct {
+	mu     sync.Mutex
+	leases map[string]leaseRecord
+}
+
+// ServeHTTP implements http.Handler.
+func (s *LeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases == nil {
+		s.leases = make(map[string]leaseRecord)
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req leaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Holder == "" {
+			http.Error(w, "invalid lease request", http.StatusBadRequest)
+			return
+		}
+		ttl := time.Duration(req.TTLSeconds * float64(time.Second))
+		record, ok := s.leases[r.URL.Path].acquire(req.Holder, ttl, time.Now())
+		s.leases[r.URL.Path] = record
+		status := http.StatusOK
+		if !ok {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, record)
+	case http.MethodDelete:
+		if s.leases[r.URL.Path].Holder == r.URL.Query().Get("holder") {
+			delete(s.leases, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,226 @@
+package mozzle
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaseRecordAcquire(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		record leaseRecord
+		holder string
+		want   bool
+	}{
+		{"free", leaseRecord{}, "a", true},
+		{"renew", leaseRecord{Holder: "a", Expiry: now.Add(time.Second)}, "a", true},
+		{"renew expired", leaseRecord{Holder: "a", Expiry: now.Add(-time.Second)}, "a", true},
+		{"held by another", leaseRecord{Holder: "b", Expiry: now.Add(time.Second)}, "a", false},
+		{"expired", leaseRecord{Holder: "b", Expiry: now.Add(-time.Second)}, "a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := tt.record.acquire(tt.holder, time.Minute, now)
+			if ok != tt.want {
+				t.Fatalf("acquire() = %v, want %v", ok, tt.want)
+			}
+			want := tt.record
+			if ok {
+				want = leaseRecord{Holder: tt.holder, Expiry: now.Add(time.Minute)}
+			}
+			if r != want {
+				t.Errorf("record = %+v, want %+v", r, want)
+			}
+		})
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mozzle-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestLease(t *testing.T) {
+	tests := []struct {
+		name  string
+		lease func(t *testing.T) Lease
+	}{
+		{"file", func(t *testing.T) Lease {
+			return &FileLease{Path: filepath.Join(tempDir(t), "lease")}
+		}},
+		{"http", func(t *testing.T) Lease {
+			srv := httptest.NewServer(new(LeaseServer))
+			t.Cleanup(srv.Close)
+			return &HTTPLease{URL: srv.URL + "/mozzle"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease := tt.lease(t)
+			ctx := context.Background()
+			ttl := 100 * time.Millisecond
+			steps := []struct {
+				name    string
+				holder  string
+				release bool
+				sleep   time.Duration
+				want    bool
+			}{
+				{name: "acquire", holder: "a", want: true},
+				{name: "renew", holder: "a", want: true},
+				{name: "held", holder: "b", want: false},
+				{name: "release by another", holder: "b", release: true},
+				{name: "still held", holder: "b", want: false},
+				{name: "expiry", holder: "b", sleep: 2 * ttl, want: true},
+				{name: "taken over", holder: "a", want: false},
+				{name: "release", holder: "b", release: true},
+				{name: "handover", holder: "a", want: true},
+			}
+			for _, s := range steps {
+				time.Sleep(s.sleep)
+				if s.release {
+					if err := lease.Release(ctx, s.holder); err != nil {
+						t.Fatalf("%s: Release(%q) = %v", s.name, s.holder, err)
+					}
+					continue
+				}
+				ok, err := lease.Acquire(ctx, s.holder, ttl)
+				if err != nil || ok != s.want {
+					t.Fatalf("%s: Acquire(%q) = %v, %v, want %v", s.name, s.holder, ok, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLeaseLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration // of an existing lock file; none if zero
+		wantErr bool
+	}{
+		{"unlocked", 0, false},
+		{"locked", time.Second, true},
+		{"stale lock", 2 * staleLockAge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FileLease{Path: filepath.Join(tempDir(t), "lease")}
+			if tt.age > 0 {
+				if err := ioutil.WriteFile(f.Path+".lock", nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := time.Now().Add(-tt.age)
+				if err := os.Chtimes(f.Path+".lock", modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := f.Acquire(context.Background(), "a", time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Acquire() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "lease.lock")
+	write := func(modTime time.Time) os.FileInfo {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	stale := write(time.Now().Add(-2 * staleLockAge))
+	removeStaleLock(path, stale)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("stale lock not removed: %v", err)
+	}
+
+	// Another instance removes the stale lock and takes it before this one
+	// gets to it.
+	os.Remove(path)
+	fresh := write(time.Now())
+	removeStaleLock(path, stale)
+	if fi, err := os.Stat(path); err != nil || !os.SameFile(fi, fresh) {
+		t.Errorf("fresh lock removed: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left, want only the lock", len(files))
+	}
+}
+
+func TestLeadershipRun(t *testing.T) {
+	srv := httptest.NewServer(new(LeaseServer))
+	defer srv.Close()
+	ttl := 150 * time.Millisecond
+	a := &Leadership{ID: "a", Lease: &HTTPLease{URL: srv.URL}, TTL: ttl}
+	b := &Leadership{ID: "b", Lease: &HTTPLease{URL: srv.URL}, TTL: ttl}
+
+	waitFor := func(l *Leadership, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for l.IsLeader() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s IsLeader() = %v, want %v", l.ID, !want, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- a.Run(ctxA) }()
+	waitFor(a, true)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	doneB := make(chan error, 1)
+	go func() { doneB <- b.Run(ctxB) }()
+	// b stays on standby while a renews the lease.
+	time.Sleep(2 * ttl)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a leader %v, b leader %v, want only a", a.IsLeader(), b.IsLeader())
+	}
+
+	// a releases the lease when stopped, so b takes over.
+	cancelA()
+	if err := <-doneA; err != nil {
+		t.Errorf("Run() of the leader = %v, want nil after releasing", err)
+	}
+	if a.IsLeader() {
+		t.Error("a still leader after stopping")
+	}
+	waitFor(b, true)
+
+	cancelB()
+	if err := <-doneB; err != nil {
+		t.Errorf("Run() of b = %v", err)
+	}
+}
+
+func TestLeadershipRunInvalidTTL(t *testing.T) {
+	l := &Leadership{ID: "a", Lease: new(FileLease)}
+	if err := l.Run(context.Background()); err == nil {
+		t.Error("Run() without a TTL = nil, want error")
+	}
+}
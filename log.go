@@ -0,0 +1,33 @@
+package mozzle
+
+// Logger is a levelled, structured logger. Each message is accompanied by
+// alternating keys and values, describing its context - e.g.
+//
+//	logger.Error("error fetching app summary", "app_guid", guid, "error", err)
+//
+// The method set matches the one of *slog.Logger, so it can be used
+// directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger implements Logger that discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// logArgs returns the key-value pairs identifying app in log messages.
+func (app application) logArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{
+		"org", app.Org,
+		"space", app.Space,
+		"app", app.Entity.Name,
+		"app_guid", app.GUID,
+	}, args...)
+}
@@ -1,5 +1,10 @@
 package mozzle
 
+import (
+	"context"
+	"io"
+)
+
 // Metric is a metric regarding an application.
 type Metric struct {
 	// Application is the name of the application.
@@ -19,6 +24,11 @@ type Metric struct {
 	Metric interface{}
 	// State is a text description of the service's state - e.g. 'ok', 'warn'.
 	State string
+	// Description is an optional human-readable description of the event,
+	// e.g. for showing it as an annotation.
+	Description string
+	// Tags are optional labels of the event.
+	Tags []string
 	// Attributes are key-value pairs describing the metric.
 	Attributes map[string]string
 }
@@ -26,10 +36,49 @@ type Metric struct {
 // Emitter should emit application metrics.
 type Emitter interface {
 	// Emit emits the specified application metric.
-	// It should not block and should be safe for concurrent use.
+	// It should be safe for concurrent use. It is called from the loops
+	// that monitor the applications, so it should return quickly; emitters
+	// that apply backpressure, such as RiemannEmitter with the Block
+	// overflow policy, should block only for a bounded time.
 	Emit(m Metric)
 }
 
+// Flusher is implemented by emitters that buffer metrics before sending them.
+type Flusher interface {
+	// Flush sends all metrics emitted so far. It blocks until they are sent
+	// or ctx is done.
+	Flush(ctx context.Context) error
+}
+
+// Shutdowner is implemented by emitters that need to release resources once
+// they are no longer used.
+type Shutdowner interface {
+	// Shutdown sends all buffered metrics, like Flush, and releases the
+	// emitter's resources. The emitter should not be used afterwards.
+	// If ctx is done before the metrics are sent, the remaining ones are
+	// discarded and the context's error is returned.
+	Shutdown(ctx context.Context) error
+}
+
+// ShutdownEmitter shuts e down gracefully, waiting for its buffered metrics
+// to be sent until ctx is done. Emitters that implement neither Shutdowner
+// nor Flusher are closed, if they implement io.Closer.
+func ShutdownEmitter(ctx context.Context, e Emitter) error {
+	if s, ok := e.(Shutdowner); ok {
+		return s.Shutdown(ctx)
+	}
+	var err error
+	if f, ok := e.(Flusher); ok {
+		err = f.Flush(ctx)
+	}
+	if c, ok := e.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 func forApp(app application, m Metric) Metric {
 	m.Application = app.Entity.Name
 	m.ApplicationID = app.GUID
@@ -46,10 +95,12 @@ func ratio(part, whole uint64) float64 {
 }
 
 func attributes(app application) map[string]string {
-	return map[string]string{
+	attrs := map[string]string{
 		"org":            app.Org,
 		"space":          app.Space,
 		"application":    app.Entity.Name,
 		"application_id": app.GUID,
 	}
+	app.meta.addTo(attrs)
+	return attrs
 }
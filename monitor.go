@@ -3,17 +3,17 @@ package mozzle
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 
 	"github.com/Bo0mer/ccv2"
 	"github.com/cloudfoundry/noaa/consumer"
@@ -40,6 +40,20 @@ type Firehose interface {
 	Stream(appGUID string, authToken string) (outputChan <-chan *events.Envelope, errorChan <-chan error)
 }
 
+// EventPolling selects how audit events are fetched from the Cloud
+// Controller.
+type EventPolling int
+
+const (
+	// PollAppEvents fetches the events of each application separately,
+	// resulting in one request per application on every refresh.
+	PollAppEvents EventPolling = iota
+	// PollSpaceEvents fetches the events of the whole space with a single
+	// request on every refresh and dispatches them to the applications.
+	// Events that do not concern any application are emitted as space events.
+	PollSpaceEvents
+)
+
 // Target describes a monitoring target.
 type Target struct {
 	API      string
@@ -47,15 +61,68 @@ type Target struct {
 	Password string
 	// Token should be a valid OAuth2 bearer token, including a refresh token.
 	// If token is provided the username and password fields should be left emtpy.
-	Token    *oauth2.Token
-	Insecure bool
-	Org      string
-	Space    string
+	Token *oauth2.Token
+	// TokenFile is a path to a file containing the token. The file is read
+	// again whenever it changes. See Token for its expected content.
+	TokenFile string
+	// ClientID and ClientSecret identify the OAuth2 client used for
+	// obtaining tokens. ClientID defaults to "cf".
+	// If neither Username, Token nor TokenFile are provided, the client
+	// credentials grant is used.
+	ClientID     string
+	ClientSecret string
+	Insecure     bool
+	Org          string
+	Space        string
 	// RPCTimeout configures the timeouts when making RPCs.
 	RPCTimeout time.Duration
 	// RefreshInterval configures the polling interval for application
 	// state changes.
 	RefreshInterval time.Duration
+	// Stats, if not nil, collects metrics about mozzle itself.
+	Stats *Stats
+	// Cursors stores the positions up to which audit events have been
+	// emitted. Defaults to a MemoryCursorStore.
+	Cursors CursorStore
+	// EventPolling selects how audit events are fetched.
+	EventPolling EventPolling
+	// Sharder, if not nil, selects the applications monitored by this
+	// instance.
+	Sharder Sharder
+	// Leader, if not nil, reports whether this instance should emit
+	// application metrics.
+	Leader Leader
+	// RateLimit limits the requests made to the Cloud Controller.
+	RateLimit RateLimit
+	// Retry configures retrying of failed Cloud Controller and UAA calls,
+	// including the initial ones.
+	Retry RetryPolicy
+	// Logger is used for logging events and errors. Defaults to discarding
+	// all messages.
+	Logger Logger
+	// Recorder, if not nil, records the firehose envelopes and the Cloud
+	// Controller responses, so that they can be replayed later.
+	Recorder *Recorder
+	// Quota configures the states of the quota utilisation metrics.
+	Quota QuotaThresholds
+	// Enrich selects the attributes from EnrichmentAttributes that are
+	// attached to all metrics of each application.
+	Enrich []string
+	// AppDefaults are the settings of the applications that do not
+	// override them.
+	AppDefaults AppSettings
+	// Trend, if not nil, enables the projection of memory and disk
+	// exhaustion.
+	Trend *TrendConfig
+	// Anomaly, if not nil, enables the detection of anomalies in the HTTP
+	// metrics of the applications.
+	Anomaly *AnomalyDetection
+	// SLOStore persists the counts of the SLOs. Defaults to a
+	// MemorySLOStore.
+	SLOStore SLOStore
+	// SLOSaveInterval configures the interval for saving the counts of the
+	// SLOs. Defaults to DefaultSLOSaveInterval.
+	SLOSaveInterval time.Duration
 }
 
 // AppMonitor implements a Cloud Foundry application monitor that collects
@@ -69,18 +136,95 @@ type AppMonitor struct {
 	Firehose Firehose
 	// UAA should provide valid OAuth2 tokens for the specific Cloud Foundry system.
 	UAA oauth2.TokenSource
-	// ErrLog is used for logging erros that occur when monitoring applications.
-	ErrLog *log.Logger
+	// Logger is used for logging events and errors that occur when
+	// monitoring applications. Defaults to discarding all messages.
+	Logger Logger
 
 	// RPCTimeout configures the timeouts when making RPCs.
 	RPCTimeout time.Duration
 	// RefreshInterval configures the polling interval for application
 	// state changes.
 	RefreshInterval time.Duration
+	// Stats, if not nil, collects metrics about the monitor itself. They are
+	// emitted using Emitter on every RefreshInterval.
+	Stats *Stats
+	// Cursors stores the positions up to which audit events have been
+	// emitted. Use a persistent store to avoid losing or duplicating events
+	// across restarts. Defaults to a MemoryCursorStore.
+	Cursors CursorStore
+	// EventPolling selects how audit events are fetched. Defaults to
+	// PollAppEvents.
+	EventPolling EventPolling
+	// Sharder, if not nil, selects the applications monitored by this
+	// instance when multiple instances monitor the same space.
+	Sharder Sharder
+	// Retry configures retrying of failed Cloud Controller calls.
+	Retry RetryPolicy
+	// Leader, if not nil, reports whether this instance should emit
+	// application metrics. While not the leader, the monitor keeps
+	// discovering and watching applications, so that it can take over
+	// immediately, but emits only its Stats.
+	Leader Leader
+	// Quota configures the states of the org and space quota utilisation
+	// metrics.
+	Quota QuotaThresholds
+	// Enrich selects the attributes from EnrichmentAttributes that are
+	// attached to all metrics of each application, e.g. "buildpack" and
+	// "stack". They are refreshed on every summary poll.
+	Enrich []string
+	// AppDefaults are the settings of the applications that do not
+	// override them using their metadata or environment. See AppSettings.
+	AppDefaults AppSettings
+	// Trend, if not nil, enables the projection of the time until each
+	// instance exhausts its memory or disk quota.
+	Trend *TrendConfig
+	// Anomaly, if not nil, enables the detection of anomalies in the HTTP
+	// response times and 5xx ratios of the applications, compared to their
+	// rolling baselines.
+	Anomaly *AnomalyDetection
+	// SLOStore persists the counts of the applications' SLOs, so that
+	// their compliance survives restarts, and moves with the applications
+	// between instances sharing the store. Defaults to a MemorySLOStore.
+	SLOStore SLOStore
+	// SLOSaveInterval configures the interval for saving the counts of the
+	// SLOs. They are also saved when the monitor stops, and on the next
+	// refresh after applications start or stop being monitored. Defaults
+	// to DefaultSLOSaveInterval.
+	SLOSaveInterval time.Duration
 
 	initOnce  sync.Once
 	mu        sync.Mutex // guards
-	monitored map[string]struct{}
+	monitored map[string]*appStatus
+	appMeta   map[string]*appMetadata
+	brokers   map[string]string   // service GUID to broker name
+	domains   map[string]string   // domain GUID to name
+	routes    map[string][]string // app GUID to routes, as of the last poll
+	stacks    map[string]string   // stack GUID to name
+	// appSettings are the settings of the applications, fetched when
+	// they were last updated, as of settingsSynced. invalidSettings holds
+	// the reported invalid settings by app GUID.
+	appSettings     map[string]AppSettings
+	settingsSynced  map[string]time.Time
+	invalidSettings map[string]map[string]bool
+	// baselines are the anomaly detection baselines by app GUID and metric.
+	baselines map[string]Baseline
+	// sloCounts are the stored SLO counts, as of the last save, from
+	// which the SLO counters are created. sloReleased holds the
+	// applications no longer monitored whose counts in sloCounts are yet to
+	// be saved, and sloHandover whether applications started or stopped
+	// being monitored since the last save.
+	sloCounts   map[string]SLOCounts
+	sloReleased map[string]bool
+	sloHandover bool
+	// httpObserved is 1 while the settings of some application need its
+	// HTTP events to be observed. It is accessed atomically.
+	httpObserved int32
+	heartbeat    time.Time
+
+	// emitter is used for emitting application metrics. It is Emitter,
+	// gated by Leader if provided.
+	emitter Emitter
+	retrier *retrier
 }
 
 // Monitor monitors a target for events and emits them using the provided.
@@ -89,14 +233,38 @@ type AppMonitor struct {
 // organization and space.
 // It uses default implementations of Firehose, UAA and ccv2.Client.
 func Monitor(ctx context.Context, t Target, e Emitter) (err error) {
-	u, err := url.Parse(t.API)
+	mon, err := NewMonitor(ctx, t, e)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if cerr := mon.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	return mon.Monitor(ctx, t.Org, t.Space)
+}
+
+// NewMonitor creates an AppMonitor for the specified target, which emits
+// metrics using the provided Emitter.
+// It uses default implementations of Firehose, UAA and ccv2.Client.
+// Tokens are fetched using ctx, so they are no longer retried once it is
+// done.
+// The returned monitor should be closed when no longer needed.
+func NewMonitor(ctx context.Context, t Target, e Emitter) (*AppMonitor, error) {
+	u, err := url.Parse(t.API)
+	if err != nil {
+		return nil, err
+	}
 	var httpClient = http.DefaultClient
 	if t.Insecure {
 		httpClient = defaultInsecureClient
 	}
+	if t.Stats != nil {
+		httpClient = instrumentClient(httpClient, t.Stats)
+	}
+	httpClient = limitClient(httpClient, t.RateLimit, t.Stats)
 	cf := &ccv2.Client{
 		API:        u,
 		HTTPClient: httpClient,
@@ -105,15 +273,24 @@ func Monitor(ctx context.Context, t Target, e Emitter) (err error) {
 	if t.RPCTimeout == 0 {
 		t.RPCTimeout = DefaultRPCTimeout
 	}
-	infoCtx, cancel := context.WithTimeout(ctx, t.RPCTimeout)
-	defer cancel()
-	info, err := cf.Info(infoCtx)
-	if err != nil {
+	retrier := newRetrier(t.Retry, t.Stats)
+	var info ccv2.Info
+	err = retrier.Do(ctx, func(ctx context.Context) error {
+		infoCtx, cancel := context.WithTimeout(ctx, t.RPCTimeout)
+		defer cancel()
+		info, err = cf.Info(infoCtx)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	if t.ClientID == "" {
+		t.ClientID = "cf"
+	}
 	oauthConfig := &oauth2.Config{
-		ClientID: "cf",
+		ClientID:     t.ClientID,
+		ClientSecret: t.ClientSecret,
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  info.TokenEndpoint + "/oauth/auth",
 			TokenURL: info.TokenEndpoint + "/oauth/token",
@@ -121,125 +298,322 @@ func Monitor(ctx context.Context, t Target, e Emitter) (err error) {
 	}
 
 	// clientCtx is used to pass a non-default *http.Client to package aouth2.
-	clientCtx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
-	var token = t.Token
-	if token == nil {
-		token, err = oauthConfig.PasswordCredentialsToken(clientCtx, t.Username, t.Password)
-		if err != nil {
-			return err
-		}
+	clientCtx := context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	uaa, err := tokenSource(clientCtx, oauthConfig, t, retrier)
+	if err != nil {
+		return nil, err
 	}
 	cf = &ccv2.Client{
 		API:        u,
-		HTTPClient: oauthConfig.Client(clientCtx, token),
+		HTTPClient: authorizedClient(httpClient, uaa),
 	}
 
 	tlsConfig := &tls.Config{InsecureSkipVerify: t.Insecure}
-	firehose := consumer.New(info.DopplerEndpoint, tlsConfig, nil)
-	defer func() {
-		if cerr := firehose.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
+	noaa := consumer.New(info.DopplerEndpoint, tlsConfig, nil)
 
-	uaa := oauthConfig.TokenSource(clientCtx, token)
 	tr := tokenRefresher{uaa}
-	firehose.RefreshTokenFrom(&tr)
+	noaa.RefreshTokenFrom(&tr)
+	noaa.SetOnConnectCallback(t.Stats.firehoseConnected)
+
+	var firehose Firehose = noaa
+	if t.Recorder != nil {
+		// Only the authenticated Cloud Controller requests are recorded,
+		// so that no credentials end up in the recording. The application
+		// environments are redacted for the same reason.
+		t.Recorder.begin(t.API, t.Org, t.Space)
+		cf.HTTPClient = t.Recorder.client(cf.HTTPClient)
+		firehose = t.Recorder.firehose(firehose)
+	}
 
-	mon := AppMonitor{
-		ErrLog:          log.New(os.Stderr, "mozzle: ", 0),
+	m := newAppMonitor(t, cf, firehose, uaa, e)
+	m.retrier = retrier
+	return m, nil
+}
+
+// newAppMonitor returns an AppMonitor that uses the given clients and is
+// configured as specified by t. The credentials and the target in t are
+// ignored.
+func newAppMonitor(t Target, cc *ccv2.Client, f Firehose, uaa oauth2.TokenSource, e Emitter) *AppMonitor {
+	return &AppMonitor{
+		Logger:          t.Logger,
 		RefreshInterval: t.RefreshInterval,
 		RPCTimeout:      t.RPCTimeout,
-
-		CloudController: cf,
-		Firehose:        firehose,
+		Stats:           t.Stats,
+		Cursors:         t.Cursors,
+		EventPolling:    t.EventPolling,
+		Sharder:         t.Sharder,
+		Leader:          t.Leader,
+		Retry:           t.Retry,
+		Quota:           t.Quota,
+		Enrich:          t.Enrich,
+		AppDefaults:     t.AppDefaults,
+		Trend:           t.Trend,
+		Anomaly:         t.Anomaly,
+		SLOStore:        t.SLOStore,
+		SLOSaveInterval: t.SLOSaveInterval,
+
+		CloudController: cc,
+		Firehose:        f,
 		Emitter:         e,
 		UAA:             uaa,
 	}
+}
 
-	return mon.Monitor(ctx, t.Org, t.Space)
+// tokenSource returns a token source based on the credentials provided in t.
+// Failed token acquisitions are retried using r.
+func tokenSource(ctx context.Context, config *oauth2.Config, t Target, r *retrier) (oauth2.TokenSource, error) {
+	var src oauth2.TokenSource
+	switch {
+	case t.TokenFile != "":
+		src = &fileTokenSource{path: t.TokenFile, ctx: ctx, config: config}
+	case t.Token != nil:
+		src = config.TokenSource(ctx, t.Token)
+	case t.Username != "":
+		var token *oauth2.Token
+		err := r.Do(ctx, func(ctx context.Context) (err error) {
+			token, err = config.PasswordCredentialsToken(ctx, t.Username, t.Password)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		src = config.TokenSource(ctx, token)
+	case t.ClientSecret != "":
+		cc := &clientcredentials.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			TokenURL:     config.Endpoint.TokenURL,
+		}
+		src = cc.TokenSource(ctx)
+	default:
+		return nil, errors.New("no credentials provided")
+	}
+	src = &retryTokenSource{ctx: ctx, src: src, retrier: r}
+	// Fail early if the credentials are not valid. All sources above cache
+	// their tokens, and wrapping them in another cache would keep a
+	// rotated token file from being read until the cached token expires.
+	if _, err := src.Token(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// authorizedClient returns a client that authorizes the requests of base with
+// tokens from src. Unlike oauth2.NewClient, it does not cache the tokens, so
+// that a rotated token file is used as soon as it is read.
+func authorizedClient(base *http.Client, src oauth2.TokenSource) *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{Base: base.Transport, Source: src},
+		Timeout:   base.Timeout,
+	}
+}
+
+// Close releases the resources held by the monitor. If the monitor's
+// Firehose implements io.Closer, it is closed too.
+// The monitor should not be used after it has been closed.
+func (m *AppMonitor) Close() error {
+	if c, ok := m.Firehose.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 // Monitor starts monitoring all applications under the specified organization
 // and space.
 // Monitor blocks until the context is canceled.
 func (m *AppMonitor) Monitor(ctx context.Context, org, space string) error {
-	m.initOnce.Do(func() {
-		m.monitored = make(map[string]struct{})
-		if m.ErrLog == nil {
-			m.ErrLog = log.New(ioutil.Discard, "", 0)
-		}
-		if m.RPCTimeout == 0 {
-			m.RPCTimeout = DefaultRPCTimeout
-		}
-		if m.RefreshInterval == 0 {
-			m.RefreshInterval = DefaultRefreshInterval
-		}
+	m.init()
+	m.beat()
+	m.loadBaselines()
+	m.loadSLOs()
+
+	var spaceEntity ccv2.Space
+	err := m.call(ctx, func(ctx context.Context) (err error) {
+		spaceEntity, err = getSpace(ctx, m.CloudController, org, space)
+		return err
 	})
-
-	spaceCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
-	defer cancel()
-	spaceEntity, err := getSpace(spaceCtx, m.CloudController, org, space)
 	if err != nil {
 		return err
 	}
-	applications := func() ([]application, error) {
-		appQuery := ccv2.Query{
-			Filter: ccv2.FilterSpaceGUID,
-			Op:     ccv2.OperatorEqual,
-			Value:  spaceEntity.GUID,
-		}
-
-		appCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
-		defer cancel()
-		apps, err := m.CloudController.Applications(appCtx, appQuery)
-		if err != nil {
-			return nil, err
-		}
-		var res []application
-		for _, app := range apps {
-			res = append(res, application{app, org, space})
-		}
-		return res, nil
-	}
 
+	sloSaved := time.Now()
 	ticker := time.NewTicker(m.RefreshInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			apps, err := applications()
+		case now := <-ticker.C:
+			m.beat()
+			apps, err := m.applications(ctx, spaceEntity, org, space)
 			if err != nil {
-				m.ErrLog.Printf("error fetching apps: %v\n", err)
+				m.Logger.Error("error fetching apps", "org", org, "space", space, "error", err)
 				continue
 			}
-			m.mu.Lock()
-			for _, app := range apps {
-				if _, ok := m.monitored[app.GUID]; ok {
-					continue
+			if m.Sharder != nil {
+				if err := m.Sharder.Sync(ctx); err != nil {
+					m.Logger.Error("error syncing shards", "error", err)
 				}
-				m.monitored[app.GUID] = struct{}{}
-				go m.monitorApp(ctx, app)
 			}
-			m.mu.Unlock()
+			m.pruneMetadata(apps)
+			m.syncSettings(ctx, apps)
+			m.reconcile(ctx, apps)
+			m.pollSpace(ctx, spaceEntity, org, space)
+			if m.EventPolling == PollSpaceEvents {
+				m.emitSpaceEvents(ctx, spaceEntity, org, space, now)
+			}
+			m.Stats.EmitTo(m.Emitter)
+			m.saveBaselines()
+			if m.sloSaveDue(now, sloSaved) {
+				m.saveSLOs()
+				sloSaved = now
+			}
 		case <-ctx.Done():
+			m.saveSLOs()
 			return ctx.Err()
 		}
 	}
 }
 
+// pollSpace fetches the space summary and emits the metrics of the
+// resources in the space other than the applications.
+func (m *AppMonitor) pollSpace(ctx context.Context, s ccv2.Space, org, space string) {
+	if m.standby() {
+		return
+	}
+	summary, err := m.spaceSummary(ctx, s.GUID)
+	if err != nil {
+		m.Logger.Error("error fetching space summary", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		return
+	}
+	m.emitServices(ctx, s, summary, org, space)
+	m.emitRoutes(ctx, s, summary, org, space)
+	m.emitQuotas(ctx, s, summary, org, space)
+}
+
+// applications returns the applications in space s.
+func (m *AppMonitor) applications(ctx context.Context, s ccv2.Space, org, space string) ([]application, error) {
+	appQuery := ccv2.Query{
+		Filter: ccv2.FilterSpaceGUID,
+		Op:     ccv2.OperatorEqual,
+		Value:  s.GUID,
+	}
+
+	var apps []ccv2.Application
+	err := m.call(ctx, func(ctx context.Context) (err error) {
+		apps, err = m.CloudController.Applications(ctx, appQuery)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res []application
+	for _, app := range apps {
+		res = append(res, application{app, org, space, m.metadata(app.GUID)})
+	}
+	return res, nil
+}
+
+func (m *AppMonitor) init() {
+	m.initOnce.Do(func() {
+		m.monitored = make(map[string]*appStatus)
+		m.appMeta = make(map[string]*appMetadata)
+		m.brokers = make(map[string]string)
+		m.domains = make(map[string]string)
+		m.routes = make(map[string][]string)
+		m.stacks = make(map[string]string)
+		m.appSettings = make(map[string]AppSettings)
+		m.settingsSynced = make(map[string]time.Time)
+		m.invalidSettings = make(map[string]map[string]bool)
+		m.baselines = make(map[string]Baseline)
+		m.sloCounts = make(map[string]SLOCounts)
+		m.sloReleased = make(map[string]bool)
+		m.updateHTTPObserved()
+		if m.SLOStore == nil {
+			m.SLOStore = new(MemorySLOStore)
+		}
+		if m.Anomaly != nil {
+			m.Anomaly.init()
+		}
+		if m.Trend != nil {
+			m.Trend.init()
+		}
+		if m.Logger == nil {
+			m.Logger = nopLogger{}
+		}
+		if m.RPCTimeout == 0 {
+			m.RPCTimeout = DefaultRPCTimeout
+		}
+		if m.RefreshInterval == 0 {
+			m.RefreshInterval = DefaultRefreshInterval
+		}
+		if m.SLOSaveInterval == 0 {
+			m.SLOSaveInterval = DefaultSLOSaveInterval
+		}
+		if m.Quota.Warn == 0 {
+			m.Quota.Warn = DefaultQuotaWarn
+		}
+		if m.Quota.Critical == 0 {
+			m.Quota.Critical = DefaultQuotaCritical
+		}
+		if m.Cursors == nil {
+			m.Cursors = new(MemoryCursorStore)
+		}
+		if m.retrier == nil {
+			m.retrier = newRetrier(m.Retry, m.Stats)
+		}
+		m.emitter = m.Emitter
+		if m.Leader != nil {
+			m.emitter = &leaderEmitter{m.Emitter, m.Leader}
+		}
+	})
+}
+
+// reconcile starts monitoring the owned and enabled applications that are
+// not monitored yet and stops monitoring the ones that are no longer owned or
+// have been disabled.
+func (m *AppMonitor) reconcile(ctx context.Context, apps []application) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, app := range apps {
+		status, monitored := m.monitored[app.GUID]
+		owned := (m.Sharder == nil || m.Sharder.Owns(app.GUID)) && !m.settingsLocked(app.GUID).Disabled
+		switch {
+		case owned && !monitored:
+			appCtx, cancel := context.WithCancel(ctx)
+			status = &appStatus{application: app, cancel: cancel}
+			m.monitored[app.GUID] = status
+			m.sloHandover = true
+			go m.monitorApp(appCtx, status)
+		case !owned && monitored:
+			// The goroutine monitoring the app removes it from the
+			// monitored ones once it exits.
+			status.cancel()
+		}
+	}
+	m.Stats.setMonitoredApps(len(m.monitored))
+}
+
 // monitorApp monitors particular application.
-func (m *AppMonitor) monitorApp(ctx context.Context, app application) {
+func (m *AppMonitor) monitorApp(ctx context.Context, status *appStatus) {
+	app := status.application
 	monitorCtx, cancel := context.WithCancel(ctx)
 	defer func() {
 		m.mu.Lock()
-		delete(m.monitored, app.GUID)
+		if m.monitored[app.GUID] == status {
+			delete(m.monitored, app.GUID)
+			m.releaseSLOsLocked(status)
+		}
+		m.Stats.setMonitoredApps(len(m.monitored))
 		m.mu.Unlock()
 		cancel()
 	}()
 
-	go m.monitorFirehose(monitorCtx, app)
+	go m.monitorFirehose(monitorCtx, app, m.emitter)
 
+	// Spread the polls of all applications over the refresh interval, to
+	// avoid bursts of requests to the Cloud Controller.
+	if err := sleep(ctx, jitter(m.RefreshInterval)); err != nil {
+		return
+	}
 	ticker := time.NewTicker(m.RefreshInterval)
 	defer ticker.Stop()
 	for {
@@ -248,7 +622,16 @@ func (m *AppMonitor) monitorApp(ctx context.Context, app application) {
 			if err := m.emitAppSummary(ctx, app); isAppNotFound(err) {
 				return
 			}
-			m.emitAppEvents(ctx, app, now.Add(-1*m.RefreshInterval))
+			if m.Trend != nil {
+				m.syncInstanceStarts(ctx, app)
+			}
+			m.emitHTTPAggregate(app.GUID)
+			m.emitAnomalies(app.GUID)
+			m.emitSLOs(app.GUID)
+			m.emitApdex(app.GUID)
+			if m.EventPolling == PollAppEvents {
+				m.emitAppEvents(ctx, app, now)
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -256,75 +639,221 @@ func (m *AppMonitor) monitorApp(ctx context.Context, app application) {
 }
 
 // monitorFirehose streams events from the firehose endpoint and creates
-// metrics based on the received events.
-func (m *AppMonitor) monitorFirehose(ctx context.Context, app application) {
+// metrics based on the received events, which are emitted using e.
+func (m *AppMonitor) monitorFirehose(ctx context.Context, app application, e Emitter) {
 	token, err := m.UAA.Token()
 	if err != nil {
+		m.Logger.Error("error obtaining token for firehose", app.logArgs("error", err)...)
 		return
 	}
 
+	// The status is nil when sampling applications that are not monitored.
+	m.mu.Lock()
+	status := m.monitored[app.GUID]
+	m.mu.Unlock()
+
 	tokenStr := token.TokenType + " " + token.AccessToken
 	msgChan, errorChan := m.Firehose.Stream(app.GUID, tokenStr)
+	m.Stats.firehoseStreamStarted()
 	for {
 		select {
 		case event := <-msgChan:
+			m.Stats.envelopeReceived(event.GetEventType())
+			status.recordEnvelope()
 			switch event.GetEventType() {
 			case events.Envelope_ContainerMetric:
-				containerMetrics{event.GetContainerMetric(), app}.EmitTo(m.Emitter)
+				containerMetrics{event.GetContainerMetric(), app, m.settings(app.GUID)}.EmitTo(e)
+				if m.Trend != nil {
+					m.emitTrends(app, event.GetContainerMetric(), e)
+				}
 			case events.Envelope_HttpStartStop:
-				httpMetrics{event.GetHttpStartStop(), app}.EmitTo(m.Emitter)
+				if !m.observeHTTP(app.GUID, event.GetHttpStartStop()) {
+					httpMetrics{event.GetHttpStartStop(), app}.EmitTo(e)
+				}
+			case events.Envelope_LogMessage:
+				m.stagingLog(app.GUID, event.GetLogMessage())
 			}
 		case <-ctx.Done():
-			m.ErrLog.Printf("stopping firehose monitor for app %s due to: %v",
-				app.GUID, ctx.Err())
+			m.Logger.Debug("stopping firehose monitor", app.logArgs("reason", ctx.Err())...)
 			return
 		case err, ok := <-errorChan:
 			if !ok {
-				m.ErrLog.Printf("firehose error chan closed, exiting\n")
+				m.Logger.Warn("firehose error channel closed, stopping firehose monitor", app.logArgs()...)
 				return
 			}
-			m.ErrLog.Printf("error streaming from firehose: %v\n", err)
+			m.Stats.firehoseError()
+			m.Logger.Error("error streaming from firehose", app.logArgs("error", err)...)
 		}
 	}
 }
 
 func (m *AppMonitor) emitAppSummary(ctx context.Context, app application) error {
-	summaryCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
-	defer cancel()
-	summary, err := m.CloudController.ApplicationSummary(summaryCtx, app.Application)
+	summary, err := m.appSummary(ctx, app.GUID)
 	if err != nil {
-		m.ErrLog.Printf("error fetching app summary: %v\n", err)
+		m.Logger.Error("error fetching app summary", app.logArgs("error", err)...)
 		return err
 	}
-	applicationMetrics{summary, app}.EmitTo(m.Emitter)
+	m.recordSummary(app.GUID, summary)
+	m.enrich(ctx, app, summary)
+	applicationMetrics{summary, app}.EmitTo(m.emitter)
+	m.deploymentProgress(ctx, app.GUID, summary)
 	return nil
 }
 
-func (m *AppMonitor) emitAppEvents(ctx context.Context, app application, since time.Time) {
-	events, err := m.appEventsSince(ctx, app, since)
+// call calls fn with a context limited to RPCTimeout, retrying it according
+// to the monitor's RetryPolicy, and records progress once it returns.
+func (m *AppMonitor) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	defer m.progress()
+	return m.retrier.Do(ctx, func(ctx context.Context) error {
+		callCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
+		defer cancel()
+		return fn(callCtx)
+	})
+}
+
+// standby reports whether the monitor is waiting to become the leader.
+func (m *AppMonitor) standby() bool {
+	return m.Leader != nil && !m.Leader.IsLeader()
+}
+
+// emitAppEvents emits the application's events that occurred after its
+// cursor. If the application has no stored cursor, events that occurred
+// within the last refresh interval before now are emitted.
+func (m *AppMonitor) emitAppEvents(ctx context.Context, app application, now time.Time) {
+	key := "app:" + app.GUID
+	if m.standby() {
+		// Keep the cursor recent, so that events occurring around a
+		// takeover are emitted once leadership is acquired.
+		cursor := EventCursor{Timestamp: now.Add(-1 * m.RefreshInterval)}
+		if err := m.Cursors.Save(key, cursor); err != nil {
+			m.Logger.Error("error saving event cursor", app.logArgs("error", err)...)
+		}
+		return
+	}
+	cursor, ok, err := m.Cursors.Load(key)
+	if err != nil {
+		m.Logger.Error("error loading event cursor", app.logArgs("error", err)...)
+		return
+	}
+	if !ok {
+		cursor = EventCursor{Timestamp: now.Add(-1 * m.RefreshInterval)}
+	}
+
+	events, err := m.appEventsSince(ctx, app, cursor.Timestamp)
+	if err != nil {
+		m.Logger.Error("error fetching app events", app.logArgs("error", err)...)
+		return
+	}
+	events, cursor = newEvents(cursor, events)
+	for _, event := range events {
+		applicationEvent{event, app}.EmitTo(m.emitter)
+		m.deploymentEvent(ctx, app.GUID, event)
+	}
+	if !ok || len(events) > 0 {
+		if err := m.Cursors.Save(key, cursor); err != nil {
+			m.Logger.Error("error saving event cursor", app.logArgs("error", err)...)
+		}
+	}
+}
+
+// emitSpaceEvents emits the space's events that occurred after its cursor.
+// Events concerning monitored applications are emitted as application
+// events, all others as space events.
+func (m *AppMonitor) emitSpaceEvents(ctx context.Context, s ccv2.Space, org, space string, now time.Time) {
+	key := "space:" + s.GUID
+	if m.standby() {
+		cursor := EventCursor{Timestamp: now.Add(-1 * m.RefreshInterval)}
+		if err := m.Cursors.Save(key, cursor); err != nil {
+			m.Logger.Error("error saving event cursor", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		}
+		return
+	}
+	cursor, ok, err := m.Cursors.Load(key)
 	if err != nil {
-		m.ErrLog.Printf("error fetching app events: %v\n", err)
+		m.Logger.Error("error loading event cursor", "org", org, "space", space, "space_guid", s.GUID, "error", err)
 		return
 	}
+	if !ok {
+		cursor = EventCursor{Timestamp: now.Add(-1 * m.RefreshInterval)}
+	}
+
+	spaceQuery := ccv2.Query{
+		Filter: ccv2.FilterSpaceGUID,
+		Op:     ccv2.OperatorEqual,
+		Value:  s.GUID,
+	}
+	var events []ccv2.Event
+	err = m.call(ctx, func(ctx context.Context) (err error) {
+		events, err = m.CloudController.Events(ctx, spaceQuery, timestampQuery(cursor.Timestamp))
+		return err
+	})
+	if err != nil {
+		m.Logger.Error("error fetching space events", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		return
+	}
+	events, cursor = newEvents(cursor, events)
 	for _, event := range events {
-		applicationEvent{event, app}.EmitTo(m.Emitter)
+		m.emitSpaceEvent(ctx, s, event, org, space)
+	}
+	if !ok || len(events) > 0 {
+		if err := m.Cursors.Save(key, cursor); err != nil {
+			m.Logger.Error("error saving event cursor", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		}
 	}
 }
 
+// emitSpaceEvent emits an event of space s as an application event, if it
+// concerns a monitored application, or as a space event, if it does not
+// concern an application at all. Events of applications that are not
+// monitored, e.g. because they opted out, are not emitted.
+func (m *AppMonitor) emitSpaceEvent(ctx context.Context, s ccv2.Space, event ccv2.Event, org, space string) {
+	// When sharding, the owner of the application emits its events and
+	// the owner of the space emits all other events.
+	owner := event.Entity.Actee
+	if event.Entity.ActeeType != "app" {
+		owner = s.GUID
+	}
+	if m.Sharder != nil && !m.Sharder.Owns(owner) {
+		return
+	}
+	if event.Entity.ActeeType != "app" {
+		spaceEvent{event, org, space}.EmitTo(m.emitter)
+		return
+	}
+	m.mu.Lock()
+	status, ok := m.monitored[event.Entity.Actee]
+	m.mu.Unlock()
+	if ok {
+		applicationEvent{event, status.application}.EmitTo(m.emitter)
+		m.deploymentEvent(ctx, status.GUID, event)
+	}
+}
+
+// appEventsSince returns the application's events that occurred at or after
+// t.
 func (m *AppMonitor) appEventsSince(ctx context.Context, app application, t time.Time) ([]ccv2.Event, error) {
 	acteeQuery := ccv2.Query{
 		Filter: ccv2.FilterActee,
 		Op:     ccv2.OperatorEqual,
 		Value:  app.GUID,
 	}
-	timestampQuery := ccv2.Query{
+	var events []ccv2.Event
+	err := m.call(ctx, func(ctx context.Context) (err error) {
+		events, err = m.CloudController.Events(ctx, acteeQuery, timestampQuery(t))
+		return err
+	})
+	return events, err
+}
+
+// timestampQuery returns a query for events that occurred at or after t.
+func timestampQuery(t time.Time) ccv2.Query {
+	// Event timestamps have a precision of one second, so make sure that
+	// events in the same second as t are included too.
+	return ccv2.Query{
 		Filter: ccv2.FilterTimestamp,
 		Op:     ccv2.OperatorGreater,
-		Value:  t.String(),
+		Value:  t.Add(-1 * time.Second).UTC().Format(time.RFC3339),
 	}
-	eventsCtx, cancel := context.WithTimeout(ctx, m.RPCTimeout)
-	defer cancel()
-	return m.CloudController.Events(eventsCtx, acteeQuery, timestampQuery)
 }
 
 // getSpace returns the Space entity described by the org, space pair.
@@ -378,6 +907,8 @@ type application struct {
 	ccv2.Application
 	Org   string
 	Space string
+
+	meta *appMetadata
 }
 
 type tokenRefresher struct {
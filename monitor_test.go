@@ -0,0 +1,105 @@
+package mozzle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// ownerSharder implements Sharder, owning the GUIDs set to true.
+type ownerSharder map[string]bool
+
+func (s ownerSharder) Sync(ctx context.Context) error { return nil }
+func (s ownerSharder) Owns(guid string) bool          { return s[guid] }
+
+// leader implements Leader, reporting the value itself.
+type leader bool
+
+func (l leader) IsLeader() bool { return bool(l) }
+
+func TestEmitSpaceEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		actee     string
+		acteeType string
+		sharder   Sharder
+		want      string // service of the emitted event; empty if none
+	}{
+		{name: "monitored app", actee: "a", acteeType: "app", want: "app event"},
+		{name: "unmonitored app", actee: "b", acteeType: "app"},
+		{name: "service instance", actee: "si", acteeType: "service_instance", want: "space event"},
+		{name: "route", actee: "r", acteeType: "route", want: "space event"},
+		{name: "owned app", actee: "a", acteeType: "app", sharder: ownerSharder{"a": true}, want: "app event"},
+		{name: "app owned by another", actee: "a", acteeType: "app", sharder: ownerSharder{"s": true}},
+		{name: "owned space", actee: "r", acteeType: "route", sharder: ownerSharder{"s": true}, want: "space event"},
+		{name: "space owned by another", actee: "r", acteeType: "route", sharder: ownerSharder{"a": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, c := newTestMonitor(Target{Sharder: tt.sharder}, new(fakeCC))
+			app := testApp("a", "app-a")
+			m.monitored[app.GUID] = &appStatus{application: app}
+			var space ccv2.Space
+			space.GUID = "s"
+			e := event("e", time.Now())
+			e.Entity.Type = "audit.app.update"
+			e.Entity.Actee = tt.actee
+			e.Entity.ActeeType = tt.acteeType
+
+			m.emitSpaceEvent(context.Background(), space, e, "org", "space")
+			var got string
+			switch len(c.metrics) {
+			case 0:
+			case 1:
+				got = c.metrics[0].Service
+			default:
+				t.Fatalf("emitted %+v, want at most one event", c.metrics)
+			}
+			if got != tt.want {
+				t.Errorf("emitted %q, want %q", got, tt.want)
+			}
+			if got == "space event" && c.metrics[0].Attributes["actee_id"] != tt.actee {
+				t.Errorf("attributes = %v, want the actee", c.metrics[0].Attributes)
+			}
+		})
+	}
+}
+
+func TestPollSpace(t *testing.T) {
+	summary := `{
+		"apps":[{"guid":"a","service_names":["db"],"routes":[
+			{"guid":"r","host":"www","domain":{"name":"example.com"}}]}],
+		"services":[{"guid":"si","name":"db","bound_app_count":1}]}`
+	tests := []struct {
+		name   string
+		leader Leader
+		want   bool
+	}{
+		{"no leader election", nil, true},
+		{"leader", leader(true), true},
+		{"standby", leader(false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := new(fakeCC)
+			cc.set("/v2/spaces/s/summary", summary)
+			m, c := newTestMonitor(Target{Leader: tt.leader}, cc)
+			app := testApp("a", "app-a")
+			m.monitored[app.GUID] = &appStatus{application: app}
+			var space ccv2.Space
+			space.GUID = "s"
+
+			m.pollSpace(context.Background(), space, "org", "space")
+			if got := cc.count("/v2/spaces/s/summary") == 1; got != tt.want {
+				t.Errorf("space summary fetched %d times", cc.count("/v2/spaces/s/summary"))
+			}
+			services := c.service("service instance bound_apps_count")
+			routes := c.service("app routes_count")
+			if got := len(services) == 1 && len(routes) == 1; got != tt.want {
+				t.Errorf("service instance metrics = %+v, route metrics = %+v, want them emitted %v", services, routes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package mozzle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+// OverflowPolicy determines what an emitter does with a metric when its
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the metric being emitted.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the oldest queued metric to make room for the one
+	// being emitted.
+	DropOldest
+	// Block blocks Emit until there is room in the queue, but for no longer
+	// than a timeout. The metric is dropped if the timeout expires.
+	Block
+	// Priority sends application summary and audit event metrics before
+	// the per-request HTTP metrics, and drops the oldest queued HTTP metric
+	// to make room for any other metric. HTTP metrics are dropped if the
+	// queue holds no other HTTP metrics.
+	Priority
+)
+
+// String returns the name of the policy, as accepted by ParseOverflowPolicy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Priority:
+		return "priority"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverflowPolicy returns the policy with the given name - one of
+// drop-newest, drop-oldest, block or priority.
+func ParseOverflowPolicy(name string) (OverflowPolicy, bool) {
+	for p := DropNewest; p <= Priority; p++ {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// lowPriority reports whether m is one of the high-rate, per-request
+// metrics, which give way to all others under the Priority policy.
+func lowPriority(m Metric) bool {
+	switch m.Service {
+	case "http response time_ms", "http response content_length_bytes":
+		return true
+	}
+	return false
+}
+
+// eventQueue is a bounded FIFO queue of events, which applies an
+// OverflowPolicy when full. Low priority events are kept separately and
+// dequeued only when there are no other events.
+type eventQueue struct {
+	size    int
+	policy  OverflowPolicy
+	timeout time.Duration // for Block
+
+	mu   sync.Mutex // guards
+	high []*raidman.Event
+	low  []*raidman.Event
+
+	// ready is signaled when an event is enqueued and space when one is
+	// dequeued. Both have a buffer of one, so signals are not lost.
+	ready chan struct{}
+	space chan struct{}
+}
+
+func newEventQueue(size int, policy OverflowPolicy, timeout time.Duration) *eventQueue {
+	return &eventQueue{
+		size:    size,
+		policy:  policy,
+		timeout: timeout,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+// Push enqueues e. It returns the event dropped to enforce the queue's size,
+// which may be e itself, or nil if none was dropped.
+func (q *eventQueue) Push(e *raidman.Event, low bool) *raidman.Event {
+	var deadline <-chan time.Time
+	for {
+		q.mu.Lock()
+		dropped, full := q.push(e, low)
+		q.mu.Unlock()
+		if !full {
+			signal(q.ready)
+			return dropped
+		}
+		if q.policy != Block {
+			return e
+		}
+		if deadline == nil {
+			timer := time.NewTimer(q.timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-q.space:
+		case <-deadline:
+			return e
+		}
+	}
+}
+
+// push enqueues e, applying the policy if the queue is full. It reports
+// whether e could not be enqueued because the queue is full.
+func (q *eventQueue) push(e *raidman.Event, low bool) (dropped *raidman.Event, full bool) {
+	if q.policy != Priority {
+		low = false
+	}
+	if len(q.high)+len(q.low) >= q.size {
+		switch {
+		case q.policy == DropOldest && len(q.high) > 0:
+			dropped, q.high = q.high[0], q.high[1:]
+		case q.policy == Priority && len(q.low) > 0:
+			dropped, q.low = q.low[0], q.low[1:]
+		default:
+			return nil, true
+		}
+	}
+	if low {
+		q.low = append(q.low, e)
+	} else {
+		q.high = append(q.high, e)
+	}
+	return dropped, false
+}
+
+// Pop dequeues the next event. It returns nil if the queue is empty.
+func (q *eventQueue) Pop() *raidman.Event {
+	q.mu.Lock()
+	var e *raidman.Event
+	switch {
+	case len(q.high) > 0:
+		e, q.high = q.high[0], q.high[1:]
+	case len(q.low) > 0:
+		e, q.low = q.low[0], q.low[1:]
+	}
+	q.mu.Unlock()
+	if e != nil {
+		signal(q.space)
+	}
+	return e
+}
+
+// Len returns the number of queued events.
+func (q *eventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.high) + len(q.low)
+}
+
+// Ready returns a channel that receives a value after events are enqueued.
+func (q *eventQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// signal sends on c without blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,128 @@
+package mozzle
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for p := DropNewest; p <= Priority; p++ {
+		got, ok := ParseOverflowPolicy(p.String())
+		if !ok || got != p {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v, want %v, true", p.String(), got, ok, p)
+		}
+	}
+	if _, ok := ParseOverflowPolicy("unknown"); ok {
+		t.Error("ParseOverflowPolicy(\"unknown\") succeeded")
+	}
+}
+
+func TestEventQueueOverflow(t *testing.T) {
+	type push struct {
+		service string
+		low     bool
+	}
+	tests := []struct {
+		name        string
+		policy      OverflowPolicy
+		pushes      []push
+		wantDropped []string
+		wantQueued  []string // in dequeue order
+	}{
+		{
+			name:        "drop newest",
+			policy:      DropNewest,
+			pushes:      []push{{"a", false}, {"b", false}, {"c", false}},
+			wantDropped: []string{"c"},
+			wantQueued:  []string{"a", "b"},
+		},
+		{
+			name:        "drop oldest",
+			policy:      DropOldest,
+			pushes:      []push{{"a", false}, {"b", false}, {"c", false}},
+			wantDropped: []string{"a"},
+			wantQueued:  []string{"b", "c"},
+		},
+		{
+			name:        "low priority ignored by other policies",
+			policy:      DropNewest,
+			pushes:      []push{{"a", true}, {"b", false}},
+			wantQueued:  []string{"a", "b"},
+			wantDropped: nil,
+		},
+		{
+			name:        "priority dequeues high first",
+			policy:      Priority,
+			pushes:      []push{{"http", true}, {"app", false}},
+			wantQueued:  []string{"app", "http"},
+			wantDropped: nil,
+		},
+		{
+			name:        "priority drops oldest low",
+			policy:      Priority,
+			pushes:      []push{{"http1", true}, {"http2", true}, {"app", false}},
+			wantDropped: []string{"http1"},
+			wantQueued:  []string{"app", "http2"},
+		},
+		{
+			name:        "priority drops newest without low",
+			policy:      Priority,
+			pushes:      []push{{"a", false}, {"b", false}, {"http", true}, {"c", false}},
+			wantDropped: []string{"http", "c"},
+			wantQueued:  []string{"a", "b"},
+		},
+		{
+			name:        "block times out",
+			policy:      Block,
+			pushes:      []push{{"a", false}, {"b", false}, {"c", false}},
+			wantDropped: []string{"c"},
+			wantQueued:  []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newEventQueue(2, tt.policy, time.Millisecond)
+			var dropped []string
+			for _, p := range tt.pushes {
+				if e := q.Push(&raidman.Event{Service: p.service}, p.low); e != nil {
+					dropped = append(dropped, e.Service)
+				}
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+			if q.Len() != len(tt.wantQueued) {
+				t.Errorf("Len() = %d, want %d", q.Len(), len(tt.wantQueued))
+			}
+			var queued []string
+			for e := q.Pop(); e != nil; e = q.Pop() {
+				queued = append(queued, e.Service)
+			}
+			if !reflect.DeepEqual(queued, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestEventQueueBlockWaitsForSpace(t *testing.T) {
+	q := newEventQueue(1, Block, time.Minute)
+	q.Push(&raidman.Event{Service: "a"}, false)
+	done := make(chan *raidman.Event)
+	go func() {
+		done <- q.Push(&raidman.Event{Service: "b"}, false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if e := q.Pop(); e == nil || e.Service != "a" {
+		t.Fatalf("Pop() = %v, want a", e)
+	}
+	if dropped := <-done; dropped != nil {
+		t.Errorf("Push() dropped %v after space was made", dropped.Service)
+	}
+	if e := q.Pop(); e == nil || e.Service != "b" {
+		t.Errorf("Pop() = %v, want b", e)
+	}
+}
@@ -0,0 +1,205 @@
+package mozzle
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// Default quota utilisation thresholds.
+const (
+	DefaultQuotaWarn     = 0.8
+	DefaultQuotaCritical = 0.95
+)
+
+// QuotaThresholds configures the states of the quota utilisation metrics.
+type QuotaThresholds struct {
+	// Warn and Critical are the ratios of used to allowed resources at or
+	// above which a quota is in warn or critical state. They default to
+	// DefaultQuotaWarn and DefaultQuotaCritical.
+	Warn     float64
+	Critical float64
+}
+
+// quotaUsage describes the usage of a single resource limited by an org or
+// space quota.
+type quotaUsage struct {
+	Scope    string // "org" or "space"
+	Quota    string
+	Resource string
+	Used     int
+	Limit    int
+	Org      string
+	Space    string
+
+	Thresholds QuotaThresholds
+}
+
+func (q quotaUsage) EmitTo(e Emitter) {
+	// A negative limit means that the resource is not limited.
+	if q.Limit < 0 {
+		return
+	}
+	r := ratio(uint64(q.Used), uint64(q.Limit))
+	if q.Limit == 0 && q.Used > 0 {
+		r = 1
+	}
+	state := "ok"
+	switch {
+	case r >= q.Thresholds.Critical:
+		state = "critical"
+	case r >= q.Thresholds.Warn:
+		state = "warn"
+	}
+	attributes := map[string]string{
+		"org":   q.Org,
+		"quota": q.Quota,
+		"used":  strconv.Itoa(q.Used),
+		"limit": strconv.Itoa(q.Limit),
+	}
+	metric := Metric{
+		Organization: q.Org,
+		Service:      q.Scope + " quota " + q.Resource + "_ratio",
+		Metric:       r,
+		State:        state,
+		Attributes:   attributes,
+	}
+	if q.Scope == "space" {
+		attributes["space"] = q.Space
+		metric.Space = q.Space
+	}
+	e.Emit(metric)
+}
+
+// quotaDefinition is a Cloud Controller v2 org or space quota definition.
+type quotaDefinition struct {
+	Entity struct {
+		Name             string `json:"name"`
+		MemoryLimit      int    `json:"memory_limit"`
+		AppInstanceLimit int    `json:"app_instance_limit"`
+		TotalServices    int    `json:"total_services"`
+		TotalRoutes      int    `json:"total_routes"`
+	} `json:"entity"`
+}
+
+// quotaResources holds the usage of the resources limited by quotas.
+type quotaResources struct {
+	Memory       int // in MB
+	AppInstances int
+	Services     int
+	Routes       int
+}
+
+// emitQuotas emits the utilisation of the quotas of the space and its org.
+func (m *AppMonitor) emitQuotas(ctx context.Context, s ccv2.Space, summary spaceSummary, org, space string) {
+	// When sharding, the owner of the space emits the quotas.
+	if m.Sharder != nil && !m.Sharder.Owns(s.GUID) {
+		return
+	}
+	var spaceEntity struct {
+		Entity struct {
+			OrganizationGUID string `json:"organization_guid"`
+			QuotaGUID        string `json:"space_quota_definition_guid"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/spaces/"+s.GUID, nil, &spaceEntity); err != nil {
+		m.Logger.Error("error fetching space", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		return
+	}
+
+	if guid := spaceEntity.Entity.QuotaGUID; guid != "" {
+		var quota quotaDefinition
+		usage, err := m.spaceQuotaUsage(ctx, s.GUID, summary)
+		if err == nil {
+			err = m.ccGet(ctx, "/v2/space_quota_definitions/"+guid, nil, &quota)
+		}
+		if err != nil {
+			m.Logger.Error("error fetching space quota", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		} else {
+			m.emitQuota("space", quota, usage, org, space)
+		}
+	}
+
+	orgGUID := spaceEntity.Entity.OrganizationGUID
+	var orgEntity struct {
+		Entity struct {
+			QuotaGUID string `json:"quota_definition_guid"`
+		} `json:"entity"`
+	}
+	var quota quotaDefinition
+	err := m.ccGet(ctx, "/v2/organizations/"+orgGUID, nil, &orgEntity)
+	if err == nil {
+		err = m.ccGet(ctx, "/v2/quota_definitions/"+orgEntity.Entity.QuotaGUID, nil, &quota)
+	}
+	var usage quotaResources
+	if err == nil {
+		usage, err = m.orgQuotaUsage(ctx, orgGUID)
+	}
+	if err != nil {
+		m.Logger.Error("error fetching org quota", "org", org, "org_guid", orgGUID, "error", err)
+		return
+	}
+	m.emitQuota("org", quota, usage, org, space)
+}
+
+func (m *AppMonitor) emitQuota(scope string, quota quotaDefinition, usage quotaResources, org, space string) {
+	th := m.Quota
+	name := quota.Entity.Name
+	for _, q := range []quotaUsage{
+		{scope, name, "memory", usage.Memory, quota.Entity.MemoryLimit, org, space, th},
+		{scope, name, "app_instances", usage.AppInstances, quota.Entity.AppInstanceLimit, org, space, th},
+		{scope, name, "service_instances", usage.Services, quota.Entity.TotalServices, org, space, th},
+		{scope, name, "routes", usage.Routes, quota.Entity.TotalRoutes, org, space, th},
+	} {
+		q.EmitTo(m.emitter)
+	}
+}
+
+// spaceQuotaUsage returns the usage of the resources in the space. Only
+// started applications and managed service instances count against quotas.
+func (m *AppMonitor) spaceQuotaUsage(ctx context.Context, spaceGUID string, summary spaceSummary) (quotaResources, error) {
+	var usage quotaResources
+	for _, app := range summary.Apps {
+		if app.State == "STARTED" {
+			usage.Memory += app.Memory * app.Instances
+			usage.AppInstances += app.Instances
+		}
+	}
+	for _, si := range summary.Services {
+		if si.ServicePlan != nil {
+			usage.Services++
+		}
+	}
+	var err error
+	usage.Routes, err = m.ccCount(ctx, "/v2/spaces/"+spaceGUID+"/routes", nil)
+	return usage, err
+}
+
+// orgQuotaUsage returns the usage of the resources in the org.
+func (m *AppMonitor) orgQuotaUsage(ctx context.Context, orgGUID string) (quotaResources, error) {
+	var usage quotaResources
+	var memory struct {
+		Usage int `json:"memory_usage_in_mb"`
+	}
+	if err := m.ccGet(ctx, "/v2/organizations/"+orgGUID+"/memory_usage", nil, &memory); err != nil {
+		return usage, err
+	}
+	usage.Memory = memory.Usage
+	var instances struct {
+		Usage int `json:"instance_usage"`
+	}
+	if err := m.ccGet(ctx, "/v2/organizations/"+orgGUID+"/instance_usage", nil, &instances); err != nil {
+		return usage, err
+	}
+	usage.AppInstances = instances.Usage
+
+	query := url.Values{"q": {"organization_guid:" + orgGUID}}
+	var err error
+	if usage.Services, err = m.ccCount(ctx, "/v2/service_instances", query); err != nil {
+		return usage, err
+	}
+	usage.Routes, err = m.ccCount(ctx, "/v2/routes", query)
+	return usage, err
+}
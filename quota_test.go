@@ -0,0 +1,110 @@
+package mozzle
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+func TestQuotaUsageEmitTo(t *testing.T) {
+	th := QuotaThresholds{Warn: 0.8, Critical: 0.95}
+	tests := []struct {
+		name      string
+		used      int
+		limit     int
+		wantRatio float64
+		wantState string // empty if nothing is emitted
+	}{
+		{"ok", 50, 100, 0.5, "ok"},
+		{"warn", 80, 100, 0.8, "warn"},
+		{"just below critical", 94, 100, 0.94, "warn"},
+		{"critical", 95, 100, 0.95, "critical"},
+		{"exceeded", 120, 100, 1.2, "critical"},
+		{"unlimited", 1000, -1, 0, ""},
+		{"none allowed and none used", 0, 0, 0, "ok"},
+		{"none allowed but used", 1, 0, 1, "critical"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c collector
+			quotaUsage{"org", "default", "memory", tt.used, tt.limit, "org", "space", th}.EmitTo(&c)
+			ms := c.service("org quota memory_ratio")
+			if tt.wantState == "" {
+				if len(c.metrics) != 0 {
+					t.Errorf("emitted %+v, want nothing", c.metrics)
+				}
+				return
+			}
+			if len(ms) != 1 {
+				t.Fatalf("emitted %+v, want a single org quota memory_ratio", c.metrics)
+			}
+			if ms[0].Metric != tt.wantRatio || ms[0].State != tt.wantState {
+				t.Errorf("ratio = %v %s, want %v %s", ms[0].Metric, ms[0].State, tt.wantRatio, tt.wantState)
+			}
+			if ms[0].Space != "" || ms[0].Attributes["space"] != "" {
+				t.Errorf("org quota has space %q", ms[0].Space)
+			}
+		})
+	}
+}
+
+func TestEmitQuotas(t *testing.T) {
+	cc := new(fakeCC)
+	cc.set("/v2/spaces/s", `{"entity":{"organization_guid":"o","space_quota_definition_guid":"sq"}}`)
+	cc.set("/v2/space_quota_definitions/sq", `{"entity":{
+		"name":"small","memory_limit":1024,"app_instance_limit":-1,"total_services":2,"total_routes":10}}`)
+	cc.set("/v2/spaces/s/routes", `{"total_results":9}`)
+	cc.set("/v2/organizations/o", `{"entity":{"quota_definition_guid":"oq"}}`)
+	cc.set("/v2/quota_definitions/oq", `{"entity":{
+		"name":"default","memory_limit":10240,"app_instance_limit":100,"total_services":-1,"total_routes":1000}}`)
+	cc.set("/v2/organizations/o/memory_usage", `{"memory_usage_in_mb":2048}`)
+	cc.set("/v2/organizations/o/instance_usage", `{"instance_usage":4}`)
+	cc.set("/v2/service_instances", `{"total_results":3}`)
+	cc.set("/v2/routes", `{"total_results":20}`)
+	m, c := newTestMonitor(Target{}, cc)
+	var space ccv2.Space
+	space.GUID = "s"
+	var summary spaceSummary
+	err := json.Unmarshal([]byte(`{
+		"apps":[
+			{"guid":"a","state":"STARTED","memory":256,"instances":2},
+			{"guid":"b","state":"STOPPED","memory":1024,"instances":1}],
+		"services":[
+			{"guid":"si1","service_plan":{"name":"small"}},
+			{"guid":"si2"}]}`), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.emitQuotas(context.Background(), space, summary, "org", "space")
+
+	tests := []struct {
+		service string
+		ratio   float64 // -1 if not emitted
+		state   string
+	}{
+		{"space quota memory_ratio", 0.5, "ok"},
+		{"space quota app_instances_ratio", -1, ""},
+		{"space quota service_instances_ratio", 0.5, "ok"},
+		{"space quota routes_ratio", 0.9, "warn"},
+		{"org quota memory_ratio", 0.2, "ok"},
+		{"org quota app_instances_ratio", 0.04, "ok"},
+		{"org quota service_instances_ratio", -1, ""},
+		{"org quota routes_ratio", 0.02, "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			ms := c.service(tt.service)
+			if tt.ratio < 0 {
+				if len(ms) != 0 {
+					t.Errorf("emitted %+v for an unlimited resource", ms)
+				}
+				return
+			}
+			if len(ms) != 1 || ms[0].Metric != tt.ratio || ms[0].State != tt.state {
+				t.Errorf("emitted %+v, want %v %s", ms, tt.ratio, tt.state)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package mozzle
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit configures client-side limits for the requests made to the
+// Cloud Controller. The zero value imposes no limits, but requests rejected
+// with 429 Too Many Requests are still retried as configured by MaxRetries.
+type RateLimit struct {
+	// Rate is the maximum sustained number of requests per second.
+	// Zero means unlimited.
+	Rate float64
+	// Burst is the number of requests that may be made at once, above
+	// Rate. Defaults to 1.
+	Burst int
+	// MaxConcurrent is the maximum number of requests in flight.
+	// Zero means unlimited.
+	MaxConcurrent int
+	// MaxRetries is the number of times a request rejected with 429 Too
+	// Many Requests is retried after waiting as instructed by its
+	// Retry-After header. Defaults to 3.
+	MaxRetries int
+}
+
+// defaultRetryAfter is the time waited after a 429 Too Many Requests
+// response without a valid Retry-After header.
+const defaultRetryAfter = time.Second
+
+// limitedTransport enforces a RateLimit on all round trips.
+type limitedTransport struct {
+	base       http.RoundTripper
+	bucket     *tokenBucket  // nil if unlimited
+	sem        chan struct{} // nil if unlimited
+	maxRetries int
+	stats      *Stats
+}
+
+// limitClient returns a copy of c that enforces the limits l. It is the only
+// layer that retries requests rejected with 429 Too Many Requests; the
+// retrier treats them as permanent failures.
+func limitClient(c *http.Client, l RateLimit, s *Stats) *http.Client {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &limitedTransport{base: base, maxRetries: l.MaxRetries, stats: s}
+	if t.maxRetries == 0 {
+		t.maxRetries = 3
+	}
+	if l.Rate > 0 {
+		t.bucket = newTokenBucket(l.Rate, l.Burst)
+	}
+	if l.MaxConcurrent > 0 {
+		t.sem = make(chan struct{}, l.MaxConcurrent)
+	}
+	cpy := *c
+	cpy.Transport = t
+	return &cpy
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for retries := 0; ; retries++ {
+		if t.bucket != nil {
+			delayed, err := t.bucket.Wait(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if delayed {
+				t.stats.ccDelayed()
+			}
+		}
+		resp, err := t.roundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		t.stats.ccThrottled()
+		if retries >= t.maxRetries || !rewindable(req) {
+			return resp, nil
+		}
+		wait := retryAfter(resp, time.Now())
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		// Hold back all other requests too, as the limit is likely shared.
+		if t.bucket != nil {
+			t.bucket.Pause(wait)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip sends req while holding a concurrency slot. The slot is released
+// before waiting for a retry, so that throttled requests do not hold back
+// the others.
+func (t *limitedTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.sem != nil {
+		select {
+		case t.sem <- struct{}{}:
+			defer func() { <-t.sem }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// rewindable reports whether req can be sent again.
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewind returns a copy of req with a fresh body, ready to be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	cpy := req.Clone(req.Context())
+	cpy.Body = body
+	return cpy, nil
+}
+
+// retryAfter returns the wait time requested by the response's Retry-After
+// header, given either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// sleep waits for d to pass or ctx to be done, whichever happens first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitter returns a random duration in the range [0, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// tokenBucket implements a token bucket rate limiter, which allows rate
+// events per second with bursts of up to burst events.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu          sync.Mutex // guards
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done. It reports whether
+// it had to wait.
+func (b *tokenBucket) Wait(ctx context.Context) (delayed bool, err error) {
+	for {
+		d := b.reserve(time.Now())
+		if d == 0 {
+			return delayed, nil
+		}
+		delayed = true
+		if err := sleep(ctx, d); err != nil {
+			return delayed, err
+		}
+	}
+}
+
+// Pause stops handing out tokens for d.
+func (b *tokenBucket) Pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// available returns the number of currently available tokens.
+func (b *tokenBucket) available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens := b.tokens + time.Since(b.last).Seconds()*b.rate
+	if tokens > b.burst {
+		tokens = b.burst
+	}
+	return tokens
+}
+
+// reserve takes a token and returns zero, or returns the time to wait
+// before trying again.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,172 @@
+package mozzle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{"missing", "", defaultRetryAfter},
+		{"seconds", "5", 5 * time.Second},
+		{"zero", "0", 0},
+		{"negative", "-1", defaultRetryAfter},
+		{"date", now.Add(3 * time.Second).Format(http.TimeFormat), 3 * time.Second},
+		{"past date", now.Add(-time.Minute).Format(http.TimeFormat), defaultRetryAfter},
+		{"garbage", "soon", defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: make(http.Header)}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			if got := retryAfter(resp, now); got != tt.want {
+				t.Errorf("retryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		at    []time.Duration // offsets from start of consecutive reservations
+		want  []time.Duration
+	}{
+		{
+			name: "burst",
+			rate: 1, burst: 3,
+			at:   []time.Duration{0, 0, 0, 0},
+			want: []time.Duration{0, 0, 0, time.Second},
+		},
+		{
+			name: "refill",
+			rate: 2, burst: 1,
+			at:   []time.Duration{0, 0, 500 * time.Millisecond},
+			want: []time.Duration{0, 500 * time.Millisecond, 0},
+		},
+		{
+			name: "refill is capped by burst",
+			rate: 1, burst: 2,
+			at:   []time.Duration{time.Hour, time.Hour, time.Hour},
+			want: []time.Duration{0, 0, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			b.last = start
+			for i, at := range tt.at {
+				if got := b.reserve(start.Add(at)); got != tt.want[i] {
+					t.Errorf("reservation %d: reserve() = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketPause(t *testing.T) {
+	b := newTokenBucket(1, 1)
+	b.Pause(time.Minute)
+	if d := b.reserve(time.Now()); d <= 0 || d > time.Minute {
+		t.Errorf("reserve() while paused = %v, want in (0, 1m]", d)
+	}
+	if d := b.reserve(time.Now().Add(2 * time.Minute)); d != 0 {
+		t.Errorf("reserve() after pause = %v, want 0", d)
+	}
+}
+
+func TestLimitedTransportRetriesTooManyRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		throttled     int32 // number of 429 responses before success
+		maxRetries    int
+		wantStatus    int
+		wantRequests  int32
+		wantThrottled uint64
+	}{
+		{"not throttled", 0, 2, http.StatusOK, 1, 0},
+		{"recovers", 2, 2, http.StatusOK, 3, 2},
+		{"exhausted", 5, 2, http.StatusTooManyRequests, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tt.throttled {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			}))
+			defer srv.Close()
+
+			stats := &Stats{}
+			c := limitClient(&http.Client{}, RateLimit{MaxRetries: tt.maxRetries, MaxConcurrent: 1}, stats)
+			resp, err := c.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", requests, tt.wantRequests)
+			}
+			if got := stats.Snapshot().Throttling.Throttled; got != tt.wantThrottled {
+				t.Errorf("throttled = %d, want %d", got, tt.wantThrottled)
+			}
+		})
+	}
+}
+
+func TestLimitedTransportReleasesSlotWhileWaiting(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttled" && atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	c := limitClient(&http.Client{}, RateLimit{MaxConcurrent: 1}, nil)
+
+	throttled := make(chan error, 1)
+	go func() {
+		resp, err := c.Get(srv.URL + "/throttled")
+		if err == nil {
+			resp.Body.Close()
+		}
+		throttled <- err
+	}()
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The throttled request waits for a second; with its slot held, this
+	// one would have to wait too.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/other", nil)
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("request while another waits to be retried: %v", err)
+	}
+	resp.Body.Close()
+	if err := <-throttled; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,445 @@
+package mozzle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bo0mer/ccv2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"golang.org/x/oauth2"
+)
+
+// A recording is a gzip compressed stream of gob encoded values. It starts
+// with a recordingHeader, followed by records in the order they occurred.
+
+// recordingHeader describes what was recorded.
+type recordingHeader struct {
+	API     string
+	Org     string
+	Space   string
+	Started time.Time
+}
+
+// record is a single recorded firehose envelope or Cloud Controller
+// response.
+type record struct {
+	// Offset is the time since the start of the recording.
+	Offset time.Duration
+
+	// AppGUID and Envelope, a protobuf encoded events.Envelope, are set
+	// for firehose records.
+	AppGUID  string
+	Envelope []byte
+
+	// Request, Status and Body are set for Cloud Controller records.
+	// Request identifies the request; see requestKey.
+	Request string
+	Status  int
+	Body    []byte
+}
+
+// Recorder records the firehose envelopes and the Cloud Controller
+// responses received by an AppMonitor, so that they can be replayed later
+// using a Replay. Set it as Target.Recorder to record a monitor created by
+// NewMonitor.
+//
+// Recorder is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex // guards
+	w       io.WriteCloser
+	gz      *gzip.Writer
+	enc     *gob.Encoder
+	started time.Time
+	err     error
+}
+
+// NewRecorder returns a recorder that writes to w. Closing the recorder
+// closes w.
+func NewRecorder(w io.WriteCloser) *Recorder {
+	gz := gzip.NewWriter(w)
+	return &Recorder{w: w, gz: gz, enc: gob.NewEncoder(gz)}
+}
+
+// CreateRecording creates the file at path, truncating it if it exists,
+// and returns a recorder that writes to it.
+func CreateRecording(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+// Close flushes the recording and closes the underlying writer. It returns
+// the first error encountered while recording, if any.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.gz.Close(); r.err == nil {
+		r.err = err
+	}
+	if err := r.w.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// begin writes the recording header. It must be called once, before any
+// other records are written.
+func (r *Recorder) begin(api, org, space string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = time.Now()
+	r.encode(recordingHeader{API: api, Org: org, Space: space, Started: r.started})
+}
+
+func (r *Recorder) write(rec record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec.Offset = time.Since(r.started)
+	r.encode(rec)
+}
+
+// encode encodes v, unless a previous write has failed. It must be called
+// with the mutex held.
+func (r *Recorder) encode(v interface{}) {
+	if r.err == nil {
+		r.err = r.enc.Encode(v)
+	}
+}
+
+// firehose returns a Firehose that records the envelopes streamed by f.
+func (r *Recorder) firehose(f Firehose) Firehose {
+	return &recordingFirehose{Firehose: f, recorder: r}
+}
+
+// client returns a copy of c that records the responses to GET requests.
+func (r *Recorder) client(c *http.Client) *http.Client {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cpy := *c
+	cpy.Transport = &recordingTransport{base: base, recorder: r}
+	return &cpy
+}
+
+type recordingFirehose struct {
+	Firehose
+	recorder *Recorder
+}
+
+func (f *recordingFirehose) Stream(appGUID string, authToken string) (<-chan *events.Envelope, <-chan error) {
+	in, errs := f.Firehose.Stream(appGUID, authToken)
+	out := make(chan *events.Envelope)
+	go func() {
+		defer close(out)
+		for env := range in {
+			if data, err := env.Marshal(); err == nil {
+				f.recorder.write(record{AppGUID: appGUID, Envelope: data})
+			}
+			out <- env
+		}
+	}()
+	return out, errs
+}
+
+// Close closes the underlying Firehose, if it implements io.Closer.
+func (f *recordingFirehose) Close() error {
+	if c, ok := f.Firehose.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type recordingTransport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.recorder.write(record{Request: requestKey(req), Status: resp.StatusCode, Body: redactEnvironment(body)})
+	return resp, nil
+}
+
+// redactEnvironment removes the variables other than the application
+// settings from the environment_json fields of a JSON response, as they
+// usually hold credentials.
+func redactEnvironment(body []byte) []byte {
+	if !bytes.Contains(body, []byte(`"environment_json"`)) {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		// Rather record nothing than the credentials.
+		return nil
+	}
+	redactValue(v)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func redactValue(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if env, ok := val.(map[string]interface{}); ok && k == "environment_json" {
+				for name := range env {
+					if envSettingKey(name) == "" {
+						delete(env, name)
+					}
+				}
+				continue
+			}
+			redactValue(val)
+		}
+	case []interface{}:
+		for _, val := range v {
+			redactValue(val)
+		}
+	}
+}
+
+// requestKey identifies a Cloud Controller request in a recording. The
+// timestamp filters of the q query parameter are left out, as they differ
+// between the recording and the replay, while the other filters, e.g.
+// actee:<guid>, are kept.
+func requestKey(req *http.Request) string {
+	q := req.URL.Query()
+	var filters []string
+	for _, v := range q["q"] {
+		for _, f := range strings.Split(v, ";") {
+			if f != "" && !strings.HasPrefix(f, "timestamp") {
+				filters = append(filters, f)
+			}
+		}
+	}
+	sort.Strings(filters)
+	q.Del("q")
+	if len(filters) > 0 {
+		q["q"] = filters
+	}
+	key := req.Method + " " + req.URL.Path
+	if len(q) > 0 {
+		key += "?" + q.Encode()
+	}
+	return key
+}
+
+// Replay replays a recording made by a Recorder. Its clock starts when it
+// is opened and runs Speed times faster than the recording's.
+//
+// Envelopes are streamed at the time they were recorded. Cloud Controller
+// requests are answered with the last response to the same request
+// recorded up to the current time, or the first one, if there is none yet.
+type Replay struct {
+	// API, Org and Space are the recorded target.
+	API   string
+	Org   string
+	Space string
+	// Speed is the replay speed factor.
+	Speed float64
+
+	envelopes map[string][]record
+	responses map[string][]record
+	length    time.Duration
+	started   time.Time
+	done      chan struct{}
+	doneOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// OpenReplay reads the recording at path and starts replaying it at the
+// given speed, e.g. 1 for real time or 10 for ten times faster.
+func OpenReplay(path string, speed float64) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplay(f, speed)
+}
+
+// NewReplay reads a recording from rd and starts replaying it at the given
+// speed.
+func NewReplay(rd io.Reader, speed float64) (*Replay, error) {
+	if speed <= 0 {
+		return nil, errors.New("replay speed must be positive")
+	}
+	gz, err := gzip.NewReader(rd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording: %v", err)
+	}
+	dec := gob.NewDecoder(gz)
+	var header recordingHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("error reading recording header: %v", err)
+	}
+	r := &Replay{
+		API:       header.API,
+		Org:       header.Org,
+		Space:     header.Space,
+		Speed:     speed,
+		envelopes: make(map[string][]record),
+		responses: make(map[string][]record),
+		done:      make(chan struct{}),
+	}
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading recording: %v", err)
+		}
+		if rec.AppGUID != "" {
+			r.envelopes[rec.AppGUID] = append(r.envelopes[rec.AppGUID], rec)
+		} else {
+			r.responses[rec.Request] = append(r.responses[rec.Request], rec)
+		}
+		if rec.Offset > r.length {
+			r.length = rec.Offset
+		}
+	}
+	r.started = time.Now()
+	return r, nil
+}
+
+// Done returns a channel that is closed once the whole recording has been
+// replayed, or the replay is closed.
+func (r *Replay) Done() <-chan struct{} {
+	r.doneOnce.Do(func() {
+		time.AfterFunc(r.at(r.length), r.Close)
+	})
+	return r.done
+}
+
+// Close stops the replay.
+func (r *Replay) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// at returns the time until the replay reaches offset.
+func (r *Replay) at(offset time.Duration) time.Duration {
+	return time.Duration(float64(offset)/r.Speed) - time.Since(r.started)
+}
+
+// now returns the current offset in the recording.
+func (r *Replay) now() time.Duration {
+	return time.Duration(float64(time.Since(r.started)) * r.Speed)
+}
+
+// Monitor returns an AppMonitor that monitors the recorded target using
+// the replayed data, configured as specified by t. The credentials and the
+// target in t are ignored. The refresh interval is shortened according to
+// the replay speed.
+func (r *Replay) Monitor(t Target, e Emitter) (*AppMonitor, error) {
+	u, err := url.Parse(r.API)
+	if err != nil {
+		return nil, err
+	}
+	if t.RefreshInterval == 0 {
+		t.RefreshInterval = DefaultRefreshInterval
+	}
+	t.RefreshInterval = time.Duration(float64(t.RefreshInterval) / r.Speed)
+	cc := &ccv2.Client{
+		API:        u,
+		HTTPClient: &http.Client{Transport: replayTransport{r}},
+	}
+	uaa := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "replay", TokenType: "bearer"})
+	return newAppMonitor(t, cc, replayFirehose{r}, uaa, e), nil
+}
+
+type replayFirehose struct {
+	replay *Replay
+}
+
+func (f replayFirehose) Stream(appGUID string, authToken string) (<-chan *events.Envelope, <-chan error) {
+	out := make(chan *events.Envelope)
+	go func() {
+		// Start with the envelopes recorded from now on, as the app is
+		// likely discovered late in the replay.
+		recs := f.replay.envelopes[appGUID]
+		now := f.replay.now()
+		i := sort.Search(len(recs), func(i int) bool { return recs[i].Offset >= now })
+		for _, rec := range recs[i:] {
+			timer := time.NewTimer(f.replay.at(rec.Offset))
+			select {
+			case <-timer.C:
+			case <-f.replay.done:
+				timer.Stop()
+				return
+			}
+			env := new(events.Envelope)
+			if err := env.Unmarshal(rec.Envelope); err != nil {
+				continue
+			}
+			select {
+			case out <- env:
+			case <-f.replay.done:
+				return
+			}
+		}
+	}()
+	return out, make(chan error)
+}
+
+type replayTransport struct {
+	replay *Replay
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	resp := &http.Response{
+		Status:     "404 Not Found",
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("{}"))),
+		Request:    req,
+	}
+	recs := t.replay.responses[requestKey(req)]
+	if len(recs) == 0 {
+		return resp, nil
+	}
+	now := t.replay.now()
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].Offset > now })
+	if i > 0 {
+		i--
+	}
+	rec := recs[i]
+	resp.StatusCode = rec.Status
+	resp.Status = fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(rec.Body))
+	return resp, nil
+}
@@ -0,0 +1,288 @@
+package mozzle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestRequestKey(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"path", "/v2/apps/a/summary", "GET /v2/apps/a/summary"},
+		{"query", "/v2/apps?results-per-page=1", "GET /v2/apps?results-per-page=1"},
+		{
+			"timestamp filter",
+			"/v2/events?q=timestamp>2020-01-01T00:00:00Z",
+			"GET /v2/events",
+		},
+		{
+			"timestamp and other filters",
+			"/v2/events?q=timestamp>2020-01-01T00:00:00Z%3Bactee:a&order-direction=asc",
+			"GET /v2/events?order-direction=asc&q=actee%3Aa",
+		},
+		{
+			"filters are sorted",
+			"/v2/events?q=type:audit.app.update&q=actee:a",
+			"GET /v2/events?q=actee%3Aa&q=type%3Aaudit.app.update",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://api.example.com"+tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requestKey(req); got != tt.want {
+				t.Errorf("requestKey(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactEnvironment(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want interface{} // decoded; nil if nothing is recorded
+	}{
+		{"no environment", `{"name":"app"}`, map[string]interface{}{"name": "app"}},
+		{
+			"environment",
+			`{"entity":{"environment_json":{"DB_PASSWORD":"secret","MOZZLE_APDEX_T":"500ms"}}}`,
+			map[string]interface{}{"entity": map[string]interface{}{
+				"environment_json": map[string]interface{}{"MOZZLE_APDEX_T": "500ms"},
+			}},
+		},
+		{
+			"list",
+			`{"resources":[{"entity":{"environment_json":{"TOKEN":"secret"}}}],"total_results":1}`,
+			map[string]interface{}{
+				"resources": []interface{}{map[string]interface{}{"entity": map[string]interface{}{
+					"environment_json": map[string]interface{}{},
+				}}},
+				"total_results": json.Number("1"),
+			},
+		},
+		{"invalid", `{"environment_json":{"TOKEN":`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := redactEnvironment([]byte(tt.body))
+			if tt.want == nil {
+				if data != nil {
+					t.Errorf("redactEnvironment() = %s, want nothing", data)
+				}
+				return
+			}
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			var got interface{}
+			if err := dec.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactEnvironment() = %s, want %v", data, tt.want)
+			}
+		})
+	}
+}
+
+// bufferCloser is a bytes.Buffer with a no-op Close.
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// staticFirehose streams the same envelopes for all applications.
+type staticFirehose []*events.Envelope
+
+func (f staticFirehose) Stream(appGUID string, authToken string) (<-chan *events.Envelope, <-chan error) {
+	out := make(chan *events.Envelope, len(f))
+	for _, env := range f {
+		out <- env
+	}
+	close(out)
+	return out, make(chan error)
+}
+
+// httpEnvelope returns an envelope of a server side HTTP event.
+func httpEnvelope(uri string, status int32, duration time.Duration) *events.Envelope {
+	return &events.Envelope{
+		Origin:        stringPtr("gorouter"),
+		EventType:     events.Envelope_HttpStartStop.Enum(),
+		HttpStartStop: httpEvent(uri, status, duration),
+	}
+}
+
+// httpEvent returns a server side HTTP event.
+func httpEvent(uri string, status int32, duration time.Duration) *events.HttpStartStop {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	stop := start + int64(duration)
+	return &events.HttpStartStop{
+		StartTimestamp: &start,
+		StopTimestamp:  &stop,
+		PeerType:       events.PeerType_Server.Enum(),
+		Method:         events.Method_GET.Enum(),
+		Uri:            &uri,
+		StatusCode:     &status,
+		ContentLength:  int64Ptr(100),
+	}
+}
+
+func stringPtr(s string) *string { return &s }
+func int64Ptr(n int64) *int64    { return &n }
+
+func TestRecordAndReplay(t *testing.T) {
+	const api = "https://api.example.com"
+	var recording bufferCloser
+	rec := NewRecorder(&recording)
+	rec.begin(api, "org", "space")
+	// Offset the records, so that the replay streams them after the test
+	// starts the firehose.
+	rec.started = time.Now().Add(-100 * time.Millisecond)
+
+	responses := map[string]string{
+		"/v2/apps/a/summary": `{"guid":"a","name":"app-a","state":"STARTED","running_instances":1,"instances":2}`,
+		"/v2/apps/a/env":     `{"environment_json":{"DB_PASSWORD":"secret"}}`,
+	}
+	cc := rec.client(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, ok := responses[req.URL.Path]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+	})})
+	for path := range responses {
+		resp, err := cc.Get(api + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	envs, _ := rec.firehose(staticFirehose{
+		httpEnvelope("https://app.example.com/", 200, 5*time.Millisecond),
+	}).Stream("a", "")
+	for range envs {
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewReplay(&recording, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	if replay.API != api || replay.Org != "org" || replay.Space != "space" {
+		t.Errorf("replay target = %s %s/%s, want %s org/space", replay.API, replay.Org, replay.Space, api)
+	}
+	var c collector
+	m, err := replay.Monitor(Target{}, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.init()
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.emitAppSummary(ctx, app); err != nil {
+		t.Fatal(err)
+	}
+	if ms := c.service("instance running_count"); len(ms) != 1 || ms[0].Metric != 1 {
+		t.Errorf("instance running_count = %+v, want 1 from the recorded summary", ms)
+	}
+	var env struct {
+		Environment map[string]string `json:"environment_json"`
+	}
+	if err := m.ccGet(ctx, "/v2/apps/a/env", nil, &env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Environment) != 0 {
+		t.Errorf("replayed environment = %v, want it redacted", env.Environment)
+	}
+	if err := m.ccGet(ctx, "/v2/apps/b/summary", nil, new(appSummary)); !isAppNotFound(err) {
+		t.Errorf("ccGet() of a request not recorded = %v, want 404", err)
+	}
+
+	go m.monitorFirehose(ctx, app, &c)
+	for len(c.service("http response time_ms")) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("recorded HTTP event not replayed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	ms := c.service("http response time_ms")
+	if len(ms) != 1 || ms[0].Metric != 5 || ms[0].ApplicationID != "a" {
+		t.Errorf("http response time_ms = %+v, want 5ms for app a", ms)
+	}
+	if m.Status()[0].LastEnvelope.IsZero() {
+		t.Error("replayed envelope not recorded in the status")
+	}
+}
+
+func TestNewReplayInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		speed float64
+	}{
+		{"zero speed", nil, 0},
+		{"not gzip", []byte("recording"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewReplay(bytes.NewReader(tt.data), tt.speed); err == nil {
+				t.Error("NewReplay() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestReplayMonitorRefreshInterval(t *testing.T) {
+	var recording bufferCloser
+	rec := NewRecorder(&recording)
+	rec.begin("https://api.example.com", "org", "space")
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := NewReplay(&recording, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	m, err := replay.Monitor(Target{RefreshInterval: time.Minute, AppDefaults: AppSettings{ApdexT: time.Second}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RefreshInterval != 6*time.Second {
+		t.Errorf("RefreshInterval = %v, want 6s", m.RefreshInterval)
+	}
+	if m.AppDefaults.ApdexT != time.Second {
+		t.Errorf("AppDefaults = %+v, want them taken from the target", m.AppDefaults)
+	}
+	if u, _ := url.Parse("https://api.example.com"); *m.CloudController.API != *u {
+		t.Errorf("API = %v, want %v", m.CloudController.API, u)
+	}
+}
@@ -0,0 +1,171 @@
+package mozzle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// RetryPolicy configures retrying of failed Cloud Controller and UAA calls.
+// Calls are retried with exponentially growing, jittered backoff, unless
+// they fail with a permanent error, such as 401, 403 or 404. Responses with
+// 429 Too Many Requests are retried by the HTTP transport instead, as
+// configured by RateLimit.MaxRetries, and not again by the policy.
+// The zero value disables retries.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the time waited before the first retry.
+	// Defaults to 500ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time waited between attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the backoff grows after each
+	// attempt. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction of the backoff that is randomized, in the
+	// range [0, 1]. Defaults to 0.2.
+	Jitter float64
+	// Budget, if positive, limits the number of retries per minute, shared
+	// between all calls, so that a failing system is not flooded with
+	// retries.
+	Budget int
+}
+
+// retrier retries calls according to a RetryPolicy.
+type retrier struct {
+	policy RetryPolicy
+	budget *tokenBucket // nil if unlimited
+	stats  *Stats
+}
+
+func newRetrier(p RetryPolicy, s *Stats) *retrier {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 500 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = 0.2
+	}
+	r := &retrier{policy: p, stats: s}
+	if p.Budget > 0 {
+		r.budget = newTokenBucket(float64(p.Budget)/60, p.Budget)
+		s.retryBudget(p.Budget)
+	}
+	return r
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, the attempts
+// or the retry budget are exhausted, or ctx is done. It returns the error
+// of the last call.
+func (r *retrier) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := r.policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || isPermanent(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= r.policy.MaxAttempts {
+			if attempt > 1 {
+				r.stats.retriesExhausted()
+			}
+			return err
+		}
+		if r.budget != nil {
+			ok := r.budget.reserve(time.Now()) == 0
+			r.stats.retryBudget(int(r.budget.available()))
+			if !ok {
+				r.stats.retryBudgetExhausted()
+				return err
+			}
+		}
+		r.stats.retried()
+		if serr := sleep(ctx, r.jittered(backoff)); serr != nil {
+			return err
+		}
+		backoff = time.Duration(float64(backoff) * r.policy.Multiplier)
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// maxDuration returns the longest time a call retried by Do may take, if
+// each attempt takes at most timeout.
+func (r *retrier) maxDuration(timeout time.Duration) time.Duration {
+	attempts := r.policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	total := time.Duration(attempts) * timeout
+	backoff := r.policy.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		total += backoff
+		backoff = time.Duration(float64(backoff) * r.policy.Multiplier)
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+	return total
+}
+
+// jittered returns d with its Jitter fraction randomized.
+func (r *retrier) jittered(d time.Duration) time.Duration {
+	fixed := time.Duration(float64(d) * (1 - r.policy.Jitter))
+	return fixed + jitter(d-fixed+1)
+}
+
+// isPermanent reports whether err is not worth retrying.
+func isPermanent(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	var rerr *ccv2.UnexpectedResponseError
+	if errors.As(err, &rerr) {
+		return isPermanentStatus(rerr.StatusCode)
+	}
+	var oerr *oauth2.RetrieveError
+	if errors.As(err, &oerr) && oerr.Response != nil {
+		return isPermanentStatus(oerr.Response.StatusCode)
+	}
+	return false
+}
+
+func isPermanentStatus(code int) bool {
+	switch code {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	case http.StatusTooManyRequests:
+		// The transport has already retried as long as allowed.
+		return true
+	}
+	return false
+}
+
+// retryTokenSource retries failed token acquisitions until ctx is done.
+type retryTokenSource struct {
+	ctx     context.Context
+	src     oauth2.TokenSource
+	retrier *retrier
+}
+
+func (r *retryTokenSource) Token() (*oauth2.Token, error) {
+	var token *oauth2.Token
+	err := r.retrier.Do(r.ctx, func(context.Context) error {
+		var err error
+		token, err = r.src.Token()
+		return err
+	})
+	return token, err
+}
@@ -0,0 +1,149 @@
+package mozzle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"generic", errors.New("connection reset"), false},
+		{"canceled", context.Canceled, true},
+		{"deadline", context.DeadlineExceeded, false},
+		{"wrapped canceled", fmt.Errorf("list apps: %w", context.Canceled), true},
+		{"cc 404", &ccv2.UnexpectedResponseError{StatusCode: http.StatusNotFound}, true},
+		{"cc 401", &ccv2.UnexpectedResponseError{StatusCode: http.StatusUnauthorized}, true},
+		{"cc 429", &ccv2.UnexpectedResponseError{StatusCode: http.StatusTooManyRequests}, true},
+		{"cc 500", &ccv2.UnexpectedResponseError{StatusCode: http.StatusInternalServerError}, false},
+		{"cc 503", &ccv2.UnexpectedResponseError{StatusCode: http.StatusServiceUnavailable}, false},
+		{"wrapped cc 403", fmt.Errorf("get app: %w", &ccv2.UnexpectedResponseError{StatusCode: http.StatusForbidden}), true},
+		{"uaa 401", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, true},
+		{"uaa 502", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadGateway}}, false},
+		{"uaa without response", &oauth2.RetrieveError{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPermanent(tt.err); got != tt.want {
+				t.Errorf("isPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrierDo(t *testing.T) {
+	temporary := errors.New("temporary")
+	permanent := &ccv2.UnexpectedResponseError{StatusCode: http.StatusNotFound}
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		errs         []error // returned by the consecutive calls; nil after
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", RetryPolicy{MaxAttempts: 3}, nil, 1, nil},
+		{"retries disabled", RetryPolicy{}, []error{temporary}, 1, temporary},
+		{"recovers", RetryPolicy{MaxAttempts: 3}, []error{temporary, temporary}, 3, nil},
+		{"exhausted", RetryPolicy{MaxAttempts: 3}, []error{temporary, temporary, temporary, temporary}, 3, temporary},
+		{"permanent", RetryPolicy{MaxAttempts: 3}, []error{permanent}, 1, permanent},
+		{"budget", RetryPolicy{MaxAttempts: 5, Budget: 1}, []error{temporary, temporary, temporary}, 2, temporary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.InitialBackoff = time.Microsecond
+			r := newRetrier(tt.policy, &Stats{})
+			attempts := 0
+			err := r.Do(context.Background(), func(context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("Do() = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetrierDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRetrier(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}, nil)
+	attempts := 0
+	err := r.Do(ctx, func(context.Context) error {
+		attempts++
+		cancel()
+		return errors.New("temporary")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Do() = %v after %d attempts, want an error after 1", err, attempts)
+	}
+}
+
+// tokenSourceFunc implements oauth2.TokenSource by calling itself.
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) { return f() }
+
+func TestRetryTokenSourceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	src := &retryTokenSource{
+		ctx: ctx,
+		src: tokenSourceFunc(func() (*oauth2.Token, error) {
+			attempts++
+			cancel()
+			return nil, errors.New("temporary")
+		}),
+		retrier: newRetrier(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}, nil),
+	}
+	if token, err := src.Token(); err == nil || attempts != 1 {
+		t.Errorf("Token() = %v, %v after %d attempts, want an error after 1", token, err, attempts)
+	}
+}
+
+func TestRetrierMaxDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"no retries", RetryPolicy{}, time.Second, time.Second},
+		{
+			"exponential",
+			RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Multiplier: 2},
+			time.Second,
+			3*time.Second + time.Second + 2*time.Second,
+		},
+		{
+			"capped",
+			RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 4},
+			0,
+			time.Second + 3*time.Second + 3*time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRetrier(tt.policy, nil)
+			if got := r.maxDuration(tt.timeout); got != tt.want {
+				t.Errorf("maxDuration(%v) = %v, want %v", tt.timeout, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package mozzle
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/amir/raidman"
@@ -10,26 +15,69 @@ import (
 // RiemannEmitter implements Emitter that interpretes metrics as Riemann events
 // and emits them to a Riemann instance.
 type RiemannEmitter struct {
+	// Stats, if not nil, collects metrics about the emitter's queue and
+	// connection. It should be set before calling Initialize.
+	Stats *Stats
+	// Logger is used for logging emission errors. It should be set before
+	// calling Initialize. Defaults to slog.Default().
+	Logger Logger
+	// Overflow is the policy applied when the queue is full. It should be
+	// set before calling Initialize. Defaults to DropNewest.
+	Overflow OverflowPolicy
+	// BlockTimeout is the maximum time Emit blocks with the Block policy.
+	// Defaults to one second.
+	BlockTimeout time.Duration
+	// SampleRates maps services to the fraction of their metrics that are
+	// emitted, e.g. 0.1 for every tenth metric on average. Services that
+	// are not present are not sampled. It should not be modified after
+	// calling Initialize.
+	SampleRates map[string]float64
+
 	client    *riemann
 	eventTTL  float32
-	events    chan *raidman.Event
+	events    *eventQueue
+	flushes   chan flushRequest
 	done      chan struct{}
-	connected bool
+	closeOnce sync.Once
+	connected int32 // accessed atomically
+}
+
+// flushRequest asks the emit loop to send all queued events.
+type flushRequest struct {
+	ctx  context.Context
+	done chan error
 }
 
+// reconnectInterval is the time waited between connection attempts while
+// flushing.
+const reconnectInterval = time.Second
+
+var errEmitterClosed = errors.New("riemann: emitter closed")
+
 // Initialize prepares for emitting to Riemann.
 // It should be called only once, before using the emitter.
 //
 // Known networks are "tcp", "tcp4", "tcp6", "udp", "udp4" and "udp6".
 // The queueSize argument specifies how many events will be kept in-memory
-// if there is problem with emission.
+// if there is problem with emission. Once they are more, the Overflow policy
+// applies.
 func (r *RiemannEmitter) Initialize(network, addr string, ttl float32, queueSize int) {
+	if r.Logger == nil {
+		r.Logger = slog.Default()
+	}
 	r.client = &riemann{
 		network: network,
 		addr:    addr,
 	}
 	r.eventTTL = ttl
-	r.events = make(chan *raidman.Event, queueSize)
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	if r.BlockTimeout <= 0 {
+		r.BlockTimeout = time.Second
+	}
+	r.events = newEventQueue(queueSize, r.Overflow, r.BlockTimeout)
+	r.flushes = make(chan flushRequest)
 	r.done = make(chan struct{})
 
 	go r.emitLoop()
@@ -37,19 +85,61 @@ func (r *RiemannEmitter) Initialize(network, addr string, ttl float32, queueSize
 
 // Close renders the emitter unusable and frees all allocated resources.
 // The emitter should not be used after it has been closed.
-// There is no guarantee that any queued events will be sent before closing.
+// There is no guarantee that any queued events will be sent before closing;
+// use Shutdown for that.
+// Closing an emitter more than once, e.g. after Shutdown, has no effect.
 // This particular close never fails.
 func (r *RiemannEmitter) Close() error {
-	close(r.done)
+	r.closeOnce.Do(func() { close(r.done) })
 	return nil
 }
 
+// Flush sends all queued events to Riemann, reconnecting if necessary.
+// It blocks until the queue is drained or ctx is done.
+func (r *RiemannEmitter) Flush(ctx context.Context) error {
+	req := flushRequest{ctx: ctx, done: make(chan error, 1)}
+	select {
+	case r.flushes <- req:
+	case <-r.done:
+		return errEmitterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown flushes the queued events and closes the emitter. If ctx is done
+// before all events are sent, the remaining ones are discarded.
+func (r *RiemannEmitter) Shutdown(ctx context.Context) error {
+	err := r.Flush(ctx)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Connected reports whether the emitter is currently connected to Riemann.
+func (r *RiemannEmitter) Connected() bool {
+	return atomic.LoadInt32(&r.connected) == 1
+}
+
 // Emit constructs a riemann event from the specified metric and emits it to
-// Riemann. It is non-blocking and  safe for concurrent use by multiple goroutines.
+// Riemann. It is safe for concurrent use by multiple goroutines, and blocks
+// only with the Block overflow policy.
 //
 // Emit must be used only after calling Initialize, and not after calling
 // Shutdown.
 func (r *RiemannEmitter) Emit(m Metric) {
+	if rate, ok := r.SampleRates[m.Service]; ok && rand.Float64() >= rate {
+		r.Stats.riemannSampledOut()
+		return
+	}
+
 	e := &raidman.Event{}
 	e.Ttl = r.eventTTL
 
@@ -61,6 +151,8 @@ func (r *RiemannEmitter) Emit(m Metric) {
 	e.Service = m.Service
 	e.Metric = m.Metric
 	e.State = m.State
+	e.Description = m.Description
+	e.Tags = m.Tags
 	// Since we're modifying the map, we need a copy.
 	e.Attributes = copyMap(m.Attributes)
 	if e.Attributes == nil {
@@ -71,39 +163,99 @@ func (r *RiemannEmitter) Emit(m Metric) {
 	e.Attributes["org"] = m.Organization
 	e.Attributes["space"] = m.Space
 
-	select {
-	case r.events <- e:
-	default:
-		log.Printf("riemann: queue full, dropping events\n")
+	dropped := r.events.Push(e, lowPriority(m))
+	r.Stats.riemannQueued(r.events.Len())
+	if dropped != nil {
+		r.Stats.riemannDrop(dropped.Service)
+		r.Logger.Debug("queue full, dropping event", "sink", "riemann", "policy", r.Overflow, "service", dropped.Service)
 	}
 }
 
 func (r *RiemannEmitter) emitLoop() {
-	r.connected = false
+	// Connect eagerly, so that Connected reflects reality before the
+	// first event is sent.
+	r.connect()
 	for {
 		select {
-		case e := <-r.events:
-			if !r.connected {
-				if err := r.client.Connect(); err != nil {
-					log.Printf("riemann: error connecting: %v\n", err)
-					continue
+		case <-r.events.Ready():
+			// Send a single event at a time, so that flushes and closing
+			// are not delayed by a long queue.
+			if e := r.events.Pop(); e != nil {
+				r.Stats.riemannQueued(r.events.Len())
+				// Events that cannot be sent are dropped, so that the
+				// queue keeps moving while Riemann is unavailable.
+				if !r.send(e) {
+					r.Stats.riemannDrop(e.Service)
 				}
-				r.connected = true
 			}
-
-			if err := r.client.SendEvent(e); err != nil {
-				log.Printf("riemann: error sending event: %v\n", err)
-				if cerr := r.client.Close(); cerr != nil {
-					log.Printf("riemann: error closing conn: %v\n", cerr)
-				}
-				r.connected = false
+			if r.events.Len() > 0 {
+				signal(r.events.ready)
 			}
+		case req := <-r.flushes:
+			req.done <- r.drain(req.ctx)
 		case <-r.done:
+			if r.Connected() {
+				r.disconnect()
+			}
 			return
 		}
 	}
 }
 
+// drain sends the events queued so far. Unlike the emit loop, it retries
+// sending each event until it succeeds or ctx is done.
+func (r *RiemannEmitter) drain(ctx context.Context) error {
+	for n := r.events.Len(); n > 0; n-- {
+		e := r.events.Pop()
+		if e == nil {
+			break
+		}
+		r.Stats.riemannQueued(r.events.Len())
+		for !r.send(e) {
+			if err := sleep(ctx, reconnectInterval); err != nil {
+				r.Stats.riemannDrop(e.Service)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send sends e, connecting first if necessary, and reports whether it
+// succeeded.
+func (r *RiemannEmitter) send(e *raidman.Event) bool {
+	if !r.Connected() && !r.connect() {
+		return false
+	}
+	start := time.Now()
+	err := r.client.SendEvent(e)
+	r.Stats.riemannSend(time.Since(start), err)
+	if err != nil {
+		r.Logger.Error("error sending event", "sink", "riemann", "error", err)
+		r.disconnect()
+		return false
+	}
+	return true
+}
+
+func (r *RiemannEmitter) disconnect() {
+	if err := r.client.Close(); err != nil {
+		r.Logger.Error("error closing connection", "sink", "riemann", "error", err)
+	}
+	atomic.StoreInt32(&r.connected, 0)
+}
+
+// connect connects to Riemann and reports whether it succeeded.
+func (r *RiemannEmitter) connect() bool {
+	if err := r.client.Connect(); err != nil {
+		r.Logger.Error("error connecting", "sink", "riemann", "addr", r.client.addr, "error", err)
+		return false
+	}
+	atomic.StoreInt32(&r.connected, 1)
+	r.Stats.riemannConnected()
+	return true
+}
+
 type riemann struct {
 	network string
 	addr    string
@@ -0,0 +1,138 @@
+package mozzle
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amir/raidman"
+)
+
+func TestRiemannEmitterClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(r *RiemannEmitter) error
+	}{
+		{"close", (*RiemannEmitter).Close},
+		{"shutdown", func(r *RiemannEmitter) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r.Shutdown(ctx)
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RiemannEmitter{}
+			r.Initialize("tcp", "127.0.0.1:0", 30, 10)
+			if err := tt.close(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("second Close() = %v, want nil", err)
+			}
+			if err := r.Flush(context.Background()); err != errEmitterClosed {
+				t.Errorf("Flush() after Close() = %v, want %v", err, errEmitterClosed)
+			}
+		})
+	}
+}
+
+func TestRiemannEmitterSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		rates       map[string]float64
+		wantSampled uint64
+	}{
+		{"not sampled", nil, 0},
+		{"other service", map[string]float64{"other": 0}, 0},
+		{"all emitted", map[string]float64{"http response time_ms": 1}, 0},
+		{"none emitted", map[string]float64{"http response time_ms": 0}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &Stats{}
+			r := &RiemannEmitter{Stats: stats, SampleRates: tt.rates}
+			r.Initialize("tcp", "127.0.0.1:0", 30, 100)
+			defer r.Close()
+			for i := 0; i < 10; i++ {
+				r.Emit(Metric{Service: "http response time_ms"})
+			}
+			if got := stats.Snapshot().Riemann.SampledOut; got != tt.wantSampled {
+				t.Errorf("sampled out = %d, want %d", got, tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestRiemannEmitterSendFailure(t *testing.T) {
+	// A closed listener leaves an address that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stats := &Stats{}
+	r := &RiemannEmitter{Stats: stats}
+	r.Initialize("tcp", addr, 30, 100)
+	defer r.Close()
+	services := []string{"a", "b", "a"}
+	for _, service := range services {
+		r.Emit(Metric{Service: service})
+	}
+
+	want := map[string]uint64{"a": 2, "b": 1}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap := stats.Snapshot().Riemann
+		if reflect.DeepEqual(snap.DroppedByService, want) {
+			if snap.Dropped != uint64(len(services)) {
+				t.Errorf("dropped = %d, want %d", snap.Dropped, len(services))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dropped by service = %v, want %v", snap.DroppedByService, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+func TestRiemannEmitterDrainFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// The emit loop is not started, so that only drain sends the events.
+	stats := &Stats{}
+	r := &RiemannEmitter{
+		Stats:  stats,
+		Logger: slog.Default(),
+		client: &riemann{network: "tcp", addr: addr},
+		events: newEventQueue(10, DropNewest, time.Second),
+	}
+	r.events.Push(&raidman.Event{Service: "a"}, false)
+	r.events.Push(&raidman.Event{Service: "b"}, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.drain(ctx); err == nil {
+		t.Fatal("drain() to a refusing address succeeded")
+	}
+	// Only the event being sent is given up on; the rest stay queued.
+	snap := stats.Snapshot().Riemann
+	if want := map[string]uint64{"a": 1}; !reflect.DeepEqual(snap.DroppedByService, want) {
+		t.Errorf("dropped by service = %v, want %v", snap.DroppedByService, want)
+	}
+	if r.events.Len() != 1 {
+		t.Errorf("queue length = %d, want 1", r.events.Len())
+	}
+}
@@ -0,0 +1,227 @@
+package mozzle
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// appRoutes describes the routes mapped to an application.
+type appRoutes struct {
+	Routes []string
+	App    application
+}
+
+func (r appRoutes) EmitTo(e Emitter) {
+	e.Emit(forApp(r.App, Metric{
+		Service:    "app routes_count",
+		Metric:     len(r.Routes),
+		State:      "ok",
+		Attributes: attributes(r.App),
+	}))
+}
+
+// routeMappingEvent describes a route being mapped to or unmapped from an
+// application, as noticed when polling the routes.
+type routeMappingEvent struct {
+	Route  string
+	Mapped bool
+	App    application
+}
+
+func (r routeMappingEvent) EmitTo(e Emitter) {
+	attributes := attributes(r.App)
+	attributes["route"] = r.Route
+	attributes["event"] = "route.unmapped"
+	state := "warn"
+	if r.Mapped {
+		attributes["event"] = "route.mapped"
+		state = "ok"
+	}
+	e.Emit(forApp(r.App, Metric{
+		Service:    "route mapping event",
+		Metric:     1,
+		State:      state,
+		Attributes: attributes,
+	}))
+}
+
+// orphanRoutes describes the routes in a space that are not mapped to any
+// application.
+type orphanRoutes struct {
+	Routes []string
+	Org    string
+	Space  string
+}
+
+func (r orphanRoutes) EmitTo(e Emitter) {
+	attributes := map[string]string{
+		"org":   r.Org,
+		"space": r.Space,
+	}
+	if len(r.Routes) > 0 {
+		attributes["routes"] = joinSorted(r.Routes)
+	}
+	e.Emit(Metric{
+		Organization: r.Org,
+		Space:        r.Space,
+		Service:      "space orphan_routes_count",
+		Metric:       len(r.Routes),
+		State:        "ok",
+		Attributes:   attributes,
+	})
+}
+
+// emitRoutes emits the number of routes mapped to each application and the
+// changes of the mappings since the previous poll, as well as the routes in
+// the space that are not mapped to any application. The routes of each
+// application are attached to its metrics, if Enrich selects them.
+func (m *AppMonitor) emitRoutes(ctx context.Context, s ccv2.Space, summary spaceSummary, org, space string) {
+	mapped := make(map[string]bool)
+	for _, app := range summary.Apps {
+		var routes []string
+		for _, r := range app.Routes {
+			mapped[r.GUID] = true
+			routes = append(routes, routeURL(r.Host, r.Domain.Name, r.Path))
+		}
+		sort.Strings(routes)
+		if contains(m.Enrich, "routes") {
+			m.metadata(app.GUID).set("routes", strings.Join(routes, ","))
+		}
+
+		m.mu.Lock()
+		status, monitored := m.monitored[app.GUID]
+		previous, seen := m.routes[app.GUID]
+		m.routes[app.GUID] = routes
+		m.mu.Unlock()
+		// Only the monitored applications are emitted, so that each one is
+		// emitted by its owner when sharding.
+		if !monitored {
+			continue
+		}
+		appRoutes{routes, status.application}.EmitTo(m.emitter)
+		if !seen {
+			continue
+		}
+		for _, r := range diff(routes, previous) {
+			routeMappingEvent{r, true, status.application}.EmitTo(m.emitter)
+		}
+		for _, r := range diff(previous, routes) {
+			routeMappingEvent{r, false, status.application}.EmitTo(m.emitter)
+		}
+	}
+
+	// When sharding, the owner of the space emits its orphan routes.
+	if m.Sharder != nil && !m.Sharder.Owns(s.GUID) {
+		return
+	}
+	var routes []route
+	if err := m.ccList(ctx, "/v2/spaces/"+s.GUID+"/routes", nil, &routes); err != nil {
+		m.Logger.Error("error fetching routes", "org", org, "space", space, "space_guid", s.GUID, "error", err)
+		return
+	}
+	var orphans []string
+	for _, r := range routes {
+		if mapped[r.Metadata.GUID] {
+			continue
+		}
+		orphans = append(orphans, routeURL(r.Entity.Host, m.domainName(ctx, r.Entity.DomainGUID), r.Entity.Path))
+	}
+	orphanRoutes{orphans, org, space}.EmitTo(m.emitter)
+}
+
+// domainName returns the name of the domain with the given GUID. Names are
+// cached, as domains rarely change. If the name cannot be fetched, the GUID
+// is returned.
+func (m *AppMonitor) domainName(ctx context.Context, guid string) string {
+	m.mu.Lock()
+	name, ok := m.domains[guid]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+	var domain struct {
+		Entity struct {
+			Name string `json:"name"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/domains/"+guid, nil, &domain); err != nil {
+		m.Logger.Warn("error fetching domain", "domain_guid", guid, "error", err)
+		return guid
+	}
+	m.mu.Lock()
+	m.domains[guid] = domain.Entity.Name
+	m.mu.Unlock()
+	return domain.Entity.Name
+}
+
+// routeURL returns the address of a route, e.g. "www.example.com/shop".
+func routeURL(host, domain, path string) string {
+	if host == "" {
+		return domain + path
+	}
+	return host + "." + domain + path
+}
+
+// requestHost returns the host name of an HTTP request URI, as reported by
+// the router - either an absolute URL or a host followed by a path.
+func requestHost(uri string) string {
+	u, err := parseRequestURI(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func parseRequestURI(uri string) (*url.URL, error) {
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + uri
+	}
+	return url.Parse(uri)
+}
+
+// matchRoute returns the route, out of routes as returned by routeURL, that
+// the router matched for the request URI - the one with its host and the
+// longest path that is a prefix of its path. If no route matches, the host
+// of the request is returned.
+func matchRoute(routes []string, uri string) string {
+	u, err := parseRequestURI(uri)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	match := host
+	matchPath := -1
+	for _, r := range routes {
+		path := ""
+		if i := strings.IndexByte(r, '/'); i >= 0 {
+			r, path = r[:i], r[i:]
+		}
+		if !strings.EqualFold(r, host) || len(path) <= matchPath {
+			continue
+		}
+		if path == "" || u.Path == path || strings.HasPrefix(u.Path, path+"/") {
+			match = host + path
+			matchPath = len(path)
+		}
+	}
+	return match
+}
+
+// diff returns the elements of a that are not in b.
+func diff(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, v := range b {
+		in[v] = true
+	}
+	var res []string
+	for _, v := range a {
+		if !in[v] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
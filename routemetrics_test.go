@@ -0,0 +1,206 @@
+package mozzle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// fakeCC implements http.RoundTripper that answers Cloud Controller
+// requests with JSON responses by path, and 404 for unknown paths.
+type fakeCC struct {
+	mu        sync.Mutex
+	responses map[string]string
+	requests  map[string]int
+}
+
+func (f *fakeCC) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.requests == nil {
+		f.requests = make(map[string]int)
+	}
+	f.requests[req.URL.Path]++
+	status, body := http.StatusOK, f.responses[req.URL.Path]
+	if body == "" {
+		status, body = http.StatusNotFound, "{}"
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeCC) set(path, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.responses == nil {
+		f.responses = make(map[string]string)
+	}
+	f.responses[path] = body
+}
+
+func (f *fakeCC) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+// newTestMonitor returns an initialized monitor, configured as specified by
+// t, that uses cc as the Cloud Controller and emits to the returned
+// collector.
+func newTestMonitor(t Target, cc *fakeCC) (*AppMonitor, *collector) {
+	api, _ := url.Parse("https://api.example.com")
+	client := &ccv2.Client{API: api, HTTPClient: &http.Client{Transport: cc}}
+	uaa := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", TokenType: "bearer"})
+	c := new(collector)
+	m := newAppMonitor(t, client, nil, uaa, c)
+	m.init()
+	return m, c
+}
+
+func TestRouteURL(t *testing.T) {
+	tests := []struct {
+		host, domain, path string
+		want               string
+	}{
+		{"www", "example.com", "", "www.example.com"},
+		{"www", "example.com", "/shop", "www.example.com/shop"},
+		{"", "example.com", "", "example.com"},
+		{"", "example.com", "/shop", "example.com/shop"},
+	}
+	for _, tt := range tests {
+		if got := routeURL(tt.host, tt.domain, tt.path); got != tt.want {
+			t.Errorf("routeURL(%q, %q, %q) = %q, want %q", tt.host, tt.domain, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"https://www.example.com/shop?q=1", "www.example.com"},
+		{"http://www.example.com:8080/", "www.example.com"},
+		{"www.example.com/shop", "www.example.com"},
+		{"www.example.com", "www.example.com"},
+		{"", ""},
+		{"http://[::1", ""},
+	}
+	for _, tt := range tests {
+		if got := requestHost(tt.uri); got != tt.want {
+			t.Errorf("requestHost(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, nil, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"b", "c"}, []string{"a"}},
+		{[]string{"a"}, []string{"a"}, nil},
+	}
+	for _, tt := range tests {
+		if got := diff(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diff(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEmitRoutes(t *testing.T) {
+	cc := new(fakeCC)
+	cc.set("/v2/spaces/s/routes", `{"resources":[
+		{"metadata":{"guid":"r1"},"entity":{"host":"www","domain_guid":"d"}},
+		{"metadata":{"guid":"r3"},"entity":{"host":"old","path":"/api","domain_guid":"d"}}]}`)
+	cc.set("/v2/domains/d", `{"entity":{"name":"example.com"}}`)
+	m, c := newTestMonitor(Target{Enrich: []string{"routes"}}, cc)
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app}
+	var space ccv2.Space
+	space.GUID = "s"
+
+	poll := func(summary string) {
+		var s spaceSummary
+		if err := json.Unmarshal([]byte(summary), &s); err != nil {
+			t.Fatal(err)
+		}
+		c.metrics = nil
+		m.emitRoutes(context.Background(), space, s, "org", "space")
+	}
+	poll(`{"apps":[
+		{"guid":"a","routes":[{"guid":"r1","host":"www","domain":{"name":"example.com"}}]},
+		{"guid":"b","routes":[{"guid":"r2","host":"b","domain":{"name":"example.com"}}]}]}`)
+	if ms := c.service("app routes_count"); len(ms) != 1 || ms[0].Metric != 1 || ms[0].ApplicationID != "a" {
+		t.Errorf("app routes_count = %+v, want 1 for the monitored app only", ms)
+	}
+	if ms := c.service("route mapping event"); len(ms) != 0 {
+		t.Errorf("route mapping events on the first poll = %+v, want none", ms)
+	}
+	orphans := c.service("space orphan_routes_count")
+	if len(orphans) != 1 || orphans[0].Metric != 1 || orphans[0].Attributes["routes"] != "old.example.com/api" {
+		t.Errorf("space orphan_routes_count = %+v, want old.example.com/api", orphans)
+	}
+	attrs := make(map[string]string)
+	m.metadata("a").addTo(attrs)
+	if attrs["routes"] != "www.example.com" {
+		t.Errorf("routes attribute = %q, want www.example.com", attrs["routes"])
+	}
+
+	poll(`{"apps":[{"guid":"a","routes":[
+		{"guid":"r3","host":"old","path":"/api","domain":{"name":"example.com"}},
+		{"guid":"r4","host":"new","domain":{"name":"example.com"}}]}]}`)
+	var events []string
+	for _, e := range c.service("route mapping event") {
+		events = append(events, e.Attributes["event"]+" "+e.Attributes["route"]+" "+e.State)
+	}
+	sort.Strings(events)
+	want := []string{
+		"route.mapped new.example.com ok",
+		"route.mapped old.example.com/api ok",
+		"route.unmapped www.example.com warn",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("route mapping events = %v, want %v", events, want)
+	}
+	if n := cc.count("/v2/domains/d"); n != 1 {
+		t.Errorf("domain fetched %d times, want it cached", n)
+	}
+}
+
+func TestEmitRoutesNotEnriched(t *testing.T) {
+	m, _ := newTestMonitor(Target{Enrich: []string{"buildpack"}}, new(fakeCC))
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app}
+	var space ccv2.Space
+	space.GUID = "s"
+	var s spaceSummary
+	err := json.Unmarshal([]byte(`{"apps":[
+		{"guid":"a","routes":[{"guid":"r1","host":"www","domain":{"name":"example.com"}}]}]}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.emitRoutes(context.Background(), space, s, "org", "space")
+	attrs := make(map[string]string)
+	m.metadata("a").addTo(attrs)
+	if v, ok := attrs["routes"]; ok {
+		t.Errorf("routes attribute = %q, want none unless enriched", v)
+	}
+}
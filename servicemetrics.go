@@ -0,0 +1,123 @@
+package mozzle
+
+import (
+	"context"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+// serviceInstanceMetrics describes a service instance in a monitored space.
+type serviceInstanceMetrics struct {
+	serviceInstanceSummary
+	Broker string
+	Org    string
+	Space  string
+}
+
+func (s serviceInstanceMetrics) EmitTo(e Emitter) {
+	attributes := map[string]string{
+		"org":                 s.Org,
+		"space":               s.Space,
+		"service_instance":    s.Name,
+		"service_instance_id": s.GUID,
+	}
+	state := "ok"
+	failed := 0
+	if op := s.LastOperation; op != nil {
+		attributes["last_operation"] = op.Type
+		attributes["last_operation_state"] = op.State
+		switch op.State {
+		case "failed":
+			state = "critical"
+			failed = 1
+		case "in progress":
+			state = "warn"
+		}
+	}
+	if p := s.ServicePlan; p != nil {
+		attributes["plan"] = p.Name
+		attributes["service"] = p.Service.Label
+	} else {
+		attributes["service"] = "user-provided"
+	}
+	if s.Broker != "" {
+		attributes["broker"] = s.Broker
+	}
+
+	e.Emit(Metric{
+		Organization: s.Org,
+		Space:        s.Space,
+		Service:      "service instance bound_apps_count",
+		Metric:       s.BoundAppCount,
+		State:        state,
+		Attributes:   attributes,
+	})
+	e.Emit(Metric{
+		Organization: s.Org,
+		Space:        s.Space,
+		Service:      "service instance last_operation_failed",
+		Metric:       failed,
+		State:        state,
+		Attributes:   attributes,
+	})
+}
+
+// emitServices emits the metrics of the service instances in the space and
+// attaches the names of the services bound to each application to its
+// metrics.
+func (m *AppMonitor) emitServices(ctx context.Context, s ccv2.Space, summary spaceSummary, org, space string) {
+	for _, app := range summary.Apps {
+		m.metadata(app.GUID).set("services", joinSorted(app.ServiceNames))
+	}
+	// When sharding, the owner of the space emits its service instances.
+	if m.Sharder != nil && !m.Sharder.Owns(s.GUID) {
+		return
+	}
+	for _, si := range summary.Services {
+		var broker string
+		if si.ServicePlan != nil {
+			broker = m.brokerName(ctx, si.ServicePlan.Service.GUID)
+		}
+		serviceInstanceMetrics{si, broker, org, space}.EmitTo(m.emitter)
+	}
+}
+
+// brokerName returns the name of the broker of the service with the given
+// GUID, or an empty string, if it is not known. Names are cached, as
+// brokers rarely change.
+func (m *AppMonitor) brokerName(ctx context.Context, serviceGUID string) string {
+	m.mu.Lock()
+	name, ok := m.brokers[serviceGUID]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	var service struct {
+		Entity struct {
+			BrokerName string `json:"service_broker_name"`
+			BrokerGUID string `json:"service_broker_guid"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/services/"+serviceGUID, nil, &service); err != nil {
+		m.Logger.Warn("error fetching service", "service_guid", serviceGUID, "error", err)
+		return ""
+	}
+	name = service.Entity.BrokerName
+	if name == "" && service.Entity.BrokerGUID != "" {
+		var broker struct {
+			Entity struct {
+				Name string `json:"name"`
+			} `json:"entity"`
+		}
+		// Space developers may not see brokers, so do not log failures.
+		if err := m.ccGet(ctx, "/v2/service_brokers/"+service.Entity.BrokerGUID, nil, &broker); err == nil {
+			name = broker.Entity.Name
+		}
+	}
+
+	m.mu.Lock()
+	m.brokers[serviceGUID] = name
+	m.mu.Unlock()
+	return name
+}
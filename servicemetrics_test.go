@@ -0,0 +1,116 @@
+package mozzle
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Bo0mer/ccv2"
+)
+
+func TestEmitServices(t *testing.T) {
+	cc := new(fakeCC)
+	cc.set("/v2/services/mysql", `{"entity":{"service_broker_name":"mysql-broker"}}`)
+	cc.set("/v2/services/redis", `{"entity":{"service_broker_guid":"b"}}`)
+	cc.set("/v2/service_brokers/b", `{"entity":{"name":"redis-broker"}}`)
+	m, c := newTestMonitor(Target{}, cc)
+	var space ccv2.Space
+	space.GUID = "s"
+
+	var summary spaceSummary
+	err := json.Unmarshal([]byte(`{
+		"apps":[
+			{"guid":"a","service_names":["db","cache"]},
+			{"guid":"b","service_names":[]}],
+		"services":[
+			{"guid":"si1","name":"db","bound_app_count":1,
+			 "last_operation":{"type":"create","state":"succeeded"},
+			 "service_plan":{"name":"small","service":{"guid":"mysql","label":"p-mysql"}}},
+			{"guid":"si2","name":"cache","bound_app_count":1,
+			 "last_operation":{"type":"update","state":"in progress"},
+			 "service_plan":{"name":"large","service":{"guid":"redis","label":"p-redis"}}},
+			{"guid":"si3","name":"queue","bound_app_count":0,
+			 "last_operation":{"type":"create","state":"failed"},
+			 "service_plan":{"name":"small","service":{"guid":"unknown","label":"p-rabbitmq"}}},
+			{"guid":"si4","name":"creds","bound_app_count":2}]}`), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The broker names are cached across polls.
+	for i := 0; i < 2; i++ {
+		c.metrics = nil
+		m.emitServices(context.Background(), space, summary, "org", "space")
+	}
+
+	tests := []struct {
+		instance string
+		bound    int
+		failed   int
+		state    string
+		service  string
+		broker   string
+	}{
+		{"db", 1, 0, "ok", "p-mysql", "mysql-broker"},
+		{"cache", 1, 0, "warn", "p-redis", "redis-broker"},
+		{"queue", 0, 1, "critical", "p-rabbitmq", ""},
+		{"creds", 2, 0, "ok", "user-provided", ""},
+	}
+	bound := c.service("service instance bound_apps_count")
+	failed := c.service("service instance last_operation_failed")
+	if len(bound) != len(tests) || len(failed) != len(tests) {
+		t.Fatalf("emitted %d bound and %d failed metrics, want %d", len(bound), len(failed), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.instance, func(t *testing.T) {
+			b, f := bound[i], failed[i]
+			if b.Attributes["service_instance"] != tt.instance {
+				t.Fatalf("service instance = %q, want %q", b.Attributes["service_instance"], tt.instance)
+			}
+			if b.Metric != tt.bound || f.Metric != tt.failed {
+				t.Errorf("bound apps, failed = %v, %v, want %d, %d", b.Metric, f.Metric, tt.bound, tt.failed)
+			}
+			if b.State != tt.state || f.State != tt.state {
+				t.Errorf("states = %q, %q, want %q", b.State, f.State, tt.state)
+			}
+			if b.Attributes["service"] != tt.service || b.Attributes["broker"] != tt.broker {
+				t.Errorf("service, broker = %q, %q, want %q, %q", b.Attributes["service"], b.Attributes["broker"], tt.service, tt.broker)
+			}
+		})
+	}
+
+	// Services that could not be fetched are fetched again.
+	for guid, want := range map[string]int{"mysql": 1, "redis": 1, "unknown": 2} {
+		if n := cc.count("/v2/services/" + guid); n != want {
+			t.Errorf("service %s fetched %d times, want %d", guid, n, want)
+		}
+	}
+	for guid, want := range map[string]string{"a": "cache,db", "b": ""} {
+		attrs := make(map[string]string)
+		m.metadata(guid).addTo(attrs)
+		if attrs["services"] != want {
+			t.Errorf("services attribute of %s = %q, want %q", guid, attrs["services"], want)
+		}
+	}
+}
+
+func TestEmitServicesNotOwned(t *testing.T) {
+	m, c := newTestMonitor(Target{Sharder: ownerSharder{"a": true}}, new(fakeCC))
+	var space ccv2.Space
+	space.GUID = "s"
+	var summary spaceSummary
+	err := json.Unmarshal([]byte(`{
+		"apps":[{"guid":"a","service_names":["creds"]}],
+		"services":[{"guid":"si","name":"creds","bound_app_count":1}]}`), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.emitServices(context.Background(), space, summary, "org", "space")
+	if len(c.metrics) != 0 {
+		t.Errorf("emitted %+v by an instance not owning the space", c.metrics)
+	}
+	attrs := make(map[string]string)
+	m.metadata("a").addTo(attrs)
+	if attrs["services"] != "creds" {
+		t.Errorf("services attribute = %q, want it set regardless of the space owner", attrs["services"])
+	}
+}
@@ -0,0 +1,284 @@
+package mozzle
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AppSettings control how a single application is monitored. The defaults,
+// AppMonitor.AppDefaults, can be overridden by each application using the
+// labels and annotations of its v3 metadata, or its environment, e.g.
+//
+//	mozzle.io/enabled=false
+//	mozzle.io/http-aggregate=true
+//	mozzle.io/memory-warn=0.7
+//
+// In the environment, the keys can also be spelled as environment variables,
+// e.g. MOZZLE_MEMORY_WARN=0.7. Annotations take precedence over labels, which
+// take precedence over the environment.
+type AppSettings struct {
+	// Disabled stops the application from being monitored. Set it in the
+	// defaults for monitoring only the applications that opt in using
+	// mozzle.io/enabled=true.
+	Disabled bool
+	// HTTPAggregate selects emitting the HTTP metrics aggregated on every
+	// refresh, instead of for each request.
+	HTTPAggregate bool
+	// MemoryWarn and MemoryCritical are the used memory ratios of an
+	// instance above which its memory metrics are in warn or critical
+	// state. Zero values disable the respective state.
+	MemoryWarn     float64
+	MemoryCritical float64
+	// DiskWarn and DiskCritical are the used disk ratios of an instance
+	// above which its disk metrics are in warn or critical state. Zero
+	// values disable the respective state.
+	DiskWarn     float64
+	DiskCritical float64
+	// SLOs are the service level objectives of the application's HTTP
+	// requests. In the metadata or environment, they are given in the
+	// format accepted by ParseSLOs.
+	SLOs []SLO
+	// ApdexT is the Apdex threshold of the application's HTTP requests -
+	// the response time within which users are satisfied. Zero disables
+	// the Apdex score.
+	ApdexT time.Duration
+	// ApdexPerRoute selects computing the Apdex score per route, instead of
+	// for the whole application.
+	ApdexPerRoute bool
+}
+
+// settingsPrefix is the prefix of the keys of the application settings.
+const settingsPrefix = "mozzle.io/"
+
+// settingKeys are the keys of the application settings, without the prefix.
+var settingKeys = []string{
+	"enabled",
+	"http-aggregate",
+	"memory-warn",
+	"memory-critical",
+	"disk-warn",
+	"disk-critical",
+	"slo",
+	"apdex-t",
+	"apdex-per-route",
+}
+
+// set sets the setting with the given key, without the prefix, to value.
+func (s *AppSettings) set(key, value string) error {
+	switch key {
+	case "enabled":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.Disabled = !enabled
+		return nil
+	case "slo":
+		slos, err := ParseSLOs(value)
+		if err != nil {
+			return err
+		}
+		s.SLOs = slos
+		return nil
+	case "apdex-t":
+		t, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if t < 0 {
+			return fmt.Errorf("negative threshold")
+		}
+		s.ApdexT = t
+		return nil
+	case "apdex-per-route":
+		perRoute, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.ApdexPerRoute = perRoute
+		return nil
+	case "http-aggregate":
+		aggregate, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.HTTPAggregate = aggregate
+		return nil
+	}
+
+	var threshold *float64
+	switch key {
+	case "memory-warn":
+		threshold = &s.MemoryWarn
+	case "memory-critical":
+		threshold = &s.MemoryCritical
+	case "disk-warn":
+		threshold = &s.DiskWarn
+	case "disk-critical":
+		threshold = &s.DiskCritical
+	default:
+		return fmt.Errorf("unknown setting")
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v < 0 || v > 1 {
+		return fmt.Errorf("invalid ratio; must be between 0 and 1")
+	}
+	*threshold = v
+	return nil
+}
+
+// observesHTTP reports whether the settings need the HTTP events of the
+// application to be observed.
+func (s AppSettings) observesHTTP() bool {
+	return s.HTTPAggregate || len(s.SLOs) > 0 || s.ApdexT > 0
+}
+
+// updateHTTPObserved updates whether the settings of some application need
+// its HTTP events to be observed.
+func (m *AppMonitor) updateHTTPObserved() {
+	m.mu.Lock()
+	observed := m.AppDefaults.observesHTTP()
+	for _, s := range m.appSettings {
+		observed = observed || s.observesHTTP()
+	}
+	m.mu.Unlock()
+	var v int32
+	if observed {
+		v = 1
+	}
+	atomic.StoreInt32(&m.httpObserved, v)
+}
+
+// ratioState returns the state of a ratio with the given thresholds.
+func ratioState(r, warn, critical float64) string {
+	switch {
+	case critical > 0 && r > critical:
+		return "critical"
+	case warn > 0 && r > warn:
+		return "warn"
+	}
+	return "ok"
+}
+
+// envSettingKey returns the setting key, without the prefix, of an
+// environment variable, or an empty string, if it is not a setting.
+func envSettingKey(name string) string {
+	if strings.HasPrefix(name, settingsPrefix) {
+		return strings.TrimPrefix(name, settingsPrefix)
+	}
+	// Other variables with the same prefix may be used by the application
+	// itself, so only the known settings are taken.
+	key := strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, "MOZZLE_")), "_", "-")
+	if strings.HasPrefix(name, "MOZZLE_") && contains(settingKeys, key) {
+		return key
+	}
+	return ""
+}
+
+// syncSettings fetches the settings of the owned applications that have
+// changed since they were last fetched, as reported by their updated_at
+// timestamp in the listing of the space. If fetching them fails, the last
+// known settings are kept and they are fetched again on the next poll.
+func (m *AppMonitor) syncSettings(ctx context.Context, apps []application) {
+	for _, app := range apps {
+		if m.Sharder != nil && !m.Sharder.Owns(app.GUID) {
+			continue
+		}
+		m.mu.Lock()
+		synced, ok := m.settingsSynced[app.GUID]
+		m.mu.Unlock()
+		if ok && synced.Equal(app.UpdatedAt) {
+			continue
+		}
+		if err := m.syncAppSettings(ctx, app); err != nil {
+			m.Logger.Error("error fetching app settings", app.logArgs("error", err)...)
+			continue
+		}
+		m.mu.Lock()
+		m.settingsSynced[app.GUID] = app.UpdatedAt
+		m.mu.Unlock()
+	}
+	m.updateHTTPObserved()
+}
+
+// syncAppSettings fetches the settings of the application from its
+// environment and metadata.
+func (m *AppMonitor) syncAppSettings(ctx context.Context, app application) error {
+	var envApp struct {
+		Entity struct {
+			Environment map[string]interface{} `json:"environment_json"`
+		} `json:"entity"`
+	}
+	if err := m.ccGet(ctx, "/v2/apps/"+app.GUID, nil, &envApp); err != nil {
+		return err
+	}
+	var metaApp struct {
+		Metadata struct {
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := m.ccGet(ctx, "/v3/apps/"+app.GUID, nil, &metaApp); err != nil {
+		// Metadata is not supported by older Cloud Controllers, so the
+		// settings from the environment are still applied.
+		m.Logger.Debug("error fetching app metadata", app.logArgs("error", err)...)
+	}
+
+	values := make(map[string]string)
+	for name, v := range envApp.Entity.Environment {
+		if key := envSettingKey(name); key != "" {
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	// Annotations take precedence over labels.
+	for _, meta := range []map[string]string{metaApp.Metadata.Labels, metaApp.Metadata.Annotations} {
+		for name, v := range meta {
+			if strings.HasPrefix(name, settingsPrefix) {
+				values[strings.TrimPrefix(name, settingsPrefix)] = v
+			}
+		}
+	}
+
+	as := m.AppDefaults
+	invalid := make(map[string]bool)
+	for key, value := range values {
+		err := as.set(key, value)
+		if err == nil {
+			continue
+		}
+		// Invalid settings are logged once, rather than on every change.
+		id := key + "=" + value
+		invalid[id] = true
+		m.mu.Lock()
+		reported := m.invalidSettings[app.GUID][id]
+		m.mu.Unlock()
+		if !reported {
+			m.Logger.Warn("invalid app setting", app.logArgs("setting", settingsPrefix+key, "value", value, "error", err)...)
+		}
+	}
+
+	m.mu.Lock()
+	m.appSettings[app.GUID] = as
+	m.invalidSettings[app.GUID] = invalid
+	m.mu.Unlock()
+	return nil
+}
+
+// settings returns the settings of the application with the given GUID.
+func (m *AppMonitor) settings(guid string) AppSettings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settingsLocked(guid)
+}
+
+// settingsLocked is like settings, but expects m.mu to be held.
+func (m *AppMonitor) settingsLocked(guid string) AppSettings {
+	if s, ok := m.appSettings[guid]; ok {
+		return s
+	}
+	return m.AppDefaults
+}
@@ -0,0 +1,113 @@
+package mozzle
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppSettingsSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       AppSettings
+		wantErr    bool
+	}{
+		{key: "enabled", value: "false", want: AppSettings{Disabled: true}},
+		{key: "enabled", value: "maybe", wantErr: true},
+		{key: "http-aggregate", value: "true", want: AppSettings{HTTPAggregate: true}},
+		{key: "memory-warn", value: "0.7", want: AppSettings{MemoryWarn: 0.7}},
+		{key: "disk-critical", value: "1", want: AppSettings{DiskCritical: 1}},
+		{key: "memory-critical", value: "1.5", wantErr: true},
+		{key: "disk-warn", value: "-0.1", wantErr: true},
+		{key: "apdex-t", value: "500ms", want: AppSettings{ApdexT: 500 * time.Millisecond}},
+		{key: "apdex-t", value: "-1s", wantErr: true},
+		{key: "apdex-per-route", value: "true", want: AppSettings{ApdexPerRoute: true}},
+		{
+			key: "slo", value: "name=availability,objective=0.999,period=30d",
+			want: AppSettings{SLOs: []SLO{{Name: "availability", Objective: 0.999, Period: 30 * 24 * time.Hour}}},
+		},
+		{key: "slo", value: "name=availability", wantErr: true},
+		{key: "unknown", value: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		var s AppSettings
+		err := s.set(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("set(%q, %q) error = %v, want error %v", tt.key, tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(s, tt.want) {
+			t.Errorf("set(%q, %q) = %+v, want %+v", tt.key, tt.value, s, tt.want)
+		}
+	}
+}
+
+func TestEnvSettingKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"mozzle.io/memory-warn", "memory-warn"},
+		{"mozzle.io/unknown", "unknown"},
+		{"MOZZLE_MEMORY_WARN", "memory-warn"},
+		{"MOZZLE_APDEX_PER_ROUTE", "apdex-per-route"},
+		{"MOZZLE_SLO", "slo"},
+		{"MOZZLE_UNKNOWN", ""},
+		{"MEMORY_WARN", ""},
+		{"DB_PASSWORD", ""},
+	}
+	for _, tt := range tests {
+		if got := envSettingKey(tt.name); got != tt.want {
+			t.Errorf("envSettingKey(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyncSettings(t *testing.T) {
+	cc := new(fakeCC)
+	cc.set("/v2/apps/a", `{"entity":{"environment_json":{
+		"MOZZLE_MEMORY_WARN":"0.5","MOZZLE_DISK_WARN":"0.5","MOZZLE_APDEX_T":"1s","DB_PASSWORD":"secret"}}}`)
+	cc.set("/v3/apps/a", `{"metadata":{
+		"labels":{"mozzle.io/disk-warn":"0.6","mozzle.io/apdex-t":"2s"},
+		"annotations":{"mozzle.io/apdex-t":"3s","mozzle.io/memory-critical":"2"}}}`)
+	m, _ := newTestMonitor(Target{AppDefaults: AppSettings{MemoryCritical: 0.9}}, cc)
+
+	app := testApp("a", "app-a")
+	app.UpdatedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	m.syncSettings(ctx, []application{app})
+
+	want := AppSettings{
+		MemoryWarn:     0.5,             // environment
+		MemoryCritical: 0.9,             // default, as the override is invalid
+		DiskWarn:       0.6,             // label over environment
+		ApdexT:         3 * time.Second, // annotation over label
+	}
+	if got := m.settings("a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("settings = %+v, want %+v", got, want)
+	}
+	if atomic.LoadInt32(&m.httpObserved) == 0 {
+		t.Error("HTTP events not observed with an Apdex threshold")
+	}
+	if got := m.settings("b"); !reflect.DeepEqual(got, m.AppDefaults) {
+		t.Errorf("settings of an unknown app = %+v, want the defaults", got)
+	}
+
+	// Settings are fetched again only when the app is updated.
+	cc.set("/v2/apps/a", `{"entity":{"environment_json":{}}}`)
+	cc.set("/v3/apps/a", `{"metadata":{}}`)
+	m.syncSettings(ctx, []application{app})
+	if n := cc.count("/v2/apps/a"); n != 1 {
+		t.Errorf("settings fetched %d times for an unchanged app, want 1", n)
+	}
+	app.UpdatedAt = app.UpdatedAt.Add(time.Minute)
+	m.syncSettings(ctx, []application{app})
+	if got := m.settings("a"); !reflect.DeepEqual(got, m.AppDefaults) {
+		t.Errorf("settings after update = %+v, want the defaults", got)
+	}
+	if atomic.LoadInt32(&m.httpObserved) != 0 {
+		t.Error("HTTP events observed without settings that need them")
+	}
+}
@@ -0,0 +1,243 @@
+package mozzle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sharder splits the monitored applications between multiple mozzle
+// instances.
+type Sharder interface {
+	// Sync updates the sharder's view of the instances. It is called on
+	// every refresh, before deciding which applications to monitor.
+	Sync(ctx context.Context) error
+	// Owns reports whether the application with the specified GUID should
+	// be monitored by this instance.
+	Owns(appGUID string) bool
+}
+
+// StaticSharder implements Sharder for a fixed number of instances, each
+// given a distinct index.
+// Applications do not move to other instances when an instance dies; use
+// GroupSharder for that.
+type StaticSharder struct {
+	// Index is the index of this instance, in the range [0, Count).
+	Index int
+	// Count is the total number of instances.
+	Count int
+
+	once sync.Once
+	ring *hashRing
+	self string
+}
+
+// Sync implements Sharder.
+func (s *StaticSharder) Sync(ctx context.Context) error {
+	if s.Index < 0 || s.Index >= s.Count {
+		return fmt.Errorf("shard index %d out of range [0, %d)", s.Index, s.Count)
+	}
+	return nil
+}
+
+// Owns implements Sharder.
+func (s *StaticSharder) Owns(appGUID string) bool {
+	s.once.Do(func() {
+		members := make([]string, s.Count)
+		for i := range members {
+			members[i] = "shard-" + strconv.Itoa(i)
+		}
+		s.ring = newHashRing(members)
+		s.self = "shard-" + strconv.Itoa(s.Index)
+	})
+	return s.ring.Get(appGUID) == s.self
+}
+
+// Membership tracks the live members of a group of mozzle instances.
+type Membership interface {
+	// Heartbeat announces that member is alive.
+	Heartbeat(ctx context.Context, member string) error
+	// Members returns the currently live members.
+	Members(ctx context.Context) ([]string, error)
+	// Leave removes member from the group.
+	Leave(ctx context.Context, member string) error
+}
+
+// GroupSharder implements Sharder for a dynamic group of instances.
+// On every Sync it announces itself to the group and splits the
+// applications between the live members using consistent hashing, so that
+// the applications of a dead member move to the rest of the group.
+type GroupSharder struct {
+	// ID identifies this instance within the group.
+	ID string
+	// Membership is the backend used for tracking the group members.
+	Membership Membership
+
+	mu   sync.Mutex // guards
+	ring *hashRing
+}
+
+// Sync implements Sharder.
+func (g *GroupSharder) Sync(ctx context.Context) error {
+	if err := g.Membership.Heartbeat(ctx, g.ID); err != nil {
+		return err
+	}
+	members, err := g.Membership.Members(ctx)
+	if err != nil {
+		return err
+	}
+	ring := newHashRing(members)
+	g.mu.Lock()
+	g.ring = ring
+	g.mu.Unlock()
+	return nil
+}
+
+// Owns implements Sharder. No applications are owned before the first
+// successful Sync.
+func (g *GroupSharder) Owns(appGUID string) bool {
+	g.mu.Lock()
+	ring := g.ring
+	g.mu.Unlock()
+	return ring != nil && ring.Get(appGUID) == g.ID
+}
+
+// Leave removes the instance from the group, so that its applications
+// move to the rest of the group without waiting for it to expire.
+func (g *GroupSharder) Leave(ctx context.Context) error {
+	g.mu.Lock()
+	g.ring = nil
+	g.mu.Unlock()
+	return g.Membership.Leave(ctx, g.ID)
+}
+
+// DirMembership implements Membership using a directory shared between
+// all members, e.g. on a local or network file system. Each member
+// periodically touches its own file and members whose files have not been
+// touched within TTL are considered dead.
+type DirMembership struct {
+	// Dir is the shared directory. It is created if it does not exist.
+	Dir string
+	// TTL is the time after which a member without heartbeats is
+	// considered dead. It should be a few times the refresh interval.
+	TTL time.Duration
+}
+
+const memberFileExt = ".member"
+
+// Heartbeat implements Membership.
+func (d *DirMembership) Heartbeat(ctx context.Context, member string) error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	// The file's content is the member, as the name may not be able to
+	// hold it verbatim.
+	return ioutil.WriteFile(d.path(member), []byte(member), 0644)
+}
+
+// Members implements Membership.
+func (d *DirMembership) Members(ctx context.Context) ([]string, error) {
+	if d.TTL <= 0 {
+		return nil, errors.New("membership TTL must be positive")
+	}
+	files, err := ioutil.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != memberFileExt {
+			continue
+		}
+		if time.Since(fi.ModTime()) > d.TTL {
+			continue
+		}
+		member, err := ioutil.ReadFile(filepath.Join(d.Dir, fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // left in the meantime
+			}
+			return nil, err
+		}
+		members = append(members, string(member))
+	}
+	return members, nil
+}
+
+// Leave implements Membership.
+func (d *DirMembership) Leave(ctx context.Context, member string) error {
+	err := os.Remove(d.path(member))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirMembership) path(member string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, member)
+	// Append a hash of the member, in case the mapping above made two
+	// members look the same.
+	return filepath.Join(d.Dir, fmt.Sprintf("%s-%08x%s", name, hash(member), memberFileExt))
+}
+
+// hashRingReplicas is the number of points each member has on the ring. The
+// more points, the more even the distribution of keys between the members.
+const hashRingReplicas = 64
+
+// hashRing implements consistent hashing - when a member is added or
+// removed, only the keys of that member move to other members.
+type hashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{members: make(map[uint32]string)}
+	for _, m := range members {
+		for i := 0; i < hashRingReplicas; i++ {
+			p := hash(m + "#" + strconv.Itoa(i))
+			if _, ok := r.members[p]; ok {
+				continue
+			}
+			r.points = append(r.points, p)
+			r.members[p] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Get returns the member responsible for key, or an empty string if the
+// ring has no members.
+func (r *hashRing) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,135 @@
+package mozzle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHashRingGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []string
+	}{
+		{"single member", []string{"a"}},
+		{"two members", []string{"a", "b"}},
+		{"many members", []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newHashRing(tt.members)
+			seen := make(map[string]int)
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("app-%d", i)
+				m := r.Get(key)
+				if m != r.Get(key) {
+					t.Fatalf("Get(%q) is not stable", key)
+				}
+				seen[m]++
+			}
+			for _, m := range tt.members {
+				if seen[m] == 0 {
+					t.Errorf("member %q owns no keys: %v", m, seen)
+				}
+			}
+			if len(seen) != len(tt.members) {
+				t.Errorf("keys spread across %v, want only %v", seen, tt.members)
+			}
+		})
+	}
+}
+
+func TestHashRingGetEmpty(t *testing.T) {
+	if got := newHashRing(nil).Get("app"); got != "" {
+		t.Errorf("Get() = %q, want empty", got)
+	}
+}
+
+func TestHashRingRemoveMember(t *testing.T) {
+	before := newHashRing([]string{"a", "b", "c"})
+	after := newHashRing([]string{"a", "c"})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("app-%d", i)
+		if m := before.Get(key); m != "b" && after.Get(key) != m {
+			t.Errorf("key %q moved from %q to %q", key, m, after.Get(key))
+		}
+	}
+}
+
+func TestStaticSharder(t *testing.T) {
+	tests := []struct {
+		index, count int
+		wantErr      bool
+	}{
+		{0, 1, false},
+		{2, 3, false},
+		{3, 3, true},
+		{-1, 3, true},
+	}
+	for _, tt := range tests {
+		s := &StaticSharder{Index: tt.index, Count: tt.count}
+		if err := s.Sync(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("Sync() for shard %d/%d: err = %v, want error %v", tt.index, tt.count, err, tt.wantErr)
+		}
+	}
+
+	const count = 3
+	sharders := make([]*StaticSharder, count)
+	for i := range sharders {
+		sharders[i] = &StaticSharder{Index: i, Count: count}
+	}
+	for i := 0; i < 100; i++ {
+		guid := fmt.Sprintf("app-%d", i)
+		owners := 0
+		for _, s := range sharders {
+			if s.Owns(guid) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("app %q is owned by %d shards, want 1", guid, owners)
+		}
+	}
+}
+
+func TestGroupSharder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	membership := &DirMembership{Dir: dir, TTL: time.Minute}
+
+	a := &GroupSharder{ID: "host/a", Membership: membership}
+	b := &GroupSharder{ID: "host/b", Membership: membership}
+	if a.Owns("app") {
+		t.Error("Owns() before Sync = true, want false")
+	}
+	for _, g := range []*GroupSharder{a, b, a} {
+		if err := g.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		guid := fmt.Sprintf("app-%d", i)
+		if a.Owns(guid) == b.Owns(guid) {
+			t.Errorf("app %q: owned by a = %v, by b = %v", guid, a.Owns(guid), b.Owns(guid))
+		}
+	}
+
+	if err := b.Leave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if guid := fmt.Sprintf("app-%d", i); !a.Owns(guid) {
+			t.Errorf("app %q not owned by the remaining member", guid)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package mozzle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfevent "github.com/cloudfoundry/sonde-go/events"
+)
+
+// DefaultSLOPeriod is the default period over which SLO compliance is
+// computed.
+const DefaultSLOPeriod = 30 * 24 * time.Hour
+
+// DefaultSLOSaveInterval is the default interval for saving the SLO counts.
+const DefaultSLOSaveInterval = 5 * time.Minute
+
+// SLO is a service level objective for the HTTP requests of an application.
+// A request is good if it is not a 5xx response and, if Latency is set, it
+// completes within Latency.
+type SLO struct {
+	// Name identifies the SLO in the metrics. Defaults to its String.
+	Name string
+	// Objective is the required ratio of good requests, e.g. 0.999.
+	Objective float64
+	// Latency is the response time within which a request is good. Zero
+	// disables the latency requirement.
+	Latency time.Duration
+	// Period is the time over which compliance is computed. Defaults to
+	// DefaultSLOPeriod.
+	Period time.Duration
+	// Peer selects the requests by peer type - "client" for the requests
+	// made by the router, or "server" for the ones served by the
+	// application. All requests are considered if empty.
+	Peer string
+}
+
+// String returns the SLO in the format accepted by ParseSLOs, without its
+// name.
+func (s SLO) String() string {
+	parts := []string{"objective=" + strconv.FormatFloat(s.Objective*100, 'f', -1, 64) + "%"}
+	if s.Latency > 0 {
+		parts = append(parts, "latency="+s.Latency.String())
+	}
+	parts = append(parts, "period="+formatDays(s.period()))
+	if s.Peer != "" {
+		parts = append(parts, "peer="+s.Peer)
+	}
+	return strings.Join(parts, ",")
+}
+
+// key identifies the SLO by its full definition.
+func (s SLO) key() string {
+	return s.Name + " " + s.String()
+}
+
+func (s SLO) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.String()
+}
+
+func (s SLO) period() time.Duration {
+	if s.Period > 0 {
+		return s.Period
+	}
+	return DefaultSLOPeriod
+}
+
+// good reports whether the request meets the SLO. The second result reports
+// whether the request is considered at all.
+func (s SLO) good(r *cfevent.HttpStartStop) (good, ok bool) {
+	if s.Peer != "" && s.Peer != peerType(r.GetPeerType()) {
+		return false, false
+	}
+	if r.GetStatusCode() >= 500 {
+		return false, true
+	}
+	duration := time.Duration(r.GetStopTimestamp() - r.GetStartTimestamp())
+	return s.Latency == 0 || duration <= s.Latency, true
+}
+
+// ParseSLOs parses SLOs separated by semicolons. Each SLO is a list of
+// comma-separated key=value pairs, e.g.
+//
+//	name=checkout,objective=99.9%,latency=500ms,period=30d,peer=server
+//
+// The objective can also be a ratio, e.g. 0.999, and the period is a
+// duration, with an additional "d" unit for days.
+func ParseSLOs(s string) ([]SLO, error) {
+	var res []SLO
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		var slo SLO
+		for _, pair := range strings.Split(spec, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid SLO %q: missing value of %q", spec, pair)
+			}
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			var err error
+			switch key {
+			case "name":
+				slo.Name = value
+			case "objective":
+				slo.Objective, err = parseObjective(value)
+			case "latency":
+				slo.Latency, err = time.ParseDuration(value)
+			case "period":
+				slo.Period, err = parseDays(value)
+			case "peer":
+				if value != "client" && value != "server" {
+					err = fmt.Errorf("must be client or server")
+				}
+				slo.Peer = value
+			default:
+				err = fmt.Errorf("unknown key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid SLO %q: %s: %v", spec, key, err)
+			}
+		}
+		if slo.Objective <= 0 || slo.Objective >= 1 {
+			return nil, fmt.Errorf("invalid SLO %q: objective must be between 0 and 100%%", spec)
+		}
+		res = append(res, slo)
+	}
+	return res, nil
+}
+
+func parseObjective(s string) (float64, error) {
+	if strings.HasSuffix(s, "%") {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return v / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		return time.Duration(days) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
+
+func formatDays(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	}
+	return d.String()
+}
+
+// sloBucket counts the requests within a single time slot.
+type sloBucket struct {
+	slot      int64
+	total     uint64
+	bad       uint64
+	allocated bool
+}
+
+// sloBuckets is a ring of buckets of the same size.
+type sloBuckets struct {
+	size    time.Duration
+	buckets []sloBucket
+}
+
+func newSLOBuckets(size, span time.Duration) sloBuckets {
+	return sloBuckets{size: size, buckets: make([]sloBucket, int(span/size)+1)}
+}
+
+func (b sloBuckets) add(t time.Time, bad bool) {
+	slot := t.UnixNano() / int64(b.size)
+	bucket := &b.buckets[slot%int64(len(b.buckets))]
+	if !bucket.allocated || bucket.slot != slot {
+		*bucket = sloBucket{slot: slot, allocated: true}
+	}
+	bucket.total++
+	if bad {
+		bucket.bad++
+	}
+}
+
+// counts returns the allocated buckets.
+func (b sloBuckets) counts() []SLOBucket {
+	var res []SLOBucket
+	for _, bucket := range b.buckets {
+		if bucket.allocated {
+			res = append(res, SLOBucket{
+				Start: time.Unix(0, bucket.slot*int64(b.size)).UTC(),
+				Total: bucket.total,
+				Bad:   bucket.bad,
+			})
+		}
+	}
+	return res
+}
+
+// restore restores the buckets from counts, skipping the ones that no
+// longer fit in the ring at t.
+func (b sloBuckets) restore(t time.Time, counts []SLOBucket) {
+	last := t.UnixNano() / int64(b.size)
+	for _, c := range counts {
+		slot := c.Start.UnixNano() / int64(b.size)
+		if slot > last || slot <= last-int64(len(b.buckets)) {
+			continue
+		}
+		b.buckets[slot%int64(len(b.buckets))] = sloBucket{slot: slot, total: c.Total, bad: c.Bad, allocated: true}
+	}
+}
+
+// sum returns the numbers of all and bad requests within window before t.
+func (b sloBuckets) sum(t time.Time, window time.Duration) (total, bad uint64) {
+	last := t.UnixNano() / int64(b.size)
+	first := last - int64(window/b.size) + 1
+	for _, bucket := range b.buckets {
+		if bucket.allocated && bucket.slot >= first && bucket.slot <= last {
+			total += bucket.total
+			bad += bucket.bad
+		}
+	}
+	return total, bad
+}
+
+// Burn rate windows, shorter ones are counted per minute and longer ones
+// per hour.
+const (
+	sloFineSpan     = 6 * time.Hour
+	sloFineBucket   = time.Minute
+	sloCoarseBucket = time.Hour
+)
+
+// sloCounter counts the good and bad requests of an application for an SLO.
+type sloCounter struct {
+	slo    SLO
+	fine   sloBuckets
+	coarse sloBuckets
+}
+
+func newSLOCounter(slo SLO) *sloCounter {
+	return &sloCounter{
+		slo:    slo,
+		fine:   newSLOBuckets(sloFineBucket, sloFineSpan),
+		coarse: newSLOBuckets(sloCoarseBucket, slo.period()),
+	}
+}
+
+func (c *sloCounter) counts() SLOCounts {
+	return SLOCounts{Fine: c.fine.counts(), Coarse: c.coarse.counts()}
+}
+
+func (c *sloCounter) restore(t time.Time, counts SLOCounts) {
+	c.fine.restore(t, counts.Fine)
+	c.coarse.restore(t, counts.Coarse)
+}
+
+func (c *sloCounter) add(t time.Time, bad bool) {
+	c.fine.add(t, bad)
+	c.coarse.add(t, bad)
+}
+
+func (c *sloCounter) sum(t time.Time, window time.Duration) (total, bad uint64) {
+	if window <= sloFineSpan {
+		return c.fine.sum(t, window)
+	}
+	return c.coarse.sum(t, window)
+}
+
+// SLOBucket counts the requests of an SLO within the time slot starting at
+// Start.
+type SLOBucket struct {
+	Start time.Time `json:"start"`
+	Total uint64    `json:"total"`
+	Bad   uint64    `json:"bad"`
+}
+
+// SLOCounts are the request counts of an application's SLO, per minute over
+// the last hours and per hour over the SLO's period.
+type SLOCounts struct {
+	Fine   []SLOBucket `json:"fine"`
+	Coarse []SLOBucket `json:"coarse"`
+}
+
+// SLOStore stores SLO counts by key. Implementations should be safe for
+// concurrent use.
+type SLOStore interface {
+	// Load returns all stored counts.
+	Load() (map[string]SLOCounts, error)
+	// Save replaces the stored counts with c.
+	Save(c map[string]SLOCounts) error
+}
+
+// MemorySLOStore implements SLOStore that keeps counts in memory. Its zero
+// value is ready to use.
+type MemorySLOStore struct {
+	mu     sync.Mutex
+	counts map[string]SLOCounts
+}
+
+// Load implements SLOStore.
+func (s *MemorySLOStore) Load() (map[string]SLOCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copySLOCounts(s.counts), nil
+}
+
+// Save implements SLOStore.
+func (s *MemorySLOStore) Save(c map[string]SLOCounts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts = copySLOCounts(c)
+	return nil
+}
+
+// FileSLOStore implements SLOStore that persists counts in a JSON encoded
+// file, so that they survive restarts. The file is rewritten atomically on
+// every Save.
+type FileSLOStore struct {
+	// Path is the path of the file. It is created if it does not exist.
+	Path string
+
+	mu sync.Mutex
+}
+
+// Load implements SLOStore.
+func (s *FileSLOStore) Load() (map[string]SLOCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]SLOCounts)
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &counts); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// Save implements SLOStore.
+func (s *FileSLOStore) Save(c map[string]SLOCounts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.Path, c)
+}
+
+func copySLOCounts(c map[string]SLOCounts) map[string]SLOCounts {
+	res := make(map[string]SLOCounts, len(c))
+	for k, v := range c {
+		res[k] = v
+	}
+	return res
+}
+
+// burnRateWindows are the windows over which burn rates are computed, with
+// the rates at which they are in the given state, as recommended for
+// multi-window alerting on a 30 day budget - 2% of the budget spent within
+// an hour, 5% within six hours and 10% within three days.
+var burnRateWindows = []struct {
+	name      string
+	window    time.Duration
+	threshold float64
+	state     string
+}{
+	{"1h", time.Hour, 14.4, "critical"},
+	{"6h", 6 * time.Hour, 6, "critical"},
+	{"3d", 3 * 24 * time.Hour, 1, "warn"},
+}
+
+// sloMetrics describes the compliance of an application with an SLO.
+type sloMetrics struct {
+	Counter *sloCounter
+	Time    time.Time
+	App     application
+}
+
+func (s sloMetrics) EmitTo(e Emitter) {
+	slo := s.Counter.slo
+	attributes := attributes(s.App)
+	attributes["slo"] = slo.name()
+	attributes["objective"] = strconv.FormatFloat(slo.Objective, 'f', -1, 64)
+	attributes["period"] = formatDays(slo.period())
+	if slo.Latency > 0 {
+		attributes["latency_ms"] = strconv.FormatInt(slo.Latency.Milliseconds(), 10)
+	}
+	budget := 1 - slo.Objective
+
+	total, bad := s.Counter.sum(s.Time, slo.period())
+	compliance := 1.0
+	if total > 0 {
+		compliance = 1 - ratio(bad, total)
+	}
+	state := "ok"
+	if compliance < slo.Objective {
+		state = "critical"
+	}
+	e.Emit(forApp(s.App, Metric{
+		Service:    "slo compliance_ratio",
+		Metric:     compliance,
+		State:      state,
+		Attributes: attributes,
+	}))
+
+	// The remaining budget is the ratio of bad requests still allowed
+	// within the period, negative once it is exceeded.
+	remaining := 1 - (1-compliance)/budget
+	state = "ok"
+	switch {
+	case remaining <= 0:
+		state = "critical"
+	case remaining < 0.25:
+		state = "warn"
+	}
+	e.Emit(forApp(s.App, Metric{
+		Service:    "slo error_budget_remaining_ratio",
+		Metric:     remaining,
+		State:      state,
+		Attributes: attributes,
+	}))
+
+	for _, w := range burnRateWindows {
+		total, bad := s.Counter.sum(s.Time, w.window)
+		rate := ratio(bad, total) / budget
+		state := "ok"
+		if rate >= w.threshold {
+			state = w.state
+		}
+		attrs := copyMap(attributes)
+		attrs["window"] = w.name
+		e.Emit(forApp(s.App, Metric{
+			Service:    "slo burn_rate",
+			Metric:     rate,
+			State:      state,
+			Attributes: attrs,
+		}))
+	}
+}
+
+// observeSLOsLocked counts the HTTP event towards the SLOs of the
+// application. It expects m.mu to be held.
+func (m *AppMonitor) observeSLOsLocked(status *appStatus, slos []SLO, r *cfevent.HttpStartStop, now time.Time) {
+	for _, slo := range slos {
+		good, ok := slo.good(r)
+		if !ok {
+			continue
+		}
+		c := m.sloCounterLocked(status, slo, now)
+		c.add(now, !good)
+	}
+}
+
+// sloKey returns the key of the counts of the application's SLO in the
+// SLOStore. The counts are keyed by the full definition, so that they are
+// reset when the definition changes.
+func sloKey(guid string, slo SLO) string {
+	return guid + ":" + slo.key()
+}
+
+// sloCounterLocked returns the counter of the application's SLO, creating it
+// from the stored counts if needed. It expects m.mu to be held.
+func (m *AppMonitor) sloCounterLocked(status *appStatus, slo SLO, now time.Time) *sloCounter {
+	key := slo.key()
+	if status.slos == nil {
+		status.slos = make(map[string]*sloCounter)
+	}
+	c, ok := status.slos[key]
+	if !ok {
+		c = newSLOCounter(slo)
+		if counts, ok := m.sloCounts[sloKey(status.GUID, slo)]; ok {
+			c.restore(now, counts)
+		}
+		status.slos[key] = c
+	}
+	return c
+}
+
+// emitSLOs emits the compliance of the application with its SLOs.
+func (m *AppMonitor) emitSLOs(guid string) {
+	now := time.Now()
+	var metrics []sloMetrics
+	m.mu.Lock()
+	slos := m.settingsLocked(guid).SLOs
+	if status, ok := m.monitored[guid]; ok {
+		counters := make(map[string]*sloCounter)
+		for _, slo := range slos {
+			c := m.sloCounterLocked(status, slo, now)
+			counters[slo.key()] = c
+			metrics = append(metrics, sloMetrics{c, now, status.application})
+		}
+		// Forget the counters of SLOs that are no longer defined.
+		status.slos = counters
+	}
+	m.mu.Unlock()
+
+	for _, s := range metrics {
+		s.EmitTo(m.emitter)
+	}
+}
+
+// releaseSLOsLocked keeps the counts of the SLOs of an application that is
+// no longer monitored, so that they are saved for the instance taking it
+// over. It expects m.mu to be held.
+func (m *AppMonitor) releaseSLOsLocked(status *appStatus) {
+	for _, slo := range m.settingsLocked(status.GUID).SLOs {
+		if c, ok := status.slos[slo.key()]; ok {
+			m.sloCounts[sloKey(status.GUID, slo)] = c.counts()
+			m.sloReleased[status.GUID] = true
+		}
+	}
+	m.sloHandover = true
+}
+
+// sloSaveDue reports whether the SLO counts should be saved at now, given
+// the time of the last save.
+func (m *AppMonitor) sloSaveDue(now, saved time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sloHandover || now.Sub(saved) >= m.SLOSaveInterval
+}
+
+// saveSLOs saves the counts of the SLOs of the monitored applications to the
+// store, keeping the stored counts of the other existing applications, so
+// that instances sharing the store take over each other's counts when
+// applications move between them.
+func (m *AppMonitor) saveSLOs() {
+	stored, err := m.SLOStore.Load()
+	if err != nil {
+		m.Logger.Error("error loading SLO counts", "error", err)
+		return
+	}
+	m.mu.Lock()
+	counts := make(map[string]SLOCounts, len(stored))
+	for key, c := range stored {
+		guid, ok := keyGUID(key)
+		if _, exists := m.appMeta[guid]; !ok || !exists {
+			continue
+		}
+		if _, monitored := m.monitored[guid]; !monitored && !m.sloReleased[guid] {
+			counts[key] = c
+		}
+	}
+	// The counts of the applications released since the last save are
+	// newer than the stored ones.
+	for key, c := range m.sloCounts {
+		guid, _ := keyGUID(key)
+		_, exists := m.appMeta[guid]
+		_, monitored := m.monitored[guid]
+		if exists && !monitored && m.sloReleased[guid] {
+			counts[key] = c
+		}
+	}
+	m.sloReleased = make(map[string]bool)
+	m.sloHandover = false
+	for guid, status := range m.monitored {
+		for _, slo := range m.settingsLocked(guid).SLOs {
+			key := sloKey(guid, slo)
+			if c, ok := status.slos[slo.key()]; ok {
+				counts[key] = c.counts()
+			} else if c, ok := m.sloCounts[key]; ok {
+				counts[key] = c
+			}
+		}
+	}
+	m.sloCounts = counts
+	m.mu.Unlock()
+
+	if err := m.SLOStore.Save(counts); err != nil {
+		m.Logger.Error("error saving SLO counts", "error", err)
+	}
+}
+
+// loadSLOs loads the SLO counts from the store.
+func (m *AppMonitor) loadSLOs() {
+	counts, err := m.SLOStore.Load()
+	if err != nil {
+		m.Logger.Error("error loading SLO counts", "error", err)
+		return
+	}
+	m.mu.Lock()
+	m.sloCounts = counts
+	m.mu.Unlock()
+}
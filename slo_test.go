@@ -0,0 +1,315 @@
+package mozzle
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSLOs(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []SLO
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: "objective=99%", want: []SLO{{Objective: 0.99}}},
+		{
+			spec: "name=checkout,objective=0.999,latency=500ms,period=30d,peer=server",
+			want: []SLO{{Name: "checkout", Objective: 0.999, Latency: 500 * time.Millisecond, Period: 30 * 24 * time.Hour, Peer: "server"}},
+		},
+		{
+			spec: "objective=0.95, period=12h; objective=0.9,peer=client;",
+			want: []SLO{{Objective: 0.95, Period: 12 * time.Hour}, {Objective: 0.9, Peer: "client"}},
+		},
+		{spec: "objective", wantErr: true},
+		{spec: "name=checkout", wantErr: true},
+		{spec: "objective=100%", wantErr: true},
+		{spec: "objective=0", wantErr: true},
+		{spec: "objective=99%,latency=fast", wantErr: true},
+		{spec: "objective=99%,period=month", wantErr: true},
+		{spec: "objective=99%,peer=router", wantErr: true},
+		{spec: "objective=99%,owner=me", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSLOs(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSLOs(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSLOs(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSLOString(t *testing.T) {
+	tests := []struct {
+		slo  SLO
+		want string
+	}{
+		{SLO{Objective: 0.99}, "objective=99%,period=30d"},
+		{SLO{Objective: 0.999, Latency: 500 * time.Millisecond, Period: 36 * time.Hour, Peer: "server"},
+			"objective=99.9%,latency=500ms,period=36h0m0s,peer=server"},
+	}
+	for _, tt := range tests {
+		if got := tt.slo.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+		if slos, err := ParseSLOs(tt.slo.String()); err != nil || slos[0].String() != tt.want {
+			t.Errorf("ParseSLOs(%q) = %+v, %v, want the same SLO", tt.want, slos, err)
+		}
+	}
+}
+
+func TestSLOGood(t *testing.T) {
+	tests := []struct {
+		name     string
+		slo      SLO
+		status   int32
+		duration time.Duration
+		wantGood bool
+		wantOK   bool
+	}{
+		{"success", SLO{Objective: 0.99}, 200, time.Second, true, true},
+		{"client error", SLO{Objective: 0.99}, 404, time.Second, true, true},
+		{"server error", SLO{Objective: 0.99}, 503, time.Millisecond, false, true},
+		{"fast", SLO{Objective: 0.99, Latency: 100 * time.Millisecond}, 200, 100 * time.Millisecond, true, true},
+		{"slow", SLO{Objective: 0.99, Latency: 100 * time.Millisecond}, 200, 101 * time.Millisecond, false, true},
+		{"other peer", SLO{Objective: 0.99, Peer: "client"}, 503, time.Second, false, false},
+		{"same peer", SLO{Objective: 0.99, Peer: "server"}, 200, time.Second, true, true},
+	}
+	for _, tt := range tests {
+		good, ok := tt.slo.good(httpEvent("/", tt.status, tt.duration))
+		if good != tt.wantGood || ok != tt.wantOK {
+			t.Errorf("%s: good() = %v, %v, want %v, %v", tt.name, good, ok, tt.wantGood, tt.wantOK)
+		}
+	}
+}
+
+func TestSLOBucketsSum(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newSLOBuckets(time.Minute, 10*time.Minute)
+	// One request per minute, every third one bad.
+	for i := 0; i < 20; i++ {
+		b.add(start.Add(time.Duration(i)*time.Minute+time.Second), i%3 == 0)
+	}
+	now := start.Add(19*time.Minute + 30*time.Second)
+	tests := []struct {
+		window    time.Duration
+		wantTotal uint64
+		wantBad   uint64
+	}{
+		{time.Minute, 1, 0},       // 19
+		{3 * time.Minute, 3, 1},   // 17-19
+		{5*time.Minute + 1, 5, 2}, // 15-19, partial buckets are skipped
+		{10 * time.Minute, 10, 3}, // 10-19
+		{12 * time.Minute, 11, 4}, // 9-19, 8 is no longer in the ring
+		{time.Hour, 11, 4},        // 9-19
+		{30 * time.Second, 0, 0},  // shorter than a bucket
+	}
+	for _, tt := range tests {
+		total, bad := b.sum(now, tt.window)
+		if total != tt.wantTotal || bad != tt.wantBad {
+			t.Errorf("sum(%v) = %d, %d, want %d, %d", tt.window, total, bad, tt.wantTotal, tt.wantBad)
+		}
+	}
+}
+
+func TestSLOBucketsRestore(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newSLOBuckets(time.Hour, 24*time.Hour)
+	b.add(start, true)
+	b.add(start.Add(time.Hour), false)
+	b.add(start.Add(time.Hour), false)
+	counts := b.counts()
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		wantTotal uint64
+		wantBad   uint64
+	}{
+		{"immediately", start.Add(time.Hour), 3, 1},
+		{"a day later", start.Add(25 * time.Hour), 2, 0},
+		{"much later", start.Add(48 * time.Hour), 0, 0},
+		{"clock moved back", start.Add(-time.Hour), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := newSLOBuckets(time.Hour, 24*time.Hour)
+			restored.restore(tt.at, counts)
+			total, bad := restored.sum(tt.at, 25*time.Hour)
+			if total != tt.wantTotal || bad != tt.wantBad {
+				t.Errorf("sum() = %d, %d, want %d, %d", total, bad, tt.wantTotal, tt.wantBad)
+			}
+		})
+	}
+}
+
+func TestSLOMetrics(t *testing.T) {
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		good, bad      int
+		age            time.Duration // of the requests
+		wantCompliance float64
+		wantStates     map[string]string
+		wantBurnRates  map[string]float64
+	}{
+		{
+			name:           "no requests",
+			wantCompliance: 1,
+			wantStates:     map[string]string{"slo compliance_ratio": "ok", "slo error_budget_remaining_ratio": "ok"},
+			wantBurnRates:  map[string]float64{"1h": 0, "6h": 0, "3d": 0},
+		},
+		{
+			name: "within objective", good: 999, bad: 1, age: time.Minute,
+			wantCompliance: 0.999,
+			wantStates:     map[string]string{"slo compliance_ratio": "ok", "slo error_budget_remaining_ratio": "ok"},
+			wantBurnRates:  map[string]float64{"1h": 0.01, "6h": 0.01, "3d": 0.01},
+		},
+		{
+			name: "budget almost spent", good: 92, bad: 8, age: 4 * 24 * time.Hour,
+			wantCompliance: 0.92,
+			wantStates:     map[string]string{"slo compliance_ratio": "ok", "slo error_budget_remaining_ratio": "warn"},
+			wantBurnRates:  map[string]float64{"1h": 0, "6h": 0, "3d": 0},
+		},
+		{
+			name: "burning fast", good: 50, bad: 50, age: 10 * time.Minute,
+			wantCompliance: 0.5,
+			wantStates:     map[string]string{"slo compliance_ratio": "critical", "slo error_budget_remaining_ratio": "critical"},
+			wantBurnRates:  map[string]float64{"1h": 5, "6h": 5, "3d": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSLOCounter(SLO{Name: "availability", Objective: 0.9})
+			for i := 0; i < tt.good+tt.bad; i++ {
+				c.add(now.Add(-tt.age), i < tt.bad)
+			}
+			var e collector
+			sloMetrics{c, now, testApp("a", "app-a")}.EmitTo(&e)
+
+			compliance := e.service("slo compliance_ratio")
+			if len(compliance) != 1 || math.Abs(compliance[0].Metric.(float64)-tt.wantCompliance) > 1e-9 {
+				t.Errorf("compliance = %+v, want %v", compliance, tt.wantCompliance)
+			}
+			for service, want := range tt.wantStates {
+				if ms := e.service(service); len(ms) != 1 || ms[0].State != want {
+					t.Errorf("%s = %+v, want state %s", service, ms, want)
+				}
+			}
+			for _, m := range e.service("slo burn_rate") {
+				window := m.Attributes["window"]
+				if want := tt.wantBurnRates[window]; math.Abs(m.Metric.(float64)-want) > 1e-9 {
+					t.Errorf("%s burn rate = %v, want %v", window, m.Metric, want)
+				}
+				if m.Attributes["slo"] != "availability" || m.Attributes["objective"] != "0.9" {
+					t.Errorf("burn rate attributes = %v", m.Attributes)
+				}
+			}
+		})
+	}
+}
+
+func TestSLOCountsPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-slo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileSLOStore{Path: filepath.Join(dir, "slo.json")}
+	defaults := AppSettings{SLOs: []SLO{{Name: "availability", Objective: 0.9}}}
+	app := testApp("a", "app-a")
+
+	first, _ := newTestMonitor(Target{AppDefaults: defaults, SLOStore: store}, new(fakeCC))
+	first.loadSLOs()
+	first.monitored[app.GUID] = &appStatus{application: app}
+	first.observeHTTP(app.GUID, httpEvent("/", 200, time.Millisecond))
+	first.observeHTTP(app.GUID, httpEvent("/", 500, time.Millisecond))
+	first.saveSLOs()
+
+	// Another instance, e.g. after a restart, continues with the counts.
+	second, e := newTestMonitor(Target{AppDefaults: defaults, SLOStore: store}, new(fakeCC))
+	second.loadSLOs()
+	second.monitored[app.GUID] = &appStatus{application: app}
+	second.metadata(app.GUID)
+	second.observeHTTP(app.GUID, httpEvent("/", 200, time.Millisecond))
+	second.emitSLOs(app.GUID)
+	if ms := e.service("slo compliance_ratio"); len(ms) != 1 || math.Abs(ms[0].Metric.(float64)-2.0/3) > 1e-9 {
+		t.Errorf("compliance = %+v, want 2/3 of the requests of both instances", ms)
+	}
+
+	// Counts of SLOs that changed their definition are dropped.
+	second.AppDefaults.SLOs[0].Objective = 0.99
+	second.saveSLOs()
+	counts, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("stored counts = %v, want none after the SLO changed", counts)
+	}
+}
+
+func TestSLOSaveDue(t *testing.T) {
+	m, _ := newTestMonitor(Target{SLOSaveInterval: time.Minute}, new(fakeCC))
+	now := time.Now()
+	tests := []struct {
+		name     string
+		saved    time.Time
+		handover bool
+		want     bool
+	}{
+		{"recently saved", now.Add(-time.Second), false, false},
+		{"interval elapsed", now.Add(-time.Minute), false, true},
+		{"handover", now.Add(-time.Second), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.sloHandover = tt.handover
+			if got := m.sloSaveDue(now, tt.saved); got != tt.want {
+				t.Errorf("sloSaveDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSLOCountsRelease(t *testing.T) {
+	store := new(MemorySLOStore)
+	defaults := AppSettings{SLOs: []SLO{{Name: "availability", Objective: 0.9}}}
+	app := testApp("a", "app-a")
+	m, _ := newTestMonitor(Target{AppDefaults: defaults, SLOStore: store}, new(fakeCC))
+	m.metadata(app.GUID)
+	status := &appStatus{application: app}
+	m.monitored[app.GUID] = status
+	m.saveSLOs()
+	m.observeHTTP(app.GUID, httpEvent("/", 200, time.Millisecond))
+	m.observeHTTP(app.GUID, httpEvent("/", 500, time.Millisecond))
+
+	// The app stops being monitored before the counts are saved.
+	m.mu.Lock()
+	delete(m.monitored, app.GUID)
+	m.releaseSLOsLocked(status)
+	m.mu.Unlock()
+	if !m.sloSaveDue(time.Now(), time.Now()) {
+		t.Error("save not due after releasing an app")
+	}
+	m.saveSLOs()
+	counts, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := status.slos[defaults.SLOs[0].key()].counts()
+	if got := counts[sloKey(app.GUID, defaults.SLOs[0])]; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored counts = %+v, want %+v of the released app", got, want)
+	}
+	if m.sloSaveDue(time.Now(), time.Now()) {
+		t.Error("save still due after saving")
+	}
+}
@@ -0,0 +1,520 @@
+package mozzle
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Stats collects metrics about mozzle itself - how many applications are
+// monitored, how the firehose and the Cloud Controller behave and how well
+// the emitter keeps up.
+//
+// Stats is safe for concurrent use and its zero value is ready to use.
+// All recording methods are no-ops on a nil *Stats.
+type Stats struct {
+	// InstanceID identifies the mozzle instance. It is attached to all
+	// emitted metrics.
+	InstanceID string
+
+	mu                 sync.Mutex
+	monitoredApps      int
+	envelopes          map[string]uint64
+	firehoseStreams    uint64
+	firehoseConnects   uint64
+	firehoseErrors     uint64
+	rpcs               map[string]*rpcStats
+	ccThrottledCount   uint64
+	ccDelayedCount     uint64
+	retries            uint64
+	retriesExhaust     uint64
+	retryBudgetExhaust uint64
+	retryBudgetLeft    int
+	riemannQueueDepth  int
+	riemannDropped     map[string]uint64
+	riemannSampled     uint64
+	riemannSent        uint64
+	riemannSendLatency time.Duration
+	riemannConnects    uint64
+	riemannErrors      uint64
+
+	// last holds the values at the time of the previous emission, so that
+	// mean latencies can be computed per emission interval.
+	lastRiemannSent    uint64
+	lastRiemannLatency time.Duration
+}
+
+type rpcStats struct {
+	calls    uint64
+	failures uint64
+	latency  time.Duration
+
+	lastCalls   uint64
+	lastLatency time.Duration
+}
+
+// StatsSnapshot is a point-in-time copy of the values collected by Stats.
+type StatsSnapshot struct {
+	InstanceID    string                      `json:"instance_id"`
+	MonitoredApps int                         `json:"monitored_apps"`
+	Envelopes     map[string]uint64           `json:"firehose_envelopes"`
+	Firehose      FirehoseStats               `json:"firehose"`
+	CloudCtrl     map[string]RPCStatsSnapshot `json:"cloud_controller"`
+	Throttling    ThrottlingStats             `json:"throttling"`
+	Retries       RetryStats                  `json:"retries"`
+	Riemann       RiemannStats                `json:"riemann"`
+}
+
+// FirehoseStats describes the health of the firehose streams.
+type FirehoseStats struct {
+	Streams    uint64 `json:"streams"`
+	Reconnects uint64 `json:"reconnects"`
+	Errors     uint64 `json:"errors"`
+}
+
+// ThrottlingStats describes how often Cloud Controller requests were held
+// back.
+type ThrottlingStats struct {
+	// Throttled is the number of requests rejected by the Cloud Controller
+	// with 429 Too Many Requests.
+	Throttled uint64 `json:"throttled"`
+	// Delayed is the number of requests delayed by the client-side rate
+	// limiter.
+	Delayed uint64 `json:"delayed"`
+}
+
+// RetryStats describes the retries of failed calls.
+type RetryStats struct {
+	// Retries is the number of retried calls.
+	Retries uint64 `json:"retries"`
+	// Exhausted is the number of calls that failed after all attempts.
+	Exhausted uint64 `json:"exhausted"`
+	// BudgetExhausted is the number of calls that were not retried because
+	// the retry budget was exhausted.
+	BudgetExhausted uint64 `json:"budget_exhausted"`
+	// BudgetRemaining is the number of retries left in the budget, if one
+	// is configured.
+	BudgetRemaining int `json:"budget_remaining"`
+}
+
+// RPCStatsSnapshot describes the calls made to a single remote endpoint.
+type RPCStatsSnapshot struct {
+	Calls         uint64  `json:"calls"`
+	Failures      uint64  `json:"failures"`
+	MeanLatencyMS float64 `json:"mean_latency_ms"`
+}
+
+// RiemannStats describes the state of the Riemann emitter.
+type RiemannStats struct {
+	QueueDepth int `json:"queue_depth"`
+	// Dropped is the number of metrics dropped due to a full queue or
+	// because they could not be sent.
+	Dropped uint64 `json:"dropped"`
+	// DroppedByService breaks Dropped down by the service of the dropped
+	// metrics.
+	DroppedByService map[string]uint64 `json:"dropped_by_service"`
+	// SampledOut is the number of metrics skipped due to sampling.
+	SampledOut    uint64  `json:"sampled_out"`
+	Sent          uint64  `json:"sent"`
+	Errors        uint64  `json:"errors"`
+	Reconnects    uint64  `json:"reconnects"`
+	MeanLatencyMS float64 `json:"mean_send_latency_ms"`
+}
+
+// Snapshot returns a copy of the currently collected values. A nil *Stats
+// returns an empty snapshot.
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{
+			Envelopes: make(map[string]uint64),
+			CloudCtrl: make(map[string]RPCStatsSnapshot),
+			Riemann:   RiemannStats{DroppedByService: make(map[string]uint64)},
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := StatsSnapshot{
+		InstanceID:    s.InstanceID,
+		MonitoredApps: s.monitoredApps,
+		Envelopes:     make(map[string]uint64),
+		Firehose: FirehoseStats{
+			Streams:    s.firehoseStreams,
+			Reconnects: reconnects(s.firehoseConnects, s.firehoseStreams),
+			Errors:     s.firehoseErrors,
+		},
+		CloudCtrl: make(map[string]RPCStatsSnapshot),
+		Throttling: ThrottlingStats{
+			Throttled: s.ccThrottledCount,
+			Delayed:   s.ccDelayedCount,
+		},
+		Retries: RetryStats{
+			Retries:         s.retries,
+			Exhausted:       s.retriesExhaust,
+			BudgetExhausted: s.retryBudgetExhaust,
+			BudgetRemaining: s.retryBudgetLeft,
+		},
+		Riemann: RiemannStats{
+			QueueDepth:       s.riemannQueueDepth,
+			DroppedByService: make(map[string]uint64),
+			SampledOut:       s.riemannSampled,
+			Sent:             s.riemannSent,
+			Errors:           s.riemannErrors,
+			Reconnects:       reconnects(s.riemannConnects, 1),
+			MeanLatencyMS:    meanMillis(s.riemannSendLatency, s.riemannSent),
+		},
+	}
+	for t, n := range s.envelopes {
+		snap.Envelopes[t] = n
+	}
+	for service, n := range s.riemannDropped {
+		snap.Riemann.DroppedByService[service] = n
+		snap.Riemann.Dropped += n
+	}
+	for endpoint, rpc := range s.rpcs {
+		snap.CloudCtrl[endpoint] = RPCStatsSnapshot{
+			Calls:         rpc.calls,
+			Failures:      rpc.failures,
+			MeanLatencyMS: meanMillis(rpc.latency, rpc.calls),
+		}
+	}
+	return snap
+}
+
+// ServeHTTP serves a JSON encoded snapshot of the collected values, which is
+// empty for a nil *Stats.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Snapshot())
+}
+
+// EmitTo emits the collected values as metrics using e. Latencies are
+// reported as means over the calls made since the previous EmitTo.
+func (s *Stats) EmitTo(e Emitter) {
+	if s == nil {
+		return
+	}
+	// Emitters may record into s, so do not hold the lock while emitting.
+	for _, m := range s.metrics() {
+		e.Emit(m)
+	}
+}
+
+func (s *Stats) metrics() []Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []Metric
+	add := func(service string, metric interface{}, attrs map[string]string) {
+		attributes := map[string]string{"mozzle_instance": s.InstanceID}
+		for k, v := range attrs {
+			attributes[k] = v
+		}
+		res = append(res, Metric{
+			Application:   "mozzle",
+			ApplicationID: s.InstanceID,
+			Service:       service,
+			Metric:        metric,
+			State:         "ok",
+			Attributes:    attributes,
+		})
+	}
+
+	add("mozzle monitored_apps_count", s.monitoredApps, nil)
+
+	for _, t := range sortedKeys(s.envelopes) {
+		add("mozzle firehose envelopes_count", int(s.envelopes[t]), map[string]string{"type": t})
+	}
+	add("mozzle firehose reconnects_count", int(reconnects(s.firehoseConnects, s.firehoseStreams)), nil)
+	add("mozzle firehose errors_count", int(s.firehoseErrors), nil)
+
+	for endpoint, rpc := range s.rpcs {
+		attrs := map[string]string{"endpoint": endpoint}
+		add("mozzle cc requests_count", int(rpc.calls), attrs)
+		add("mozzle cc request_failures_count", int(rpc.failures), attrs)
+		add("mozzle cc request latency_ms", meanMillis(rpc.latency-rpc.lastLatency, rpc.calls-rpc.lastCalls), attrs)
+		rpc.lastCalls, rpc.lastLatency = rpc.calls, rpc.latency
+	}
+	add("mozzle cc throttled_count", int(s.ccThrottledCount), nil)
+	add("mozzle cc delayed_count", int(s.ccDelayedCount), nil)
+	add("mozzle retry retries_count", int(s.retries), nil)
+	add("mozzle retry exhausted_count", int(s.retriesExhaust), nil)
+	add("mozzle retry budget_exhausted_count", int(s.retryBudgetExhaust), nil)
+	add("mozzle retry budget_remaining", s.retryBudgetLeft, nil)
+
+	add("mozzle riemann queue_depth", s.riemannQueueDepth, nil)
+	var dropped uint64
+	for _, service := range sortedKeys(s.riemannDropped) {
+		n := s.riemannDropped[service]
+		add("mozzle riemann service dropped_count", int(n), map[string]string{"dropped_service": service})
+		dropped += n
+	}
+	add("mozzle riemann dropped_count", int(dropped), nil)
+	add("mozzle riemann sampled_out_count", int(s.riemannSampled), nil)
+	add("mozzle riemann errors_count", int(s.riemannErrors), nil)
+	add("mozzle riemann reconnects_count", int(reconnects(s.riemannConnects, 1)), nil)
+	add("mozzle riemann send latency_ms",
+		meanMillis(s.riemannSendLatency-s.lastRiemannLatency, s.riemannSent-s.lastRiemannSent), nil)
+	s.lastRiemannSent, s.lastRiemannLatency = s.riemannSent, s.riemannSendLatency
+	return res
+}
+
+func (s *Stats) setMonitoredApps(n int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.monitoredApps = n
+	s.mu.Unlock()
+}
+
+func (s *Stats) envelopeReceived(t events.Envelope_EventType) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.envelopes == nil {
+		s.envelopes = make(map[string]uint64)
+	}
+	s.envelopes[t.String()]++
+	s.mu.Unlock()
+}
+
+func (s *Stats) firehoseStreamStarted() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.firehoseStreams++
+	s.mu.Unlock()
+}
+
+func (s *Stats) firehoseConnected() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.firehoseConnects++
+	s.mu.Unlock()
+}
+
+func (s *Stats) firehoseError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.firehoseErrors++
+	s.mu.Unlock()
+}
+
+func (s *Stats) rpcDone(endpoint string, latency time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rpcs == nil {
+		s.rpcs = make(map[string]*rpcStats)
+	}
+	rpc, ok := s.rpcs[endpoint]
+	if !ok {
+		rpc = new(rpcStats)
+		s.rpcs[endpoint] = rpc
+	}
+	rpc.calls++
+	rpc.latency += latency
+	if failed {
+		rpc.failures++
+	}
+}
+
+func (s *Stats) ccThrottled() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.ccThrottledCount++
+	s.mu.Unlock()
+}
+
+func (s *Stats) ccDelayed() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.ccDelayedCount++
+	s.mu.Unlock()
+}
+
+func (s *Stats) retried() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.retries++
+	s.mu.Unlock()
+}
+
+func (s *Stats) retriesExhausted() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.retriesExhaust++
+	s.mu.Unlock()
+}
+
+func (s *Stats) retryBudgetExhausted() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.retryBudgetExhaust++
+	s.mu.Unlock()
+}
+
+func (s *Stats) retryBudget(remaining int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.retryBudgetLeft = remaining
+	s.mu.Unlock()
+}
+
+func (s *Stats) riemannQueued(depth int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.riemannQueueDepth = depth
+	s.mu.Unlock()
+}
+
+func (s *Stats) riemannDrop(service string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.riemannDropped == nil {
+		s.riemannDropped = make(map[string]uint64)
+	}
+	s.riemannDropped[service]++
+	s.mu.Unlock()
+}
+
+func (s *Stats) riemannSampledOut() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.riemannSampled++
+	s.mu.Unlock()
+}
+
+func (s *Stats) riemannSend(latency time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if err != nil {
+		s.riemannErrors++
+	} else {
+		s.riemannSent++
+		s.riemannSendLatency += latency
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stats) riemannConnected() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.riemannConnects++
+	s.mu.Unlock()
+}
+
+// reconnects returns the number of connections that were made in addition
+// to the initial ones.
+func reconnects(connects, initial uint64) uint64 {
+	if connects < initial {
+		return 0
+	}
+	return connects - initial
+}
+
+func meanMillis(total time.Duration, n uint64) float64 {
+	if n == 0 {
+		return 0.0
+	}
+	return float64(total) / float64(n) / float64(time.Millisecond)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instrumentedTransport records the latency and outcome of each round trip
+// in Stats.
+type instrumentedTransport struct {
+	base  http.RoundTripper
+	stats *Stats
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	failed := err != nil || resp.StatusCode >= 400
+	t.stats.rpcDone(endpoint(req), time.Since(start), failed)
+	return resp, err
+}
+
+// instrumentClient returns a copy of c that records all requests in s.
+func instrumentClient(c *http.Client, s *Stats) *http.Client {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cpy := *c
+	cpy.Transport = &instrumentedTransport{base: base, stats: s}
+	return &cpy
+}
+
+// endpoint describes the endpoint targeted by req, replacing all GUIDs in
+// the path with a placeholder - e.g. "GET /v2/apps/:guid/summary".
+func endpoint(req *http.Request) string {
+	segments := strings.Split(req.URL.Path, "/")
+	for i, s := range segments {
+		if isGUID(s) {
+			segments[i] = ":guid"
+		}
+	}
+	return req.Method + " " + strings.Join(segments, "/")
+}
+
+func isGUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
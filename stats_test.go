@@ -0,0 +1,107 @@
+package mozzle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// collector implements Emitter that keeps the emitted metrics.
+type collector struct {
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+func (c *collector) Emit(m Metric) {
+	c.mu.Lock()
+	c.metrics = append(c.metrics, m)
+	c.mu.Unlock()
+}
+
+// service returns the emitted metrics with the specified service.
+func (c *collector) service(service string) []Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res []Metric
+	for _, m := range c.metrics {
+		if m.Service == service {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func TestStatsNil(t *testing.T) {
+	var s *Stats
+	s.setMonitoredApps(1)
+	s.envelopeReceived(events.Envelope_HttpStartStop)
+	s.rpcDone("/v2/apps", time.Second, true)
+	s.ccThrottled()
+	s.retried()
+	s.riemannDrop("service")
+
+	snap := s.Snapshot()
+	if snap.Envelopes == nil || snap.CloudCtrl == nil || snap.Riemann.DroppedByService == nil {
+		t.Errorf("Snapshot() = %+v, want non-nil maps", snap)
+	}
+
+	var c collector
+	s.EmitTo(&c)
+	if len(c.metrics) != 0 {
+		t.Errorf("EmitTo() emitted %d metrics, want none", len(c.metrics))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var got StatsSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || got.MonitoredApps != 0 {
+		t.Errorf("ServeHTTP() = %d %+v, want 200 and an empty snapshot", w.Code, got)
+	}
+}
+
+func TestStatsEmitTo(t *testing.T) {
+	s := &Stats{InstanceID: "mozzle-0"}
+	s.setMonitoredApps(3)
+	s.envelopeReceived(events.Envelope_HttpStartStop)
+	s.envelopeReceived(events.Envelope_HttpStartStop)
+	s.rpcDone("/v2/apps", 2*time.Millisecond, false)
+	s.rpcDone("/v2/apps", 4*time.Millisecond, true)
+
+	tests := []struct {
+		service string
+		want    interface{}
+	}{
+		{"mozzle monitored_apps_count", 3},
+		{"mozzle firehose envelopes_count", 2},
+		{"mozzle cc requests_count", 2},
+		{"mozzle cc request_failures_count", 1},
+		{"mozzle cc request latency_ms", 3.0},
+	}
+	var c collector
+	s.EmitTo(&c)
+	for _, tt := range tests {
+		ms := c.service(tt.service)
+		if len(ms) != 1 || ms[0].Metric != tt.want {
+			t.Errorf("%s = %+v, want a single metric of %v", tt.service, ms, tt.want)
+			continue
+		}
+		if ms[0].Attributes["mozzle_instance"] != "mozzle-0" {
+			t.Errorf("%s attributes = %v, want the mozzle instance", tt.service, ms[0].Attributes)
+		}
+	}
+
+	// Latencies are means since the previous emission.
+	var again collector
+	s.EmitTo(&again)
+	if ms := again.service("mozzle cc request latency_ms"); len(ms) != 1 || ms[0].Metric != 0.0 {
+		t.Errorf("latency after no calls = %+v, want 0", ms)
+	}
+}
@@ -0,0 +1,124 @@
+package mozzle
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ParseToken converts the access and refresh token strings to an OAuth2
+// token. The access token must be a JWT bearer token, optionally prefixed
+// with "bearer ".
+func ParseToken(accessToken, refreshToken string) (*oauth2.Token, error) {
+	if strings.HasPrefix(accessToken, "bearer ") {
+		accessToken = accessToken[len("bearer "):]
+	}
+	token, err := parseBearerToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	token.RefreshToken = refreshToken
+	return token, nil
+}
+
+// parseBearerToken converts the string s to an OAuth2 bearer token.
+// It must be of the form <header>.<payload>.<signature>, where header,
+// payload and signature are base64 encoded JSON objects.
+func parseBearerToken(s string) (*oauth2.Token, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid token syntax")
+	}
+	claims, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token claims segment: %v", err)
+	}
+	var t struct {
+		Exp int64 `json:"exp"`
+	}
+	err = json.Unmarshal([]byte(claims), &t)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token claims: %v", err)
+	}
+	return &oauth2.Token{
+		AccessToken: s,
+		TokenType:   "bearer",
+		Expiry:      time.Unix(t.Exp, 0),
+	}, nil
+}
+
+// fileTokenSource provides tokens read from a file. The file is read again
+// whenever its modification time changes, so that tokens can be rotated
+// externally.
+//
+// The file should contain either a JSON encoded OAuth2 token, with
+// access_token, refresh_token, token_type and expiry fields, or a plain
+// access token, optionally prefixed with "bearer ". Tokens that carry a
+// refresh token are refreshed using config when they expire.
+type fileTokenSource struct {
+	path   string
+	ctx    context.Context
+	config *oauth2.Config
+
+	mu      sync.Mutex // guards
+	modTime time.Time
+	src     oauth2.TokenSource
+}
+
+func (f *fileTokenSource) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.src == nil || !fi.ModTime().Equal(f.modTime) {
+		token, err := readTokenFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.src = f.config.TokenSource(f.ctx, token)
+		f.modTime = fi.ModTime()
+	}
+	return f.src.Token()
+}
+
+func readTokenFile(path string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("token file %q is empty", path)
+	}
+	if data[0] != '{' {
+		return ParseToken(string(data), "")
+	}
+
+	token := new(oauth2.Token)
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("error decoding token file %q: %v", path, err)
+	}
+	if token.TokenType == "" {
+		token.TokenType = "bearer"
+	}
+	if token.Expiry.IsZero() {
+		// Fill in the expiry from the claims, if possible.
+		if t, err := parseBearerToken(token.AccessToken); err == nil {
+			token.Expiry = t.Expiry
+		}
+	}
+	return token, nil
+}
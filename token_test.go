@@ -0,0 +1,164 @@
+package mozzle
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// testJWT returns an unsigned JWT that expires at exp.
+func testJWT(exp time.Time) string {
+	enc := base64.RawStdEncoding.EncodeToString
+	claims := `{"exp":` + strconv.FormatInt(exp.Unix(), 10) + `}`
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(claims)) + "." + enc([]byte("sig"))
+}
+
+func TestReadTokenFile(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	jwt := testJWT(exp)
+	tests := []struct {
+		name        string
+		content     string
+		wantAccess  string
+		wantRefresh string
+		wantExpiry  time.Time
+		wantErr     bool
+	}{
+		{name: "plain", content: jwt + "\n", wantAccess: jwt, wantExpiry: exp},
+		{name: "bearer", content: "bearer " + jwt, wantAccess: jwt, wantExpiry: exp},
+		{
+			name:        "json",
+			content:     `{"access_token":"` + jwt + `","refresh_token":"refresh"}`,
+			wantAccess:  jwt,
+			wantRefresh: "refresh",
+			wantExpiry:  exp,
+		},
+		{
+			name:       "json with expiry",
+			content:    `{"access_token":"opaque","expiry":"2030-01-01T00:00:00Z"}`,
+			wantAccess: "opaque",
+			wantExpiry: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{name: "empty", content: " \n", wantErr: true},
+		{name: "not a jwt", content: "opaque", wantErr: true},
+		{name: "invalid json", content: `{"access_token":`, wantErr: true},
+	}
+	dir, err := ioutil.TempDir("", "mozzle-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strconv.Itoa(i))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			token, err := readTokenFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTokenFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if token.AccessToken != tt.wantAccess || token.RefreshToken != tt.wantRefresh || !token.Expiry.Equal(tt.wantExpiry) {
+				t.Errorf("readTokenFile() = %+v, want access %q, refresh %q, expiry %v",
+					token, tt.wantAccess, tt.wantRefresh, tt.wantExpiry)
+			}
+			if token.TokenType != "bearer" {
+				t.Errorf("token type = %q, want bearer", token.TokenType)
+			}
+		})
+	}
+}
+
+func TestFileTokenSourceReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mozzle-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	write := func(token string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := &fileTokenSource{path: path, ctx: context.Background(), config: &oauth2.Config{}}
+	first, second := testJWT(time.Now().Add(time.Hour)), testJWT(time.Now().Add(2*time.Hour))
+	now := time.Now()
+	write(first, now.Add(-time.Minute))
+	for _, want := range []string{first, first} {
+		if token, err := src.Token(); err != nil || token.AccessToken != want {
+			t.Fatalf("Token() = %v, %v, want the first token", token, err)
+		}
+	}
+	write(second, now)
+	if token, err := src.Token(); err != nil || token.AccessToken != second {
+		t.Errorf("Token() after rotation = %v, %v, want the second token", token, err)
+	}
+}
+
+func TestAuthorizedClientTokenFileReload(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "mozzle-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	write := func(token string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := &fileTokenSource{path: path, ctx: context.Background(), config: &oauth2.Config{}}
+	client := authorizedClient(srv.Client(), src)
+	// Both tokens are valid for an hour, so a cached token would be
+	// reused after the file changes.
+	first, second := testJWT(time.Now().Add(time.Hour)), testJWT(time.Now().Add(time.Hour+time.Minute))
+	now := time.Now()
+	write(first, now.Add(-time.Minute))
+	for _, tt := range []struct {
+		token string
+		write bool
+	}{
+		{first, false},
+		{second, true},
+		{second, false},
+	} {
+		if tt.write {
+			write(tt.token, now)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := "Bearer " + tt.token; auth != want {
+			t.Errorf("Authorization = %q, want %q", auth, want)
+		}
+	}
+}
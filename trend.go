@@ -0,0 +1,262 @@
+package mozzle
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	cfevent "github.com/cloudfoundry/sonde-go/events"
+)
+
+// Default trend analysis configuration.
+const (
+	DefaultTrendWindow   = 30 * time.Minute
+	DefaultTrendWarn     = 6 * time.Hour
+	DefaultTrendCritical = time.Hour
+)
+
+// trendMinSamples is the minimum number of samples for estimating a trend.
+const trendMinSamples = 5
+
+// TrendConfig configures the analysis of the memory and disk usage trends of
+// application instances. It requires polling the uptime of the instances of
+// each running application on every refresh, to detect their restarts.
+type TrendConfig struct {
+	// Window is the time over which the growth of the usage is estimated.
+	// Defaults to DefaultTrendWindow.
+	Window time.Duration
+	// Warn and Critical are the projected times until an instance exhausts
+	// its quota below which it is in warn or critical state. They default
+	// to DefaultTrendWarn and DefaultTrendCritical.
+	Warn     time.Duration
+	Critical time.Duration
+}
+
+func (c *TrendConfig) init() {
+	if c.Window == 0 {
+		c.Window = DefaultTrendWindow
+	}
+	if c.Warn == 0 {
+		c.Warn = DefaultTrendWarn
+	}
+	if c.Critical == 0 {
+		c.Critical = DefaultTrendCritical
+	}
+}
+
+// trendSample is a single usage sample.
+type trendSample struct {
+	t     time.Time
+	value float64
+}
+
+// trendWindow is a sliding window of usage samples of a single instance.
+type trendWindow struct {
+	samples []trendSample
+}
+
+// add adds a sample at t, dropping the ones older than window.
+func (w *trendWindow) add(t time.Time, value float64, window time.Duration) {
+	w.samples = append(w.samples, trendSample{t, value})
+	i := 0
+	for i < len(w.samples) && t.Sub(w.samples[i].t) > window {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+// since drops the samples taken before t.
+func (w *trendWindow) since(t time.Time) {
+	i := 0
+	for i < len(w.samples) && w.samples[i].t.Before(t) {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+// slope returns the growth of the usage per second and the usage at the time
+// of the last sample, estimated using linear regression. It returns false
+// if there are not enough samples.
+func (w *trendWindow) slope(window time.Duration) (slope, current float64, ok bool) {
+	n := len(w.samples)
+	if n < trendMinSamples {
+		return 0, 0, false
+	}
+	first, last := w.samples[0].t, w.samples[n-1].t
+	// Estimates over a short time span are too noisy.
+	if last.Sub(first) < window/4 {
+		return 0, 0, false
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range w.samples {
+		x := s.t.Sub(first).Seconds()
+		sumX += x
+		sumY += s.value
+		sumXY += x * s.value
+		sumXX += x * x
+	}
+	fn := float64(n)
+	d := fn*sumXX - sumX*sumX
+	if d == 0 {
+		return 0, 0, false
+	}
+	slope = (fn*sumXY - sumX*sumY) / d
+	intercept := (sumY - slope*sumX) / fn
+	return slope, intercept + slope*last.Sub(first).Seconds(), true
+}
+
+// instanceTrends holds the usage windows of a single instance.
+type instanceTrends struct {
+	memory trendWindow
+	disk   trendWindow
+	// started is the time when the instance started, as of the last poll
+	// of its uptime.
+	started time.Time
+}
+
+// restartTolerance is the difference between the start times of an instance
+// computed from its uptime on two polls, above which it is considered
+// restarted. Uptimes have a precision of one second and are computed at
+// slightly different times than they are received.
+const restartTolerance = 5 * time.Second
+
+// exhaustionTrend describes the projected exhaustion of the memory or disk
+// quota of an application instance.
+type exhaustionTrend struct {
+	Resource string // "memory" or "disk"
+	Index    int32
+	Slope    float64 // in bytes per second
+	Current  float64
+	Quota    uint64
+	Config   TrendConfig
+	App      application
+}
+
+func (t exhaustionTrend) EmitTo(e Emitter) {
+	attributes := attributes(t.App)
+	attributes["instance"] = strconv.Itoa(int(t.Index))
+	attributes["slope_bytes_per_second"] = strconv.FormatFloat(t.Slope, 'f', 2, 64)
+
+	// An instance whose usage is not growing is not projected to exhaust
+	// its quota, which is reported as -1.
+	eta := -1.0
+	state := "ok"
+	if t.Slope > 0 {
+		eta = (float64(t.Quota) - t.Current) / t.Slope
+		if eta < 0 {
+			eta = 0
+		}
+		switch d := time.Duration(eta * float64(time.Second)); {
+		case d <= t.Config.Critical:
+			state = "critical"
+		case d <= t.Config.Warn:
+			state = "warn"
+		}
+	}
+	e.Emit(forApp(t.App, Metric{
+		Service:    t.Resource + " exhaustion_eta_seconds",
+		Metric:     eta,
+		State:      state,
+		Attributes: attributes,
+	}))
+}
+
+// emitTrends adds the container metric to the usage windows of the instance
+// and emits the projected exhaustion of its memory and disk quotas.
+func (m *AppMonitor) emitTrends(app application, cm *cfevent.ContainerMetric, e Emitter) {
+	now := time.Now()
+	index := cm.GetInstanceIndex()
+	config := *m.Trend
+
+	m.mu.Lock()
+	status, ok := m.monitored[app.GUID]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	if status.trends == nil {
+		status.trends = make(map[int32]*instanceTrends)
+	}
+	trends, ok := status.trends[index]
+	if !ok {
+		trends = new(instanceTrends)
+		status.trends[index] = trends
+	}
+	// Instances beyond the configured count are gone after scaling down, so
+	// their windows are dropped, and restart when scaled up again.
+	for i := range status.trends {
+		if n := status.summary.Instances; n > 0 && int(i) >= n {
+			delete(status.trends, i)
+		}
+	}
+	trends.memory.add(now, float64(cm.GetMemoryBytes()), config.Window)
+	trends.disk.add(now, float64(cm.GetDiskBytes()), config.Window)
+	memorySlope, memory, memoryOK := trends.memory.slope(config.Window)
+	diskSlope, disk, diskOK := trends.disk.slope(config.Window)
+	m.mu.Unlock()
+
+	if memoryOK && cm.GetMemoryBytesQuota() > 0 {
+		exhaustionTrend{"memory", index, memorySlope, memory, cm.GetMemoryBytesQuota(), config, app}.EmitTo(e)
+	}
+	if diskOK && cm.GetDiskBytesQuota() > 0 {
+		exhaustionTrend{"disk", index, diskSlope, disk, cm.GetDiskBytesQuota(), config, app}.EmitTo(e)
+	}
+}
+
+// syncInstanceStarts polls the uptime of the application's instances and
+// resets the usage windows of the ones that have restarted since the last
+// poll, as their usage starts over. Applications without running instances
+// as of their last summary are not polled.
+func (m *AppMonitor) syncInstanceStarts(ctx context.Context, app application) {
+	m.mu.Lock()
+	status, ok := m.monitored[app.GUID]
+	running := ok && status.summary.RunningInstances > 0
+	m.mu.Unlock()
+	if !running {
+		return
+	}
+
+	var stats map[string]struct {
+		Stats struct {
+			Uptime int64 `json:"uptime"`
+		} `json:"stats"`
+	}
+	err := m.ccGet(ctx, "/v2/apps/"+app.GUID+"/stats", nil, &stats)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		// Only the first of consecutive failures is logged as a warning,
+		// as they are retried on every refresh.
+		if status.startsFailed {
+			m.Logger.Debug("error fetching app instance stats", app.logArgs("error", err)...)
+		} else {
+			m.Logger.Warn("error fetching app instance stats", app.logArgs("error", err)...)
+		}
+		status.startsFailed = true
+		return
+	}
+	status.startsFailed = false
+	now := time.Now()
+	if status.trends == nil {
+		status.trends = make(map[int32]*instanceTrends)
+	}
+	for i, s := range stats {
+		index, err := strconv.Atoi(i)
+		if err != nil {
+			continue
+		}
+		started := now.Add(-time.Duration(s.Stats.Uptime) * time.Second)
+		trends, ok := status.trends[int32(index)]
+		if !ok {
+			trends = new(instanceTrends)
+			status.trends[int32(index)] = trends
+		}
+		if !trends.started.IsZero() && started.Sub(trends.started) <= restartTolerance {
+			continue
+		}
+		// The samples received since the restart, if any, are kept.
+		trends.memory.since(started)
+		trends.disk.since(started)
+		trends.started = started
+	}
+}
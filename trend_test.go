@@ -0,0 +1,185 @@
+package mozzle
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrendWindowSlope(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	linear := func(n int, step time.Duration, slope float64) []trendSample {
+		var samples []trendSample
+		for i := 0; i < n; i++ {
+			d := time.Duration(i) * step
+			samples = append(samples, trendSample{start.Add(d), 1000 + slope*d.Seconds()})
+		}
+		return samples
+	}
+	tests := []struct {
+		name        string
+		samples     []trendSample
+		wantSlope   float64
+		wantCurrent float64
+		wantOK      bool
+	}{
+		{"growing", linear(7, 5*time.Minute, 10), 10, 1000 + 10*1800, true},
+		{"flat", linear(7, 5*time.Minute, 0), 0, 1000, true},
+		{"shrinking", linear(7, 5*time.Minute, -0.5), -0.5, 1000 - 0.5*1800, true},
+		{"too few samples", linear(4, 10*time.Minute, 10), 0, 0, false},
+		{"too short span", linear(10, time.Minute, 10), 0, 0, false},
+		{
+			"noisy",
+			[]trendSample{
+				{start, 100}, {start.Add(10 * time.Minute), 300}, {start.Add(20 * time.Minute), 200},
+				{start.Add(30 * time.Minute), 400}, {start.Add(40 * time.Minute), 300},
+			},
+			// The least squares fit is 160 + t/12.
+			1.0 / 12, 160 + 2400.0/12, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := trendWindow{samples: tt.samples}
+			slope, current, ok := w.slope(time.Hour)
+			if ok != tt.wantOK || math.Abs(slope-tt.wantSlope) > 1e-9 || math.Abs(current-tt.wantCurrent) > 1e-6 {
+				t.Errorf("slope() = %v, %v, %v, want %v, %v, %v", slope, current, ok, tt.wantSlope, tt.wantCurrent, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTrendWindowAddAndSince(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var w trendWindow
+	for i := 0; i < 10; i++ {
+		w.add(start.Add(time.Duration(i)*time.Minute), float64(i), 5*time.Minute)
+	}
+	if len(w.samples) != 6 || w.samples[0].value != 4 {
+		t.Errorf("samples = %v, want the last 6", w.samples)
+	}
+	w.since(start.Add(7 * time.Minute))
+	if len(w.samples) != 3 || w.samples[0].value != 7 {
+		t.Errorf("samples after since() = %v, want the last 3", w.samples)
+	}
+	w.since(start.Add(time.Hour))
+	if len(w.samples) != 0 {
+		t.Errorf("samples after since() = %v, want none", w.samples)
+	}
+}
+
+func TestExhaustionTrend(t *testing.T) {
+	config := TrendConfig{Warn: 6 * time.Hour, Critical: time.Hour}
+	tests := []struct {
+		name      string
+		slope     float64
+		current   float64
+		wantETA   float64
+		wantState string
+	}{
+		{"soon", 1, 400, 600, "critical"},
+		{"later", 0.1, 400, 6000, "warn"},
+		{"much later", 0.001, 400, 600000, "ok"},
+		{"not growing", 0, 400, -1, "ok"},
+		{"shrinking", -1, 400, -1, "ok"},
+		{"exhausted", 1, 1200, 0, "critical"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c collector
+			exhaustionTrend{"memory", 1, tt.slope, tt.current, 1000, config, testApp("a", "app-a")}.EmitTo(&c)
+			ms := c.service("memory exhaustion_eta_seconds")
+			if len(ms) != 1 {
+				t.Fatalf("emitted %d metrics, want 1", len(ms))
+			}
+			if eta := ms[0].Metric.(float64); math.Abs(eta-tt.wantETA) > 1e-6 || ms[0].State != tt.wantState {
+				t.Errorf("eta = %v %s, want %v %s", eta, ms[0].State, tt.wantETA, tt.wantState)
+			}
+			if ms[0].Attributes["instance"] != "1" {
+				t.Errorf("instance = %q, want 1", ms[0].Attributes["instance"])
+			}
+		})
+	}
+}
+
+func TestSyncInstanceStarts(t *testing.T) {
+	cc := new(fakeCC)
+	m, _ := newTestMonitor(Target{}, cc)
+	app := testApp("a", "app-a")
+	now := time.Now()
+	trends := new(instanceTrends)
+	trends.memory.samples = []trendSample{{now.Add(-2 * time.Hour), 1}, {now.Add(-30 * time.Minute), 2}}
+	m.monitored[app.GUID] = &appStatus{
+		application: app,
+		summary:     appSummary{RunningInstances: 1},
+		trends:      map[int32]*instanceTrends{0: trends},
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		uptime      string
+		wantSamples int
+	}{
+		// Samples from before the instance started are dropped.
+		{"first poll", "3600", 1},
+		{"same start", "3601", 1},
+		{"restarted", "60", 0},
+	}
+	for _, tt := range tests {
+		cc.set("/v2/apps/a/stats", `{"0":{"state":"RUNNING","stats":{"uptime":`+tt.uptime+`}}}`)
+		m.syncInstanceStarts(ctx, app)
+		if n := len(trends.memory.samples); n != tt.wantSamples {
+			t.Errorf("%s: %d samples, want %d", tt.name, n, tt.wantSamples)
+		}
+	}
+}
+
+func TestSyncInstanceStartsNotRunning(t *testing.T) {
+	cc := new(fakeCC)
+	cc.set("/v2/apps/a/stats", `{"0":{"state":"RUNNING","stats":{"uptime":60}}}`)
+	m, _ := newTestMonitor(Target{}, cc)
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app, summary: appSummary{State: "STOPPED"}}
+	m.syncInstanceStarts(context.Background(), app)
+	if n := cc.count("/v2/apps/a/stats"); n != 0 {
+		t.Errorf("stats of an app without running instances fetched %d times", n)
+	}
+}
+
+func TestSyncInstanceStartsFailure(t *testing.T) {
+	cc := new(fakeCC)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	m, _ := newTestMonitor(Target{Logger: logger}, cc)
+	app := testApp("a", "app-a")
+	m.monitored[app.GUID] = &appStatus{application: app, summary: appSummary{RunningInstances: 1}}
+	ctx := context.Background()
+
+	// Consecutive failures are logged as a warning only once.
+	steps := []struct {
+		stats string // empty if failing
+		want  string
+	}{
+		{"", "level=WARN"},
+		{"", "level=DEBUG"},
+		{`{"0":{"stats":{"uptime":60}}}`, ""},
+		{"", "level=WARN"},
+	}
+	for i, s := range steps {
+		cc.set("/v2/apps/a/stats", s.stats)
+		buf.Reset()
+		m.syncInstanceStarts(ctx, app)
+		var got string
+		if buf.Len() > 0 {
+			got = strings.Fields(buf.String())[1]
+		}
+		if got != s.want {
+			t.Errorf("poll %d logged %q, want %q", i, buf.String(), s.want)
+		}
+	}
+}